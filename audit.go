@@ -0,0 +1,59 @@
+package qstash
+
+import (
+	"net/http"
+	"time"
+)
+
+// AuditEntry records a published message for audit logs (see WithAuditLogger).
+// It never includes the token or the message body
+type AuditEntry struct {
+	Destination     string
+	MessageID       string
+	DeduplicationID string
+	// Size is the size of the message body in bytes, or -1 for a stream of unknown length
+	Size      int64
+	Timestamp time.Time
+}
+
+// messageSize returns the size of the message body, or -1 for a stream of unknown length
+func messageSize(m *Message) int64 {
+	if m.BodyStream == nil {
+		return int64(len(m.Body))
+	} else if m.BodyLength > 0 {
+		return m.BodyLength
+	}
+	return -1
+}
+
+// audit logs the published message with the audit logger
+func (q *Publisher) audit(destination, messageID, deduplicationID string, size int64) {
+	if q.auditLogger == nil {
+		return
+	}
+	q.auditLogger(AuditEntry{
+		Destination:     destination,
+		MessageID:       messageID,
+		DeduplicationID: deduplicationID,
+		Size:            size,
+		Timestamp:       time.Now(),
+	})
+}
+
+// auditBatch logs each message of a published batch with the audit logger.
+// The message ids are read from the batch response, which lists them in the order of the messages
+func (q *Publisher) auditBatch(messages []batchMessage, body []byte) {
+	if q.auditLogger == nil {
+		return
+	}
+	var res []publishResponse
+	_ = q.json.Unmarshal(body, &res)
+	header := http.CanonicalHeaderKey(q.deduplicationIDHeader())
+	for i, m := range messages {
+		var messageID string
+		if i < len(res) {
+			messageID = res[i].messageID()
+		}
+		q.audit(m.Destination, messageID, m.Headers[header], m.size)
+	}
+}
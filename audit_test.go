@@ -0,0 +1,95 @@
+package qstash
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPublisher_PublishAudit(t *testing.T) {
+	var entries []AuditEntry
+	q := &Publisher{
+		token:       "token",
+		url:         "url",
+		topic:       "topic",
+		client:      &mockRecordingClient{},
+		uuid:        &mockUUID{uuid: "uuid"},
+		auditLogger: func(entry AuditEntry) { entries = append(entries, entry) },
+	}
+	start := time.Now()
+	if err := q.Publish(context.TODO(), &Message{Body: []byte("message")}); err != nil {
+		t.Fatalf("Publisher.Publish() error = %v", err)
+	} else if err := q.Publish(context.TODO(), &Message{Body: []byte("another message")}, WithDeduplicationID("dedup-id")); err != nil {
+		t.Fatalf("Publisher.Publish() error = %v", err)
+	}
+	want := []AuditEntry{{
+		Destination:     "topic",
+		MessageID:       "mock-id-1",
+		DeduplicationID: "uuid",
+		Size:            7,
+	}, {
+		Destination:     "topic",
+		MessageID:       "mock-id-2",
+		DeduplicationID: "dedup-id",
+		Size:            15,
+	}}
+	if len(entries) != len(want) {
+		t.Fatalf("Publisher.Publish() audit entries = %v, want %v", len(entries), len(want))
+	}
+	for i, entry := range entries {
+		if entry.Timestamp.Before(start) || entry.Timestamp.After(time.Now()) {
+			t.Fatalf("Publisher.Publish() audit timestamp = %v, want the publish time", entry.Timestamp)
+		}
+		entry.Timestamp = time.Time{}
+		if entry != want[i] {
+			t.Fatalf("Publisher.Publish() audit entry = %+v, want %+v", entry, want[i])
+		}
+	}
+
+	// Failed publishes are not audited
+	entries = nil
+	q.client = &mockStatusClient{statusCode: 400}
+	if err := q.Publish(context.TODO(), &Message{Body: []byte("message")}); err == nil {
+		t.Fatalf("Publisher.Publish() error = %v, want an error", err)
+	} else if len(entries) != 0 {
+		t.Fatalf("Publisher.Publish() audit entries = %v, want none for a failed publish", entries)
+	}
+}
+
+func TestPublisher_PublishAuditBatch(t *testing.T) {
+	var entries []AuditEntry
+	q := &Publisher{
+		token:       "token",
+		url:         "url",
+		topic:       "topic",
+		client:      &mockRecordingClient{bodies: []string{`[{"messageId":"msg_1"},{"messageId":"msg_2"}]`}},
+		uuid:        &mockUUID{uuid: "uuid"},
+		batch:       &batcher{maxSize: 2},
+		auditLogger: func(entry AuditEntry) { entries = append(entries, entry) },
+	}
+	for _, body := range []string{"message", "another message"} {
+		if err := q.Publish(context.TODO(), &Message{Body: []byte(body)}); err != nil {
+			t.Fatalf("Publisher.Publish() error = %v", err)
+		}
+	}
+	want := []AuditEntry{{
+		Destination:     "topic",
+		MessageID:       "msg_1",
+		DeduplicationID: "uuid",
+		Size:            7,
+	}, {
+		Destination:     "topic",
+		MessageID:       "msg_2",
+		DeduplicationID: "uuid",
+		Size:            15,
+	}}
+	if len(entries) != len(want) {
+		t.Fatalf("Publisher.Publish() audit entries = %v, want %v", len(entries), len(want))
+	}
+	for i, entry := range entries {
+		entry.Timestamp = time.Time{}
+		if entry != want[i] {
+			t.Fatalf("Publisher.Publish() audit entry = %+v, want %+v", entry, want[i])
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package qstash
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ErrPublisherClosed is returned when publishing with a publisher that has been closed
+var ErrPublisherClosed = errors.New("publisher is closed")
+
+// ErrBatchFull is returned when publishing with batching while the batches that failed with a
+// transient error fill the buffer. Call Flush to send them again before publishing more messages
+var ErrBatchFull = errors.New("batch buffer is full")
+
+// maxBufferedBatches is the number of batches the batch buffer holds before publishing returns ErrBatchFull
+const maxBufferedBatches = 10
+
+// bodyEncodingHeader marks a batched message whose body is base64 encoded because it is not valid utf-8.
+// It is specific to this package, so that the receiver does not decode messages from other publishers
+// that happen to have a 'Body-Encoding' header. qstash strips the 'Upstash-Forward-' prefix when it delivers the message
+const bodyEncodingHeader = "Go-Qstash-Body-Encoding"
+
+// batchMessage is a single message in a request to the qstash batch endpoint
+type batchMessage struct {
+	Destination string            `json:"destination"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        string            `json:"body"`
+	// size is the size of the body before it was encoded
+	size int64
+}
+
+// batcher buffers published messages until they are flushed to the qstash batch endpoint
+type batcher struct {
+	maxSize  int
+	maxDelay time.Duration
+	// maxBuffered is the max number of buffered messages, or 0 for no limit
+	maxBuffered int
+	mu          sync.Mutex
+	messages    []batchMessage
+	timer       *time.Timer
+	err         error
+	closed      bool
+}
+
+// addToBatch buffers the message and flushes the batch once it reaches its max size.
+// The first message of a batch starts a timer that flushes the batch after the max delay.
+// The errors of the flushed batches are returned by Flush, and ErrBatchFull is returned once the batches
+// that failed with a transient error fill the buffer
+func (q *Publisher) addToBatch(ctx context.Context, destination string, header http.Header, body []byte) error {
+	b := q.batch
+	m := batchMessage{
+		Destination: destination,
+		Headers:     make(map[string]string, len(header)+1),
+		Body:        string(body),
+		size:        int64(len(body)),
+	}
+	for k, v := range header {
+		// The batch request is authenticated on its own
+		if k == "Authorization" || k == "User-Agent" {
+			continue
+		}
+		// The batch endpoint takes one value for each header, so the values are joined as they would be in a single header line
+		m.Headers[k] = strings.Join(v, ", ")
+	}
+	// The body is sent as a json string, so a body that is not valid utf-8 is base64 encoded
+	if !utf8.Valid(body) {
+		m.Body = base64.StdEncoding.EncodeToString(body)
+		m.Headers["Upstash-Forward-"+bodyEncodingHeader] = "base64"
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrPublisherClosed
+	} else if b.maxBuffered > 0 && len(b.messages) >= b.maxBuffered {
+		b.mu.Unlock()
+		return ErrBatchFull
+	}
+	b.messages = append(b.messages, m)
+	if len(b.messages) < b.maxSize {
+		q.startBatchTimer()
+		b.mu.Unlock()
+		return nil
+	}
+	b.mu.Unlock()
+	if err := q.flushBatch(ctx); err != nil {
+		q.addBatchError(err)
+	}
+	return nil
+}
+
+// startBatchTimer starts the timer that flushes the batch after the max delay unless it is already running.
+// The batch must be locked
+func (q *Publisher) startBatchTimer() {
+	b := q.batch
+	if b.timer != nil || b.maxDelay <= 0 || len(b.messages) == 0 {
+		return
+	}
+	b.timer = time.AfterFunc(b.maxDelay, func() {
+		if err := q.flushBatch(context.Background()); err != nil {
+			q.addBatchError(err)
+		}
+	})
+}
+
+// addBatchError keeps the error of a batch that was flushed without a caller to return it to, so that Flush can return it
+func (q *Publisher) addBatchError(err error) {
+	q.batch.mu.Lock()
+	q.batch.err = errors.Join(q.batch.err, err)
+	q.batch.mu.Unlock()
+}
+
+// flushBatch sends up to max size of the buffered messages to the qstash batch endpoint.
+// A batch that failed with a transient error is put back in the buffer to be sent again, and a batch
+// that qstash rejected is dropped
+func (q *Publisher) flushBatch(ctx context.Context) error {
+	// Take the buffered messages
+	b := q.batch
+	b.mu.Lock()
+	n := len(b.messages)
+	if n > b.maxSize {
+		n = b.maxSize
+	}
+	messages := b.messages[:n:n]
+	b.messages = b.messages[n:]
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.mu.Unlock()
+	if len(messages) == 0 {
+		return nil
+	}
+
+	// Publish the batch
+	err := q.sendBatch(ctx, messages)
+	var publishErr *PublishError
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil && errors.As(err, &publishErr) && publishErr.IsTransient() {
+		b.messages = append(messages, b.messages...)
+		err = fmt.Errorf("could not publish a batch of %d messages, they will be sent with the next batch %w", len(messages), err)
+	} else if err != nil {
+		err = fmt.Errorf("could not publish a batch of %d messages %w", len(messages), err)
+	}
+	if !b.closed {
+		q.startBatchTimer()
+	}
+	return err
+}
+
+// sendBatch sends the messages to the qstash batch endpoint
+func (q *Publisher) sendBatch(ctx context.Context, messages []batchMessage) error {
+	// Create the request
+	body, err := q.json.Marshal(messages)
+	if err != nil {
+		return fmt.Errorf("could not marshal batch %w", err)
+	}
+	r, err := http.NewRequest(
+		"POST",
+		q.batchURL(),
+		bytes.NewBuffer(body),
+	)
+	if err != nil {
+		return fmt.Errorf("could not create request %w", err)
+	}
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", q.token))
+	r.Header.Set("User-Agent", UserAgent())
+	r.Header.Set("Content-Type", "application/json")
+
+	// Publish the batch
+	rsp, err := q.client.Do(r.WithContext(ctx))
+	if err != nil {
+		return &PublishError{Err: fmt.Errorf("could not complete request %w", err)}
+	}
+	defer rsp.Body.Close()
+	bs, _ := io.ReadAll(rsp.Body)
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return &PublishError{StatusCode: rsp.StatusCode, Body: string(bs)}
+	}
+	q.auditBatch(messages, bs)
+	return nil
+}
+
+// decodeBody decodes the body of a batched message that was base64 encoded because it is not valid utf-8
+func decodeBody(m *Message) error {
+	if m.Headers.Get(bodyEncodingHeader) != "base64" {
+		return nil
+	}
+	body, err := base64.StdEncoding.DecodeString(string(m.Body))
+	if err != nil {
+		return fmt.Errorf("could not decode body %w", err)
+	}
+	m.Body = body
+	return nil
+}
+
+// batchURL returns the qstash batch endpoint for the publish url
+func (q *Publisher) batchURL() string {
+	return q.apiURL("batch")
+}
+
+// Flush publishes all of the messages buffered by WithBatching.
+// It also returns any errors from batches that were flushed after their max delay
+func (q *Publisher) Flush(ctx context.Context) error {
+	if q.batch == nil {
+		return nil
+	}
+	var err error
+	for err == nil && q.batchLen() > 0 {
+		err = q.flushBatch(ctx)
+	}
+	q.batch.mu.Lock()
+	err, q.batch.err = errors.Join(q.batch.err, err), nil
+	q.batch.mu.Unlock()
+	return err
+}
+
+// batchLen returns the number of buffered messages
+func (q *Publisher) batchLen() int {
+	q.batch.mu.Lock()
+	defer q.batch.mu.Unlock()
+	return len(q.batch.messages)
+}
+
+// Close flushes the messages buffered by WithBatching and stops the publisher from accepting new ones
+func (q *Publisher) Close() error {
+	if q.batch == nil {
+		return nil
+	}
+	q.batch.mu.Lock()
+	q.batch.closed = true
+	q.batch.mu.Unlock()
+	return q.Flush(context.Background())
+}
@@ -0,0 +1,275 @@
+package qstash
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockBatchClient struct {
+	mu      sync.Mutex
+	urls    []string
+	batches [][]batchMessage
+	// statusCodes are the status codes of the batch requests in order. The rest succeed
+	statusCodes []int
+}
+
+func (c *mockBatchClient) Do(r *http.Request) (*http.Response, error) {
+	var batch []batchMessage
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.urls = append(c.urls, r.URL.String())
+	c.batches = append(c.batches, batch)
+	statusCode := http.StatusOK
+	if len(c.batches) <= len(c.statusCodes) {
+		statusCode = c.statusCodes[len(c.batches)-1]
+	}
+	c.mu.Unlock()
+	return &http.Response{
+		StatusCode: statusCode,
+		Body:       io.NopCloser(bytes.NewBufferString("[]")),
+	}, nil
+}
+
+func (c *mockBatchClient) sizes() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sizes []int
+	for _, batch := range c.batches {
+		sizes = append(sizes, len(batch))
+	}
+	return sizes
+}
+
+func TestPublisher_PublishWithBatching(t *testing.T) {
+	tests := []struct {
+		name             string
+		maxSize          int
+		maxDelay         time.Duration
+		messages         int
+		wait             time.Duration
+		wantBeforeFlush  []int
+		wantAfterFlush   []int
+		wantDelayedFlush bool
+	}{{
+		name:            "Coalesce by size",
+		maxSize:         2,
+		messages:        5,
+		wantBeforeFlush: []int{2, 2},
+		wantAfterFlush:  []int{2, 2, 1},
+	}, {
+		name:             "Coalesce by time",
+		maxSize:          10,
+		maxDelay:         10 * time.Millisecond,
+		messages:         3,
+		wantBeforeFlush:  []int{3},
+		wantAfterFlush:   []int{3},
+		wantDelayedFlush: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockBatchClient{}
+			q := &Publisher{
+				token:  "token",
+				url:    "https://qstash.upstash.io/v2/publish",
+				topic:  "topic",
+				client: client,
+				uuid:   &mockUUID{uuid: "uuid"},
+				batch: &batcher{
+					maxSize:  tt.maxSize,
+					maxDelay: tt.maxDelay,
+				},
+			}
+			for i := 0; i < tt.messages; i++ {
+				if err := q.Publish(context.TODO(), &Message{Body: []byte("message")}); err != nil {
+					t.Fatalf("Publisher.Publish() error = %v", err)
+				}
+			}
+			// Wait for the delayed flush
+			if tt.wantDelayedFlush {
+				for start := time.Now(); len(client.sizes()) == 0 && time.Since(start) < time.Second; {
+					time.Sleep(tt.maxDelay)
+				}
+			}
+			if got := client.sizes(); !equalInts(got, tt.wantBeforeFlush) {
+				t.Fatalf("Publisher.Publish() batch sizes = %v, want %v", got, tt.wantBeforeFlush)
+			}
+			if err := q.Close(); err != nil {
+				t.Fatalf("Publisher.Close() error = %v", err)
+			} else if got := client.sizes(); !equalInts(got, tt.wantAfterFlush) {
+				t.Fatalf("Publisher.Close() batch sizes = %v, want %v", got, tt.wantAfterFlush)
+			} else if err := q.Publish(context.TODO(), &Message{Body: []byte("message")}); err != ErrPublisherClosed {
+				t.Fatalf("Publisher.Publish() after close error = %v, want %v", err, ErrPublisherClosed)
+			}
+
+			// Verify the batch requests
+			for _, url := range client.urls {
+				if url != "https://qstash.upstash.io/v2/batch" {
+					t.Fatalf("Publisher.Flush() url = %v, want %v", url, "https://qstash.upstash.io/v2/batch")
+				}
+			}
+			m := client.batches[0][0]
+			if m.Destination != "topic" {
+				t.Fatalf("Publisher.Flush() destination = %v, want %v", m.Destination, "topic")
+			} else if m.Body != "message" {
+				t.Fatalf("Publisher.Flush() body = %v, want %v", m.Body, "message")
+			} else if m.Headers["Upstash-Deduplication-Id"] != "uuid" {
+				t.Fatalf("Publisher.Flush() headers = %v, want a deduplication id", m.Headers)
+			} else if _, ok := m.Headers["Authorization"]; ok {
+				t.Fatalf("Publisher.Flush() headers = %v, want no authorization", m.Headers)
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishWithBatchingFailure(t *testing.T) {
+	tests := []struct {
+		name           string
+		statusCode     int
+		wantAfterFlush []int
+		wantTransient  bool
+	}{{
+		name:           "A transient failure sends the batch again",
+		statusCode:     http.StatusInternalServerError,
+		wantAfterFlush: []int{2, 2, 1},
+		wantTransient:  true,
+	}, {
+		name:           "A rejected batch is dropped",
+		statusCode:     http.StatusBadRequest,
+		wantAfterFlush: []int{2, 1},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockBatchClient{statusCodes: []int{tt.statusCode}}
+			q := &Publisher{
+				token:  "token",
+				url:    "https://qstash.upstash.io/v2/publish",
+				topic:  "topic",
+				client: client,
+				uuid:   &mockUUID{uuid: "uuid"},
+				batch:  &batcher{maxSize: 2},
+			}
+			for i := 0; i < 3; i++ {
+				if err := q.Publish(context.TODO(), &Message{Body: []byte("message")}); err != nil {
+					t.Fatalf("Publisher.Publish() error = %v", err)
+				}
+			}
+			err := q.Flush(context.TODO())
+			var publishErr *PublishError
+			if !errors.As(err, &publishErr) {
+				t.Fatalf("Publisher.Flush() error = %v, want the error of the failed batch", err)
+			} else if publishErr.StatusCode != tt.statusCode {
+				t.Fatalf("Publisher.Flush() status code = %v, want %v", publishErr.StatusCode, tt.statusCode)
+			}
+			if err := q.Flush(context.TODO()); err != nil {
+				t.Fatalf("Publisher.Flush() error = %v", err)
+			} else if got := client.sizes(); !equalInts(got, tt.wantAfterFlush) {
+				t.Fatalf("Publisher.Flush() batch sizes = %v, want %v", got, tt.wantAfterFlush)
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishWithBatchingFull(t *testing.T) {
+	client := &mockBatchClient{statusCodes: []int{
+		http.StatusInternalServerError,
+		http.StatusInternalServerError,
+		http.StatusInternalServerError,
+	}}
+	q := &Publisher{
+		token:  "token",
+		url:    "https://qstash.upstash.io/v2/publish",
+		topic:  "topic",
+		client: client,
+		uuid:   &mockUUID{uuid: "uuid"},
+		batch:  &batcher{maxSize: 2, maxBuffered: 4},
+	}
+	for i := 0; i < 4; i++ {
+		if err := q.Publish(context.TODO(), &Message{Body: []byte("message")}); err != nil {
+			t.Fatalf("Publisher.Publish() error = %v", err)
+		}
+	}
+	if err := q.Publish(context.TODO(), &Message{Body: []byte("message")}); !errors.Is(err, ErrBatchFull) {
+		t.Fatalf("Publisher.Publish() error = %v, want %v", err, ErrBatchFull)
+	} else if got := q.batchLen(); got != 4 {
+		t.Fatalf("Publisher.Publish() buffered = %v, want %v", got, 4)
+	}
+
+	// Flushing the failed batches makes room for more messages
+	if err := q.Flush(context.TODO()); err == nil {
+		t.Fatalf("Publisher.Flush() error = %v, want the errors of the failed batches", err)
+	} else if got := q.batchLen(); got != 0 {
+		t.Fatalf("Publisher.Flush() buffered = %v, want %v", got, 0)
+	} else if err := q.Publish(context.TODO(), &Message{Body: []byte("message")}); err != nil {
+		t.Fatalf("Publisher.Publish() error = %v", err)
+	}
+}
+
+func TestPublisher_PublishWithBatchingEncoding(t *testing.T) {
+	client := &mockBatchClient{}
+	q := &Publisher{
+		token:  "token",
+		url:    "https://qstash.upstash.io/v2/publish",
+		topic:  "topic",
+		client: client,
+		uuid:   &mockUUID{uuid: "uuid"},
+		batch:  &batcher{maxSize: 10},
+	}
+	body := []byte{0xff, 0xfe, 'm'}
+	if err := q.Publish(context.TODO(), &Message{
+		Headers: http.Header{"Upstash-Forward-Tag": []string{"a", "b"}},
+		Body:    body,
+	}); err != nil {
+		t.Fatalf("Publisher.Publish() error = %v", err)
+	} else if err := q.Flush(context.TODO()); err != nil {
+		t.Fatalf("Publisher.Flush() error = %v", err)
+	}
+	m := client.batches[0][0]
+	if got := m.Headers["Upstash-Forward-Tag"]; got != "a, b" {
+		t.Fatalf("Publisher.Flush() header Upstash-Forward-Tag = %v, want %v", got, "a, b")
+	} else if got := m.Headers["Upstash-Forward-Go-Qstash-Body-Encoding"]; got != "base64" {
+		t.Fatalf("Publisher.Flush() header Upstash-Forward-Go-Qstash-Body-Encoding = %v, want %v", got, "base64")
+	}
+
+	// The receiver decodes the body
+	received := Message{
+		Headers: http.Header{"Go-Qstash-Body-Encoding": []string{"base64"}},
+		Body:    []byte(m.Body),
+	}
+	if err := decodeBody(&received); err != nil {
+		t.Fatalf("decodeBody() error = %v", err)
+	} else if !bytes.Equal(received.Body, body) {
+		t.Fatalf("decodeBody() body = %v, want %v", received.Body, body)
+	}
+
+	// Messages from other publishers with a generic body encoding header are not decoded
+	other := Message{
+		Headers: http.Header{"Body-Encoding": []string{"base64"}},
+		Body:    []byte("not base64!"),
+	}
+	if err := decodeBody(&other); err != nil {
+		t.Fatalf("decodeBody() error = %v", err)
+	} else if string(other.Body) != "not base64!" {
+		t.Fatalf("decodeBody() body = %s, want %s", other.Body, "not base64!")
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package qstash
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// bodyRefHeader marks a message whose body is the reference of a body in a BodyStore.
+// qstash strips the 'Upstash-Forward-' prefix when it delivers the message
+const bodyRefHeader = "Body-Ref"
+
+// BodyStore keeps the bodies of large messages out of qstash (see WithBodyStore and WithReceiverBodyStore).
+// The publisher puts the body in the store and publishes its reference instead, and the receiver
+// gets the body back with the reference before the message is handled, e.g. from object storage.
+// The store is responsible for deleting bodies, e.g. with an expiry rule that outlasts the retries
+type BodyStore interface {
+	// Put stores the body and returns the reference to get it with
+	Put(ctx context.Context, body []byte) (ref string, err error)
+	// Get returns the body of the reference
+	Get(ctx context.Context, ref string) ([]byte, error)
+}
+
+// offloadBody puts the body of a message that is over the body store threshold in the body store
+// and returns a copy of the message with the reference as its body
+func (q *Publisher) offloadBody(ctx context.Context, m *Message) (*Message, error) {
+	if q.bodyStore == nil || m.BodyStream != nil || len(m.Body) <= q.bodyStoreThreshold {
+		return m, nil
+	}
+	ref, err := q.bodyStore.Put(ctx, m.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not store body %w", err)
+	}
+	offloaded := *m
+	offloaded.Body = []byte(ref)
+	offloaded.Headers = make(http.Header, len(m.Headers)+1)
+	for k, v := range m.Headers {
+		offloaded.Headers[k] = v
+	}
+	offloaded.Headers.Set("Upstash-Forward-"+bodyRefHeader, "true")
+	return &offloaded, nil
+}
+
+// rehydrateBody replaces the body of a message that was offloaded to the body store with the stored body
+func (q *Receiver) rehydrateBody(ctx context.Context, m *Message) error {
+	if q.bodyStore == nil || m.Headers.Get(bodyRefHeader) != "true" {
+		return nil
+	}
+	body, err := q.bodyStore.Get(ctx, string(m.Body))
+	if err != nil {
+		return fmt.Errorf("could not get stored body %w", err)
+	}
+	m.Body = body
+	return nil
+}
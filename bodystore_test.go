@@ -0,0 +1,105 @@
+package qstash_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marksalpeter/go-qstash"
+	"github.com/marksalpeter/go-qstash/qstashtest"
+)
+
+// memoryBodyStore keeps the stored bodies in memory
+type memoryBodyStore struct {
+	mu     sync.Mutex
+	bodies map[string][]byte
+}
+
+func (s *memoryBodyStore) Put(_ context.Context, body []byte) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ref := fmt.Sprintf("bodies/%d", len(s.bodies))
+	s.bodies[ref] = body
+	return ref, nil
+}
+
+func (s *memoryBodyStore) Get(_ context.Context, ref string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, ok := s.bodies[ref]
+	if !ok {
+		return nil, fmt.Errorf("body %s not found", ref)
+	}
+	return body, nil
+}
+
+func TestBodyStore_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          []byte
+		wantOffloaded bool
+	}{{
+		name:          "Offload a large body",
+		body:          bytes.Repeat([]byte("a"), 4*1024*1024),
+		wantOffloaded: true,
+	}, {
+		name: "Publish a small body",
+		body: []byte("message"),
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &memoryBodyStore{bodies: make(map[string][]byte)}
+			s := qstashtest.NewServer()
+			defer s.Close()
+
+			// Create a receiver behind a test server
+			r, err := qstash.NewReceiver(
+				qstash.WithSigningKey(s.SigningKey),
+				qstash.WithNextSigningKey(s.NextSigningKey),
+				qstash.WithReceiverBodyStore(store),
+			)
+			if err != nil {
+				t.Fatalf("NewReceiver() error = %v", err)
+			}
+			received := make(chan []byte, 1)
+			receiver := httptest.NewServer(r.Receive(func(_ context.Context, m *qstash.Message) {
+				received <- m.Body
+				m.Ack()
+			}))
+			defer receiver.Close()
+
+			// Publish the message through the qstash test server
+			p, err := qstash.NewPublisher(receiver.URL,
+				qstash.WithQStashURL(s.PublishURL()),
+				qstash.WithQStashToken(s.Token),
+				qstash.WithBodyStore(store, 1024),
+			)
+			if err != nil {
+				t.Fatalf("NewPublisher() error = %v", err)
+			}
+			m := &qstash.Message{Body: tt.body}
+			if _, err := p.PublishWithResult(context.TODO(), m); err != nil {
+				t.Fatalf("Publisher.PublishWithResult() error = %v", err)
+			} else if !bytes.Equal(m.Body, tt.body) {
+				t.Fatalf("Publisher.PublishWithResult() changed the message body")
+			}
+
+			// Check the body was offloaded and received in full
+			if offloaded := len(store.bodies) > 0; offloaded != tt.wantOffloaded {
+				t.Fatalf("Publisher.PublishWithResult() offloaded = %v, want %v", offloaded, tt.wantOffloaded)
+			}
+			select {
+			case body := <-received:
+				if !bytes.Equal(body, tt.body) {
+					t.Fatalf("Receiver.Receive() body has %d bytes, want %d bytes", len(body), len(tt.body))
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Receiver.Receive() did not receive the message")
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package qstash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrNotCallback is returned when decoding the callback result of a message that is not a callback
+var ErrNotCallback = errors.New("message is not a callback")
+
+// CallbackResult is the body of a callback request that qstash sends to the callback url
+// of a message (see WithCallback) with the response of the message's destination
+type CallbackResult struct {
+	// Status is the status code of the destination's response
+	Status int `json:"status"`
+	// Header is the header of the destination's response
+	Header http.Header `json:"header"`
+	// Body is the body of the destination's response
+	Body []byte `json:"body"`
+	// Retried is the number of times the message was retried
+	Retried int `json:"retried"`
+	// MaxRetries is the max number of times the message can be retried
+	MaxRetries int `json:"maxRetries"`
+	// SourceMessageID is the id of the message the destination responded to
+	SourceMessageID string `json:"sourceMessageId"`
+	// URL is the destination of the message
+	URL string `json:"url"`
+	// Method is the http method the message was delivered with
+	Method string `json:"method"`
+}
+
+// IsCallback returns true if the message is a callback request with the response of another message's destination.
+// Callbacks are signed like any other message, so the same receiver can verify them
+func (m *Message) IsCallback() bool {
+	_, err := m.CallbackResult()
+	return err == nil
+}
+
+// CallbackResult decodes the body of a callback request.
+// It returns ErrNotCallback if the message is not a callback
+func (m *Message) CallbackResult() (*CallbackResult, error) {
+	var result CallbackResult
+	if err := json.Unmarshal(m.Body, &result); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNotCallback, err)
+	} else if len(result.SourceMessageID) == 0 {
+		return nil, fmt.Errorf("%w: missing source message id", ErrNotCallback)
+	}
+	return &result, nil
+}
@@ -0,0 +1,84 @@
+package qstash
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMessage_CallbackResult(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		wantIsCallback bool
+		wantResult     CallbackResult
+	}{{
+		name:           "Receive a callback",
+		body:           `{"status":200,"header":{"Content-Type":["text/plain"]},"body":"cmVzdWx0","retried":1,"maxRetries":3,"sourceMessageId":"msg_1","url":"https://example.com","method":"POST"}`,
+		wantIsCallback: true,
+		wantResult: CallbackResult{
+			Status:          http.StatusOK,
+			Header:          http.Header{"Content-Type": []string{"text/plain"}},
+			Body:            []byte("result"),
+			Retried:         1,
+			MaxRetries:      3,
+			SourceMessageID: "msg_1",
+			URL:             "https://example.com",
+			Method:          http.MethodPost,
+		},
+	}, {
+		name: "Receive a json message",
+		body: `{"status":200}`,
+	}, {
+		name: "Receive a text message",
+		body: "message",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewReceiver(WithSigningKey("key"), WithNextSigningKey("next key"))
+			if err != nil {
+				t.Fatalf("NewReceiver() error = %v", err)
+			}
+			signature, err := GenerateSignature([]byte(tt.body), "key", "Upstash", time.Minute)
+			if err != nil {
+				t.Fatalf("GenerateSignature() error = %v", err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(tt.body)))
+			r.Header.Set("Upstash-Signature", signature)
+			w := httptest.NewRecorder()
+			var received *Message
+			q.Receive(func(_ context.Context, m *Message) {
+				received = m
+				m.Ack()
+			}).ServeHTTP(w, r)
+			if received == nil {
+				t.Fatalf("Receiver.Receive() status = %v, want the callback to be verified", w.Code)
+			} else if received.IsCallback() != tt.wantIsCallback {
+				t.Fatalf("Message.IsCallback() = %v, want %v", received.IsCallback(), tt.wantIsCallback)
+			}
+			result, err := received.CallbackResult()
+			if !tt.wantIsCallback {
+				if !errors.Is(err, ErrNotCallback) {
+					t.Fatalf("Message.CallbackResult() error = %v, want %v", err, ErrNotCallback)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("Message.CallbackResult() error = %v", err)
+			}
+			if result.Status != tt.wantResult.Status ||
+				result.Header.Get("Content-Type") != tt.wantResult.Header.Get("Content-Type") ||
+				string(result.Body) != string(tt.wantResult.Body) ||
+				result.Retried != tt.wantResult.Retried ||
+				result.MaxRetries != tt.wantResult.MaxRetries ||
+				result.SourceMessageID != tt.wantResult.SourceMessageID ||
+				result.URL != tt.wantResult.URL ||
+				result.Method != tt.wantResult.Method {
+				t.Fatalf("Message.CallbackResult() = %+v, want %+v", result, tt.wantResult)
+			}
+		})
+	}
+}
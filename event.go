@@ -0,0 +1,70 @@
+package qstash
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+// ErrEventType is returned when a message does not carry the expected event type
+var ErrEventType = errors.New("unexpected event type")
+
+// eventTypeHeader is the header that carries the event type of a message.
+// qstash strips the 'Upstash-Forward-' prefix when it delivers the message
+const eventTypeHeader = "Event-Type"
+
+// PublishEvent marshals the event to json and publishes it with an
+// 'Upstash-Forward-Event-Type' header set to the name of the event type
+func PublishEvent[T any](ctx context.Context, p *Publisher, event T, opts ...PublishOption) (*PublishResult, error) {
+	eventType, err := eventTypeOf[T]()
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal event %w", err)
+	}
+	return p.PublishWithResult(ctx, &Message{
+		Headers: http.Header{
+			"Upstash-Forward-" + eventTypeHeader: []string{eventType},
+		},
+		Body: body,
+	}, opts...)
+}
+
+// DecodeEvent decodes a message published with PublishEvent.
+// It returns ErrEventType if the message does not carry an event of type T.
+// Note: the event is always decoded with encoding/json, as the receiver does not know the codec set
+// with WithJSONCodec, so a custom codec must produce json that encoding/json can decode
+func DecodeEvent[T any](m *Message) (T, error) {
+	var event T
+	eventType, err := eventTypeOf[T]()
+	if err != nil {
+		return event, err
+	} else if m.EventType() != eventType {
+		return event, fmt.Errorf("%w: got '%s', want '%s'", ErrEventType, m.EventType(), eventType)
+	} else if err := json.Unmarshal(m.Body, &event); err != nil {
+		return event, fmt.Errorf("could not unmarshal event %w", err)
+	}
+	return event, nil
+}
+
+// EventType returns the event type of a message published with PublishEvent
+func (m *Message) EventType() string {
+	return m.Headers.Get(eventTypeHeader)
+}
+
+// eventTypeOf returns the name of the event type T, dereferencing pointers
+func eventTypeOf[T any]() (string, error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Name() == "" {
+		return "", fmt.Errorf("event type must be a named type, got %s", t)
+	}
+	return t.Name(), nil
+}
@@ -0,0 +1,90 @@
+package qstash
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+type orderCreated struct {
+	OrderID string `json:"orderId"`
+}
+
+func TestPublishEvent(t *testing.T) {
+	client := &mockClient{}
+	q := &Publisher{
+		token:  "token",
+		url:    "url",
+		topic:  "topic",
+		client: client,
+		uuid:   &mockUUID{uuid: "uuid"},
+	}
+	if _, err := PublishEvent(context.TODO(), q, &orderCreated{OrderID: "order-id"}); err != nil {
+		t.Fatalf("PublishEvent() error = %v", err)
+	}
+	if got := client.r.Header.Get("Upstash-Forward-Event-Type"); got != "orderCreated" {
+		t.Fatalf("PublishEvent() header Upstash-Forward-Event-Type = %v, want %v", got, "orderCreated")
+	} else if got := client.r.Header.Get("Content-Type"); got != "application/json" {
+		t.Fatalf("PublishEvent() header Content-Type = %v, want %v", got, "application/json")
+	}
+	if bs, err := io.ReadAll(client.r.Body); err != nil {
+		t.Fatalf("PublishEvent() error reading body = %v", err)
+	} else if string(bs) != `{"orderId":"order-id"}` {
+		t.Fatalf("PublishEvent() body = %s, want %s", bs, `{"orderId":"order-id"}`)
+	}
+	if _, err := PublishEvent(context.TODO(), q, map[string]string{}); err == nil {
+		t.Fatalf("PublishEvent() with an unnamed type error = %v, want an error", err)
+	}
+}
+
+func TestDecodeEvent(t *testing.T) {
+	tests := []struct {
+		name      string
+		message   Message
+		want      orderCreated
+		wantErr   bool
+		wantErrIs error
+	}{{
+		name: "Decode event",
+		message: Message{
+			Headers: http.Header{"Event-Type": []string{"orderCreated"}},
+			Body:    []byte(`{"orderId":"order-id"}`),
+		},
+		want: orderCreated{OrderID: "order-id"},
+	}, {
+		name: "Decode event with a different type fails",
+		message: Message{
+			Headers: http.Header{"Event-Type": []string{"orderDeleted"}},
+			Body:    []byte(`{"orderId":"order-id"}`),
+		},
+		wantErr:   true,
+		wantErrIs: ErrEventType,
+	}, {
+		name: "Decode event with a bad body fails",
+		message: Message{
+			Headers: http.Header{"Event-Type": []string{"orderCreated"}},
+			Body:    []byte(`not json`),
+		},
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeEvent[orderCreated](&tt.message)
+			if err != nil {
+				if !tt.wantErr {
+					t.Fatalf("DecodeEvent() error = %v, wantErr %v", err, tt.wantErr)
+				} else if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+					t.Fatalf("DecodeEvent() error = %v, want %v", err, tt.wantErrIs)
+				}
+				return
+			} else if tt.wantErr {
+				t.Fatalf("DecodeEvent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("DecodeEvent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,7 +1,12 @@
 package qstash
 
 import (
+	"context"
+	"crypto/tls"
+	"math/rand"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -11,6 +16,18 @@ type httpClient struct {
 	MaxBackOff time.Duration
 	MinBackOff time.Duration
 	Retries    int
+	// MaintenanceBackOff is the back off used for 503s when it is greater than 0
+	MaintenanceBackOff time.Duration
+	// RateLimitMaxWait is how long to wait out 429s without using up the retries when it is greater than 0
+	RateLimitMaxWait time.Duration
+	// Jitter randomizes the exponential back off between half and all of its duration
+	Jitter bool
+	// random returns a random number in [0, n) for the jitter. The default is math/rand
+	random func(n int64) int64
+	// RetryableStatuses are the status codes that are retried when it is not nil. By default 429s and 5xxs are retried
+	RetryableStatuses map[int]bool
+	// retrySemaphore bounds the number of concurrent retries when it is not nil
+	retrySemaphore chan struct{}
 }
 
 // Do executes the http request with retry logic
@@ -18,25 +35,182 @@ func (c *httpClient) Do(req *http.Request) (*http.Response, error) {
 	// Execute the request
 	var resp *http.Response
 	var err error
+	var waited time.Duration
+	release := func() {}
 	for i := 1; i <= c.Retries+1; i++ {
 		// Execute the request
 		resp, err = c.client.Do(req)
+		release()
+		release = func() {}
+		if attempts, ok := req.Context().Value(attemptsKey{}).(*int); ok {
+			*attempts = i
+		}
+		// Block on rate limits without using up an attempt
+		if err == nil && resp.StatusCode == http.StatusTooManyRequests && c.RateLimitMaxWait > 0 {
+			wait := c.getRateLimitWait(resp, waited)
+			if wait < 0 {
+				break
+			}
+			if !rewindBody(req) {
+				break
+			}
+			resp.Body.Close()
+			waited += wait
+			if err := sleep(req.Context(), wait); err != nil {
+				return nil, err
+			}
+			i--
+			continue
+		}
 		// If there is an error or the status code is not in the 200's, wait and try again
-		if err != nil || !c.isStatusOK(resp.StatusCode) {
-			time.Sleep(c.getExponentialBackOffDuration(i))
+		if c.isRetryable(resp, err) && i <= c.Retries && rewindBody(req) {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if release, err = c.acquireRetry(req.Context()); err != nil {
+				return nil, err
+			}
+			if err := sleep(req.Context(), c.getBackOffDuration(resp, i)); err != nil {
+				release()
+				return nil, err
+			}
 			continue
 		}
-		// Return the successful response
+		// Return the response
 		break
 	}
 	return resp, err
 }
 
+// sleep waits for the duration or until the context is done, whichever comes first
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// acquireRetry waits for a free retry slot or until the context is done
+// and returns a function that releases the slot
+func (c *httpClient) acquireRetry(ctx context.Context) (func(), error) {
+	if c.retrySemaphore == nil {
+		return func() {}, nil
+	}
+	select {
+	case c.retrySemaphore <- struct{}{}:
+		return func() {
+			<-c.retrySemaphore
+		}, nil
+	case <-ctx.Done():
+		return func() {}, ctx.Err()
+	}
+}
+
+// rewindBody resets the body of the request so that it can be sent again.
+// It returns false if the body has been read and can not be reset
+func rewindBody(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true
+	} else if req.GetBody == nil {
+		return false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return false
+	}
+	req.Body = body
+	return true
+}
+
+// attemptsKey is the context key httpClient.Do reports its number of attempts to
+type attemptsKey struct{}
+
+// withAttempts returns a context that records the number of attempts httpClient.Do makes in attempts
+func withAttempts(ctx context.Context, attempts *int) context.Context {
+	return context.WithValue(ctx, attemptsKey{}, attempts)
+}
+
 // isStatusOK returns true if the status code is between 200 and 299
 func (c *httpClient) isStatusOK(statusCode int) bool {
 	return statusCode >= 200 && statusCode < 300
 }
 
+// isRetryable returns true if the request failed and is worth retrying.
+// Other 4xxs, like a 401 for a bad token or a 410 for a deleted destination, are permanent, so retrying them is pointless
+func (c *httpClient) isRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	} else if c.isStatusOK(resp.StatusCode) {
+		return false
+	} else if c.RetryableStatuses != nil {
+		return c.RetryableStatuses[resp.StatusCode]
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// getRateLimitWait returns how long to wait before retrying a 429, respecting the 'Retry-After' header.
+// It returns a negative duration if the wait would exceed the remaining rate limit wait budget
+func (c *httpClient) getRateLimitWait(resp *http.Response, waited time.Duration) time.Duration {
+	remaining := c.RateLimitMaxWait - waited
+	if remaining <= 0 {
+		return -1
+	}
+	wait, ok := retryAfter(resp)
+	if ok && wait > remaining {
+		return -1
+	} else if wait < c.MinBackOff {
+		// Wait for at least the min back off, so that a 'Retry-After' of 0 or of a date
+		// in the past does not retry right away until the max wait is used up
+		wait = c.MinBackOff
+	}
+	if wait > remaining {
+		return remaining
+	}
+	return wait
+}
+
+// retryAfter parses the 'Retry-After' header of the response as seconds or as an http date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if len(v) == 0 {
+		return 0, false
+	} else if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	} else if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// getBackOffDuration returns the back off duration before retrying the response.
+// QStash responds with a 503 during maintenance windows, which use the longer maintenance back off,
+// and with a 429 when it rate limits, which waits for at least its 'Retry-After' up to the max back off
+func (c *httpClient) getBackOffDuration(resp *http.Response, attempt int) time.Duration {
+	if resp != nil && resp.StatusCode == http.StatusServiceUnavailable && c.MaintenanceBackOff > 0 {
+		return c.MaintenanceBackOff
+	}
+	backOff := c.getExponentialBackOffDuration(attempt)
+	if c.Jitter {
+		backOff = c.jitter(backOff)
+	}
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		if wait, ok := retryAfter(resp); ok && wait > backOff {
+			backOff = wait
+		}
+		if backOff > c.MaxBackOff {
+			backOff = c.MaxBackOff
+		}
+	}
+	return backOff
+}
+
 // getExponentialBackOffDuration returns a the exponential back off duration between
 // the min and max values based on the number of attempted requests
 func (c *httpClient) getExponentialBackOffDuration(attempt int) time.Duration {
@@ -50,3 +224,60 @@ func (c *httpClient) getExponentialBackOffDuration(attempt int) time.Duration {
 	}
 	return exp
 }
+
+// jitter returns a random duration between half and all of the back off ("equal jitter")
+func (c *httpClient) jitter(backOff time.Duration) time.Duration {
+	half := backOff / 2
+	if half <= 0 {
+		return backOff
+	}
+	random := c.random
+	if random == nil {
+		random = rand.Int63n
+	}
+	return backOff - half + time.Duration(random(int64(half)+1))
+}
+
+// newTransport returns a copy of the default http transport configured with the publisher options
+func newTransport(o *PublisherOptions) *http.Transport {
+	transport := defaultTransport()
+	if o.Client.DialTimeout > 0 {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   o.Client.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	if o.Client.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = o.Client.TLSHandshakeTimeout
+	}
+	if o.Client.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = o.Client.ResponseHeaderTimeout
+	}
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.MinVersion = o.Client.MinTLSVersion
+	transport.MaxIdleConns = o.Client.MaxIdleConns
+	transport.MaxIdleConnsPerHost = o.Client.MaxIdleConnsPerHost
+	return transport
+}
+
+// defaultTransport returns a copy of the default http transport, or a transport with the same
+// defaults as the standard library if it has been replaced (e.g. by httpmock)
+func defaultTransport() *http.Transport {
+	if transport, ok := http.DefaultTransport.(*http.Transport); ok {
+		return transport.Clone()
+	}
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
@@ -0,0 +1,639 @@
+package qstash
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockTransport responds to each request with the next status code
+// and repeats the last status code once they run out
+type mockTransport struct {
+	mu          sync.Mutex
+	statusCodes []int
+	headers     []http.Header
+	bodies      []string
+	requests    int
+	// requestBodies are the bodies of the requests
+	requestBodies []string
+}
+
+func (t *mockTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	statusCode := t.statusCodes[len(t.statusCodes)-1]
+	if t.requests < len(t.statusCodes) {
+		statusCode = t.statusCodes[t.requests]
+	}
+	header := http.Header{}
+	if t.requests < len(t.headers) && t.headers[t.requests] != nil {
+		header = t.headers[t.requests]
+	}
+	body := "{ \"messageId\":\"mock-id\" }"
+	if t.requests < len(t.bodies) {
+		body = t.bodies[t.requests]
+	}
+	t.requests++
+	if r.Body != nil {
+		bs, _ := io.ReadAll(r.Body)
+		t.requestBodies = append(t.requestBodies, string(bs))
+	}
+	return &http.Response{
+		StatusCode: statusCode,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewBufferString(body)),
+		Request:    r,
+	}, nil
+}
+
+func TestNewTransport(t *testing.T) {
+	defaultTransport := http.DefaultTransport.(*http.Transport)
+	tests := []struct {
+		name                      string
+		opts                      []PublisherOption
+		wantTLSHandshakeTimeout   time.Duration
+		wantResponseHeaderTimeout time.Duration
+		wantMaxIdleConns          int
+		wantMaxIdleConnsPerHost   int
+		wantMinTLSVersion         uint16
+	}{{
+		name:                      "Default transport timeouts",
+		wantTLSHandshakeTimeout:   defaultTransport.TLSHandshakeTimeout,
+		wantResponseHeaderTimeout: defaultTransport.ResponseHeaderTimeout,
+		wantMaxIdleConns:          100,
+		wantMaxIdleConnsPerHost:   100,
+		wantMinTLSVersion:         tls.VersionTLS12,
+	}, {
+		name: "Custom transport timeouts",
+		opts: []PublisherOption{
+			WithClientTransportTimeouts(time.Second, 2*time.Second, 3*time.Second),
+		},
+		wantTLSHandshakeTimeout:   2 * time.Second,
+		wantResponseHeaderTimeout: 3 * time.Second,
+		wantMaxIdleConns:          100,
+		wantMaxIdleConnsPerHost:   100,
+		wantMinTLSVersion:         tls.VersionTLS12,
+	}, {
+		name: "Custom idle connections",
+		opts: []PublisherOption{
+			WithClientMaxIdleConns(500),
+			WithClientMaxIdleConnsPerHost(200),
+		},
+		wantTLSHandshakeTimeout:   defaultTransport.TLSHandshakeTimeout,
+		wantResponseHeaderTimeout: defaultTransport.ResponseHeaderTimeout,
+		wantMaxIdleConns:          500,
+		wantMaxIdleConnsPerHost:   200,
+		wantMinTLSVersion:         tls.VersionTLS12,
+	}, {
+		name: "Custom min tls version",
+		opts: []PublisherOption{
+			WithMinTLSVersion(tls.VersionTLS13),
+		},
+		wantTLSHandshakeTimeout:   defaultTransport.TLSHandshakeTimeout,
+		wantResponseHeaderTimeout: defaultTransport.ResponseHeaderTimeout,
+		wantMaxIdleConns:          100,
+		wantMaxIdleConnsPerHost:   100,
+		wantMinTLSVersion:         tls.VersionTLS13,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPublisher("topic", append([]PublisherOption{WithQStashToken("token")}, tt.opts...)...)
+			if err != nil {
+				t.Fatalf("NewPublisher() error = %v", err)
+			}
+			transport, ok := p.client.(*httpClient).client.Transport.(*http.Transport)
+			if !ok {
+				t.Fatalf("NewPublisher() transport = %T, want *http.Transport", p.client.(*httpClient).client.Transport)
+			} else if transport == defaultTransport {
+				t.Fatalf("NewPublisher() transport is the shared default transport")
+			} else if transport.DialContext == nil {
+				t.Fatalf("NewPublisher() transport dial context is nil")
+			} else if transport.TLSHandshakeTimeout != tt.wantTLSHandshakeTimeout {
+				t.Fatalf("NewPublisher() tls handshake timeout = %v, want %v", transport.TLSHandshakeTimeout, tt.wantTLSHandshakeTimeout)
+			} else if transport.ResponseHeaderTimeout != tt.wantResponseHeaderTimeout {
+				t.Fatalf("NewPublisher() response header timeout = %v, want %v", transport.ResponseHeaderTimeout, tt.wantResponseHeaderTimeout)
+			} else if transport.MaxIdleConns != tt.wantMaxIdleConns {
+				t.Fatalf("NewPublisher() max idle conns = %v, want %v", transport.MaxIdleConns, tt.wantMaxIdleConns)
+			} else if transport.MaxIdleConnsPerHost != tt.wantMaxIdleConnsPerHost {
+				t.Fatalf("NewPublisher() max idle conns per host = %v, want %v", transport.MaxIdleConnsPerHost, tt.wantMaxIdleConnsPerHost)
+			} else if transport.TLSClientConfig == nil || transport.TLSClientConfig.MinVersion != tt.wantMinTLSVersion {
+				t.Fatalf("NewPublisher() min tls version = %v, want %v", transport.TLSClientConfig, tt.wantMinTLSVersion)
+			}
+		})
+	}
+}
+
+func TestNewTransportReplacedDefault(t *testing.T) {
+	original := http.DefaultTransport
+	http.DefaultTransport = &mockTransport{}
+	defer func() { http.DefaultTransport = original }()
+
+	p, err := NewPublisher("topic", WithQStashToken("token"))
+	if err != nil {
+		t.Fatalf("NewPublisher() error = %v", err)
+	}
+	transport, ok := p.client.(*httpClient).client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("NewPublisher() transport = %T, want *http.Transport", p.client.(*httpClient).client.Transport)
+	} else if transport.DialContext == nil {
+		t.Fatalf("NewPublisher() transport dial context is nil")
+	} else if transport.Proxy == nil {
+		t.Fatalf("NewPublisher() transport proxy is nil")
+	} else if transport.TLSHandshakeTimeout != 10*time.Second {
+		t.Fatalf("NewPublisher() tls handshake timeout = %v, want %v", transport.TLSHandshakeTimeout, 10*time.Second)
+	}
+}
+
+// concurrencyTransport fails the first attempt of each request and
+// records the max number of retries that execute at the same time
+type concurrencyTransport struct {
+	mu         sync.Mutex
+	attempts   map[string]int
+	retrying   int
+	maxRetries int
+}
+
+func (t *concurrencyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	id := r.Header.Get("X-Id")
+	t.attempts[id]++
+	if t.attempts[id] == 1 {
+		t.mu.Unlock()
+		return &http.Response{StatusCode: http.StatusInternalServerError, Body: http.NoBody, Request: r}, nil
+	}
+	t.retrying++
+	if t.retrying > t.maxRetries {
+		t.maxRetries = t.retrying
+	}
+	t.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	t.mu.Lock()
+	t.retrying--
+	t.mu.Unlock()
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+}
+
+func TestHTTPClient_DoRetryConcurrency(t *testing.T) {
+	for _, n := range []int{1, 2} {
+		transport := &concurrencyTransport{attempts: map[string]int{}}
+		c := &httpClient{
+			client:         &http.Client{Transport: transport},
+			MinBackOff:     time.Millisecond,
+			MaxBackOff:     time.Millisecond,
+			Retries:        3,
+			retrySemaphore: make(chan struct{}, n),
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				r, _ := http.NewRequest(http.MethodPost, "http://qstash", nil)
+				r.Header.Set("X-Id", strconv.Itoa(i))
+				if rsp, err := c.Do(r); err != nil {
+					t.Errorf("httpClient.Do() error = %v", err)
+				} else if rsp.StatusCode != http.StatusOK {
+					t.Errorf("httpClient.Do() status = %v, want %v", rsp.StatusCode, http.StatusOK)
+				}
+			}(i)
+		}
+		wg.Wait()
+		if transport.maxRetries > n {
+			t.Fatalf("httpClient.Do() concurrent retries = %v, want at most %v", transport.maxRetries, n)
+		} else if len(c.retrySemaphore) != 0 {
+			t.Fatalf("httpClient.Do() retry slots in use = %v, want 0", len(c.retrySemaphore))
+		}
+	}
+}
+
+func TestHTTPClient_DoCancelRetryConcurrency(t *testing.T) {
+	transport := &mockTransport{statusCodes: []int{http.StatusInternalServerError, http.StatusOK}}
+	c := &httpClient{
+		client:         &http.Client{Transport: transport},
+		MinBackOff:     time.Millisecond,
+		MaxBackOff:     time.Millisecond,
+		Retries:        3,
+		retrySemaphore: make(chan struct{}, 1),
+	}
+	c.retrySemaphore <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, "http://qstash", nil)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.Do(r)
+		errs <- err
+	}()
+
+	// Cancel the context once the first attempt has failed and the retry is waiting for a slot
+	for {
+		transport.mu.Lock()
+		requests := transport.requests
+		transport.mu.Unlock()
+		if requests > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("httpClient.Do() error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("httpClient.Do() blocked on a full retry semaphore after the context was cancelled")
+	}
+	if len(c.retrySemaphore) != 1 {
+		t.Fatalf("httpClient.Do() retry slots in use = %v, want 1", len(c.retrySemaphore))
+	}
+}
+
+func TestHTTPClient_getBackOffDuration(t *testing.T) {
+	tests := []struct {
+		name               string
+		maintenanceBackOff time.Duration
+		resp               *http.Response
+		want               time.Duration
+	}{{
+		name:               "503 uses the maintenance back off",
+		maintenanceBackOff: time.Minute,
+		resp:               &http.Response{StatusCode: http.StatusServiceUnavailable},
+		want:               time.Minute,
+	}, {
+		name:               "500 uses the exponential back off",
+		maintenanceBackOff: time.Minute,
+		resp:               &http.Response{StatusCode: http.StatusInternalServerError},
+		want:               4 * time.Millisecond,
+	}, {
+		name:               "Network errors use the exponential back off",
+		maintenanceBackOff: time.Minute,
+		want:               4 * time.Millisecond,
+	}, {
+		name: "503 without a maintenance back off uses the exponential back off",
+		resp: &http.Response{StatusCode: http.StatusServiceUnavailable},
+		want: 4 * time.Millisecond,
+	}, {
+		name: "429 waits for the retry after in seconds",
+		resp: &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"2"}}},
+		want: 2 * time.Second,
+	}, {
+		name: "429 waits for the retry after http date",
+		resp: &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}}},
+		want: 10 * time.Second,
+	}, {
+		name: "429 retry after is clamped by the max back off",
+		resp: &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"60"}}},
+		want: 10 * time.Second,
+	}, {
+		name: "429 retry after shorter than the back off uses the exponential back off",
+		resp: &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"0"}}},
+		want: 4 * time.Millisecond,
+	}, {
+		name: "429 without a retry after uses the exponential back off",
+		resp: &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}},
+		want: 4 * time.Millisecond,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &httpClient{
+				MinBackOff:         time.Millisecond,
+				MaxBackOff:         10 * time.Second,
+				MaintenanceBackOff: tt.maintenanceBackOff,
+			}
+			if got := c.getBackOffDuration(tt.resp, 2); got != tt.want {
+				t.Fatalf("httpClient.getBackOffDuration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPClient_DoMaintenanceBackOff(t *testing.T) {
+	c := &httpClient{
+		client:             &http.Client{Transport: &mockTransport{statusCodes: []int{http.StatusServiceUnavailable, http.StatusOK}}},
+		MinBackOff:         time.Millisecond,
+		MaxBackOff:         time.Millisecond,
+		MaintenanceBackOff: 50 * time.Millisecond,
+		Retries:            1,
+	}
+	r, _ := http.NewRequest(http.MethodPost, "http://qstash", nil)
+	start := time.Now()
+	if rsp, err := c.Do(r); err != nil {
+		t.Fatalf("httpClient.Do() error = %v", err)
+	} else if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("httpClient.Do() status = %v, want %v", rsp.StatusCode, http.StatusOK)
+	} else if elapsed := time.Since(start); elapsed < c.MaintenanceBackOff {
+		t.Fatalf("httpClient.Do() took %v, want at least the maintenance back off %v", elapsed, c.MaintenanceBackOff)
+	}
+}
+
+func TestHTTPClient_DoBlockOnRateLimit(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxWait      time.Duration
+		statusCodes  []int
+		headers      []http.Header
+		wantStatus   int
+		wantRequests int
+		// wantMaxRequests is checked instead of wantRequests when it is set
+		wantMaxRequests int
+		wantMinWait     time.Duration
+	}{{
+		name:         "Block on 429 then succeed without using up the retries",
+		maxWait:      time.Second,
+		statusCodes:  []int{http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusOK},
+		wantStatus:   http.StatusOK,
+		wantRequests: 3,
+	}, {
+		name:         "Block for the retry after",
+		maxWait:      2 * time.Second,
+		statusCodes:  []int{http.StatusTooManyRequests, http.StatusOK},
+		headers:      []http.Header{{"Retry-After": []string{"1"}}},
+		wantStatus:   http.StatusOK,
+		wantRequests: 2,
+		wantMinWait:  time.Second,
+	}, {
+		name:         "Give up when the retry after exceeds the max wait",
+		maxWait:      500 * time.Millisecond,
+		statusCodes:  []int{http.StatusTooManyRequests, http.StatusOK},
+		headers:      []http.Header{{"Retry-After": []string{"1"}}},
+		wantStatus:   http.StatusTooManyRequests,
+		wantRequests: 1,
+	}, {
+		name:            "Block for the min back off on a retry after of 0",
+		maxWait:         50 * time.Millisecond,
+		statusCodes:     []int{http.StatusTooManyRequests},
+		headers:         repeatHeader(http.Header{"Retry-After": []string{"0"}}, 1000),
+		wantStatus:      http.StatusTooManyRequests,
+		wantMaxRequests: 51,
+		wantMinWait:     50 * time.Millisecond,
+	}, {
+		name:            "Block for the min back off on a retry after in the past",
+		maxWait:         50 * time.Millisecond,
+		statusCodes:     []int{http.StatusTooManyRequests},
+		headers:         repeatHeader(http.Header{"Retry-After": []string{"Mon, 02 Jan 2006 15:04:05 GMT"}}, 1000),
+		wantStatus:      http.StatusTooManyRequests,
+		wantMaxRequests: 51,
+		wantMinWait:     50 * time.Millisecond,
+	}, {
+		name:         "Retry 429 without blocking",
+		statusCodes:  []int{http.StatusTooManyRequests, http.StatusOK},
+		wantStatus:   http.StatusTooManyRequests,
+		wantRequests: 1,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &mockTransport{statusCodes: tt.statusCodes, headers: tt.headers}
+			c := &httpClient{
+				client:           &http.Client{Transport: transport},
+				MinBackOff:       time.Millisecond,
+				MaxBackOff:       time.Millisecond,
+				RateLimitMaxWait: tt.maxWait,
+			}
+			r, _ := http.NewRequest(http.MethodPost, "http://qstash", nil)
+			start := time.Now()
+			rsp, err := c.Do(r)
+			if err != nil {
+				t.Fatalf("httpClient.Do() error = %v", err)
+			} else if rsp.StatusCode != tt.wantStatus {
+				t.Fatalf("httpClient.Do() status = %v, want %v", rsp.StatusCode, tt.wantStatus)
+			} else if tt.wantMaxRequests == 0 && transport.requests != tt.wantRequests {
+				t.Fatalf("httpClient.Do() requests = %v, want %v", transport.requests, tt.wantRequests)
+			} else if tt.wantMaxRequests > 0 && transport.requests > tt.wantMaxRequests {
+				t.Fatalf("httpClient.Do() requests = %v, want at most %v", transport.requests, tt.wantMaxRequests)
+			} else if elapsed := time.Since(start); elapsed < tt.wantMinWait || elapsed > tt.maxWait+100*time.Millisecond {
+				t.Fatalf("httpClient.Do() took %v, want between %v and %v", elapsed, tt.wantMinWait, tt.maxWait)
+			}
+		})
+	}
+}
+
+// repeatHeader returns the header n times, so that every response of a mockTransport has it
+func repeatHeader(header http.Header, n int) []http.Header {
+	headers := make([]http.Header, n)
+	for i := range headers {
+		headers[i] = header
+	}
+	return headers
+}
+
+func TestHTTPClient_DoResetsBody(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       func() io.Reader
+		wantStatus int
+		wantBodies []string
+	}{{
+		name:       "Retry with the full body",
+		body:       func() io.Reader { return bytes.NewBufferString("message") },
+		wantStatus: http.StatusOK,
+		wantBodies: []string{"message", "message"},
+	}, {
+		name:       "Do not retry a body that can not be reset",
+		body:       func() io.Reader { return io.MultiReader(bytes.NewBufferString("message")) },
+		wantStatus: http.StatusInternalServerError,
+		wantBodies: []string{"message"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &mockTransport{statusCodes: []int{http.StatusInternalServerError, http.StatusOK}}
+			c := &httpClient{
+				client:     &http.Client{Transport: transport},
+				MinBackOff: time.Millisecond,
+				MaxBackOff: time.Millisecond,
+				Retries:    1,
+			}
+			r, _ := http.NewRequest(http.MethodPost, "http://qstash", tt.body())
+			if rsp, err := c.Do(r); err != nil {
+				t.Fatalf("httpClient.Do() error = %v", err)
+			} else if rsp.StatusCode != tt.wantStatus {
+				t.Fatalf("httpClient.Do() status = %v, want %v", rsp.StatusCode, tt.wantStatus)
+			} else if !reflect.DeepEqual(transport.requestBodies, tt.wantBodies) {
+				t.Fatalf("httpClient.Do() bodies = %q, want %q", transport.requestBodies, tt.wantBodies)
+			}
+		})
+	}
+}
+
+func TestHTTPClient_DoCancelBackOff(t *testing.T) {
+	tests := []struct {
+		name             string
+		statusCodes      []int
+		rateLimitMaxWait time.Duration
+	}{{
+		name:        "Cancel the back off of a retry",
+		statusCodes: []int{http.StatusInternalServerError},
+	}, {
+		name:             "Cancel the wait of a rate limit",
+		statusCodes:      []int{http.StatusTooManyRequests},
+		rateLimitMaxWait: time.Minute,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &httpClient{
+				client:           &http.Client{Transport: &mockTransport{statusCodes: tt.statusCodes}},
+				MinBackOff:       time.Minute,
+				MaxBackOff:       time.Minute,
+				Retries:          5,
+				RateLimitMaxWait: tt.rateLimitMaxWait,
+				retrySemaphore:   make(chan struct{}, 1),
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			r, _ := http.NewRequestWithContext(ctx, http.MethodPost, "http://qstash", nil)
+			var canceled time.Time
+			time.AfterFunc(20*time.Millisecond, func() {
+				canceled = time.Now()
+				cancel()
+			})
+			if _, err := c.Do(r); !errors.Is(err, context.Canceled) {
+				t.Fatalf("httpClient.Do() error = %v, want %v", err, context.Canceled)
+			} else if elapsed := time.Since(canceled); elapsed > 50*time.Millisecond {
+				t.Fatalf("httpClient.Do() returned %v after the context was canceled, want it to return promptly", elapsed)
+			} else if len(c.retrySemaphore) != 0 {
+				t.Fatalf("httpClient.Do() retry slots in use = %v, want 0", len(c.retrySemaphore))
+			}
+		})
+	}
+}
+
+func TestHTTPClient_DoRetryableStatuses(t *testing.T) {
+	tests := []struct {
+		name              string
+		retryableStatuses map[int]bool
+		statusCodes       []int
+		wantStatus        int
+		wantRequests      int
+	}{{
+		name:         "Return a 401 right away",
+		statusCodes:  []int{http.StatusUnauthorized, http.StatusOK},
+		wantStatus:   http.StatusUnauthorized,
+		wantRequests: 1,
+	}, {
+		name:         "Return a 422 right away",
+		statusCodes:  []int{http.StatusUnprocessableEntity, http.StatusOK},
+		wantStatus:   http.StatusUnprocessableEntity,
+		wantRequests: 1,
+	}, {
+		name:         "Retry a 429",
+		statusCodes:  []int{http.StatusTooManyRequests, http.StatusOK},
+		wantStatus:   http.StatusOK,
+		wantRequests: 2,
+	}, {
+		name:         "Retry a 5xx",
+		statusCodes:  []int{http.StatusBadGateway, http.StatusOK},
+		wantStatus:   http.StatusOK,
+		wantRequests: 2,
+	}, {
+		name:              "Retry a custom status",
+		retryableStatuses: map[int]bool{http.StatusConflict: true},
+		statusCodes:       []int{http.StatusConflict, http.StatusOK},
+		wantStatus:        http.StatusOK,
+		wantRequests:      2,
+	}, {
+		name:              "Return a status that is not custom right away",
+		retryableStatuses: map[int]bool{http.StatusConflict: true},
+		statusCodes:       []int{http.StatusInternalServerError, http.StatusOK},
+		wantStatus:        http.StatusInternalServerError,
+		wantRequests:      1,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &mockTransport{statusCodes: tt.statusCodes}
+			c := &httpClient{
+				client:            &http.Client{Transport: transport},
+				MinBackOff:        time.Millisecond,
+				MaxBackOff:        time.Millisecond,
+				Retries:           3,
+				RetryableStatuses: tt.retryableStatuses,
+			}
+			r, _ := http.NewRequest(http.MethodPost, "http://qstash", nil)
+			if rsp, err := c.Do(r); err != nil {
+				t.Fatalf("httpClient.Do() error = %v", err)
+			} else if rsp.StatusCode != tt.wantStatus {
+				t.Fatalf("httpClient.Do() status = %v, want %v", rsp.StatusCode, tt.wantStatus)
+			} else if transport.requests != tt.wantRequests {
+				t.Fatalf("httpClient.Do() requests = %v, want %v", transport.requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestHTTPClient_getBackOffDurationJitter(t *testing.T) {
+	// An injected source makes the jitter deterministic
+	c := &httpClient{
+		MinBackOff: 100 * time.Millisecond,
+		MaxBackOff: time.Second,
+		Jitter:     true,
+		random:     func(n int64) int64 { return n - 1 },
+	}
+	if got := c.getBackOffDuration(nil, 1); got != 200*time.Millisecond {
+		t.Fatalf("httpClient.getBackOffDuration() = %v, want %v", got, 200*time.Millisecond)
+	}
+	c.random = func(int64) int64 { return 0 }
+	if got := c.getBackOffDuration(nil, 1); got != 100*time.Millisecond {
+		t.Fatalf("httpClient.getBackOffDuration() = %v, want %v", got, 100*time.Millisecond)
+	}
+
+	// Successive back offs vary between half and all of the exponential back off
+	c.random = nil
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		got := c.getBackOffDuration(nil, 2)
+		if got < 200*time.Millisecond || got > 400*time.Millisecond {
+			t.Fatalf("httpClient.getBackOffDuration() = %v, want between %v and %v", got, 200*time.Millisecond, 400*time.Millisecond)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("httpClient.getBackOffDuration() = %v every time, want it to vary", seen)
+	}
+
+	// The jitter can be turned off
+	c.Jitter = false
+	if got := c.getBackOffDuration(nil, 2); got != 400*time.Millisecond {
+		t.Fatalf("httpClient.getBackOffDuration() = %v, want %v", got, 400*time.Millisecond)
+	}
+}
+
+func TestHTTPClient_DoRetryThenRateLimit(t *testing.T) {
+	p, err := NewPublisher("topic",
+		WithQStashToken("token"),
+		WithClientMinBackOff(time.Millisecond),
+		WithClientMaxBackOff(time.Millisecond),
+		WithGlobalRetryConcurrency(1),
+		WithBlockOnRateLimit(time.Second),
+	)
+	if err != nil {
+		t.Fatalf("NewPublisher() error = %v", err)
+	}
+	transport := &mockTransport{statusCodes: []int{http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusOK}}
+	c := p.client.(*httpClient)
+	c.client.Transport = transport
+	r, _ := http.NewRequest(http.MethodPost, "http://qstash", nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if rsp, err := c.Do(r); err != nil {
+			t.Errorf("httpClient.Do() error = %v", err)
+		} else if rsp.StatusCode != http.StatusOK {
+			t.Errorf("httpClient.Do() status = %v, want %v", rsp.StatusCode, http.StatusOK)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("httpClient.Do() deadlocked releasing its retry slot")
+	}
+	if transport.requests != 3 {
+		t.Fatalf("httpClient.Do() requests = %v, want %v", transport.requests, 3)
+	} else if len(c.retrySemaphore) != 0 {
+		t.Fatalf("httpClient.Do() retry slots in use = %v, want 0", len(c.retrySemaphore))
+	}
+}
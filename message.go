@@ -1,22 +1,148 @@
 package qstash
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
 )
 
 // Message published to or received from a qstash queue
 type Message struct {
-	ID             string
-	Headers        http.Header
-	Body           []byte
+	ID      string
+	Headers http.Header
+	Body    []byte
+	// BodyStream is published instead of Body when it is set, e.g. to stream a large file.
+	// Set BodyLength to publish it with a 'Content-Length' rather than with a chunked transfer encoding.
+	// The stream can only be resent on a retry if it is an io.Seeker
+	BodyStream     io.Reader
+	BodyLength     int64
 	Retried        int
 	w              http.ResponseWriter
 	isAcknowledged bool
+	deadline       time.Time
+	hasDeadline    bool
+	claims         jwt.MapClaims
+	signature      string
+	// err is why the handler did not acknowledge the message (see ReceiveAck)
+	err error
+}
+
+// Meta returns the 'Upstash-Forward-' headers of the message with the prefix
+// stripped and the keys lowercased
+func (m *Message) Meta() map[string]string {
+	meta := make(map[string]string)
+	for k, v := range m.Headers {
+		if key := strings.ToLower(k); strings.HasPrefix(key, "upstash-forward-") && len(v) > 0 {
+			meta[strings.TrimPrefix(key, "upstash-forward-")] = v[0]
+		}
+	}
+	return meta
+}
+
+// Size returns the size of the message body in bytes
+func (m *Message) Size() int {
+	return len(m.Body)
+}
+
+// BodyReader returns a new reader over the verified message body every time it is called
+func (m *Message) BodyReader() io.Reader {
+	return bytes.NewReader(m.Body)
+}
+
+// Deadline returns the time the handler has to process the message by.
+// ok is false if no deadline is set (see WithHandlerTimeout)
+func (m *Message) Deadline() (deadline time.Time, ok bool) {
+	return m.deadline, m.hasDeadline
+}
+
+// PublishedAt returns the time qstash signed the message from the jwt 'iat' claim.
+// ok is false if the claim is missing or invalid
+func (m *Message) PublishedAt() (publishedAt time.Time, ok bool) {
+	switch iat := m.claims["iat"].(type) {
+	case float64:
+		return time.Unix(int64(iat), 0), true
+	case json.Number:
+		if v, err := iat.Int64(); err == nil {
+			return time.Unix(v, 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Claims returns a copy of the jwt claims of the verified signature, e.g. to authorize
+// the message with custom claims. The claims have already been validated by the receiver.
+// Messages received with a custom Verifier have the claims it returned
+func (m *Message) Claims() jwt.MapClaims {
+	claims := make(jwt.MapClaims, len(m.claims))
+	for k, v := range m.claims {
+		claims[k] = v
+	}
+	return claims
+}
+
+// Signature returns the raw signature jwt the message was verified with.
+// The token is a bearer credential until it expires, so take care when logging it
+func (m *Message) Signature() string {
+	return m.signature
 }
 
 // Ack acknowledges the message.
 // If ack is not called, the message will be retried.
+// The acknowledgement is flushed right away, so a handler that would outlast the delivery timeout
+// can ack early and keep working (see WithTimeout). qstash will not retry the message if that work fails
 func (m *Message) Ack() {
 	m.isAcknowledged = true
 	m.w.WriteHeader(http.StatusOK)
+	m.flush()
+}
+
+// AckWithStatus acknowledges the message with a custom status code.
+// This is useful when an intermediary only treats specific 2xx codes as a success.
+// The status code must be between 200 and 299.
+func (m *Message) AckWithStatus(statusCode int) error {
+	if statusCode < 200 || statusCode > 299 {
+		return fmt.Errorf("ack status code must be between 200 and 299, got %d", statusCode)
+	}
+	m.isAcknowledged = true
+	m.w.WriteHeader(statusCode)
+	m.flush()
+	return nil
+}
+
+// flush sends the acknowledgement to qstash right away when the response writer supports it,
+// instead of waiting for the handler to return. Some serverless platforms and proxies buffer it otherwise
+func (m *Message) flush() {
+	if f, ok := m.w.(http.Flusher); ok && f != nil {
+		f.Flush()
+	}
+}
+
+// AckWithBody acknowledges the message and writes the body to the response, which
+// qstash forwards to the callback (see WithCallback). Any trailers are declared before
+// the body is written and sent after it.
+// Note: not all proxies and load balancers between qstash and the receiver forward trailers
+func (m *Message) AckWithBody(body []byte, trailers http.Header) error {
+	// Trailers must be declared before the header is written
+	for k := range trailers {
+		m.w.Header().Add("Trailer", http.CanonicalHeaderKey(k))
+	}
+	m.isAcknowledged = true
+	m.w.WriteHeader(http.StatusOK)
+	if _, err := m.w.Write(body); err != nil {
+		return fmt.Errorf("could not write ack body %w", err)
+	}
+	m.flush()
+	// Trailers are sent once the handler returns
+	for k, v := range trailers {
+		for _, vv := range v {
+			m.w.Header().Add(k, vv)
+		}
+	}
+	return nil
 }
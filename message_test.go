@@ -0,0 +1,292 @@
+package qstash
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestMessage_AckWithStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		wantErr    bool
+		wantStatus int
+	}{{
+		name:       "Ack with 204",
+		statusCode: http.StatusNoContent,
+		wantStatus: http.StatusNoContent,
+	}, {
+		name:       "Ack with 200",
+		statusCode: http.StatusOK,
+		wantStatus: http.StatusOK,
+	}, {
+		name:       "Ack with 500 fails",
+		statusCode: http.StatusInternalServerError,
+		wantErr:    true,
+	}, {
+		name:       "Ack with 302 fails",
+		statusCode: http.StatusFound,
+		wantErr:    true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			m := &Message{w: w}
+			if err := m.AckWithStatus(tt.statusCode); err != nil {
+				if !tt.wantErr {
+					t.Fatalf("Message.AckWithStatus() error = %v, wantErr %v", err, tt.wantErr)
+				} else if m.isAcknowledged {
+					t.Fatalf("Message.AckWithStatus() acknowledged the message with status %d", tt.statusCode)
+				}
+				return
+			} else if tt.wantErr {
+				t.Fatalf("Message.AckWithStatus() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !m.isAcknowledged {
+				t.Fatalf("Message.AckWithStatus() did not acknowledge the message")
+			} else if w.Code != tt.wantStatus {
+				t.Fatalf("Message.AckWithStatus() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+// mockResponseWriter is a response writer that does not implement http.Flusher
+type mockResponseWriter struct {
+	http.ResponseWriter
+}
+
+func TestMessage_AckFlush(t *testing.T) {
+	tests := []struct {
+		name        string
+		w           func(r *httptest.ResponseRecorder) http.ResponseWriter
+		wantFlushed bool
+	}{{
+		name:        "Ack flushes a flusher",
+		w:           func(r *httptest.ResponseRecorder) http.ResponseWriter { return r },
+		wantFlushed: true,
+	}, {
+		name:        "Ack flushes through the metrics writer",
+		w:           func(r *httptest.ResponseRecorder) http.ResponseWriter { return &statusWriter{ResponseWriter: r} },
+		wantFlushed: true,
+	}, {
+		name: "Ack without a flusher does not flush",
+		w:    func(r *httptest.ResponseRecorder) http.ResponseWriter { return mockResponseWriter{r} },
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRecorder()
+			m := &Message{w: tt.w(r)}
+			m.Ack()
+			if r.Code != http.StatusOK {
+				t.Fatalf("Message.Ack() status = %v, want %v", r.Code, http.StatusOK)
+			} else if r.Flushed != tt.wantFlushed {
+				t.Fatalf("Message.Ack() flushed = %v, want %v", r.Flushed, tt.wantFlushed)
+			}
+		})
+	}
+}
+
+func TestMessage_AckEarly(t *testing.T) {
+	q, err := NewReceiver(WithSigningKey("key"), WithNextSigningKey("next key"))
+	if err != nil {
+		t.Fatalf("NewReceiver() error = %v", err)
+	}
+	// The handler keeps working after it acknowledges the message
+	working, done := make(chan struct{}), make(chan struct{})
+	s := httptest.NewServer(q.Receive(func(_ context.Context, m *Message) {
+		m.Ack()
+		close(working)
+		<-done
+	}))
+	defer s.Close()
+	defer close(done)
+
+	signature, err := GenerateSignature([]byte("message"), "key", "Upstash", time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateSignature() error = %v", err)
+	}
+	r, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader([]byte("message")))
+	if err != nil {
+		t.Fatalf("http.NewRequest() error = %v", err)
+	}
+	r.Header.Set("Upstash-Signature", signature)
+	client := &http.Client{Timeout: 5 * time.Second}
+	rsp, err := client.Do(r)
+	if err != nil {
+		t.Fatalf("Message.Ack() was not sent before the handler returned: %v", err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("Message.Ack() status = %v, want %v", rsp.StatusCode, http.StatusOK)
+	}
+	<-working
+}
+
+func TestMessage_AckWithBody(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		trailers     http.Header
+		wantTrailers http.Header
+	}{{
+		name: "Ack with body",
+		body: "result",
+	}, {
+		name: "Ack with body and trailers",
+		body: "result",
+		trailers: http.Header{
+			"Checksum":     []string{"abc"},
+			"x-result-len": []string{"6"},
+		},
+		wantTrailers: http.Header{
+			"Checksum":     []string{"abc"},
+			"X-Result-Len": []string{"6"},
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			m := &Message{w: w}
+			if err := m.AckWithBody([]byte(tt.body), tt.trailers); err != nil {
+				t.Fatalf("Message.AckWithBody() error = %v", err)
+			}
+			rsp := w.Result()
+			if !m.isAcknowledged {
+				t.Fatalf("Message.AckWithBody() did not acknowledge the message")
+			} else if rsp.StatusCode != http.StatusOK {
+				t.Fatalf("Message.AckWithBody() status = %v, want %v", rsp.StatusCode, http.StatusOK)
+			} else if body := w.Body.String(); body != tt.body {
+				t.Fatalf("Message.AckWithBody() body = %v, want %v", body, tt.body)
+			}
+			for k := range tt.wantTrailers {
+				if got, want := rsp.Trailer.Get(k), tt.wantTrailers.Get(k); got != want {
+					t.Fatalf("Message.AckWithBody() trailer %s = %v, want %v", k, got, want)
+				}
+			}
+			if len(rsp.Trailer) != len(tt.wantTrailers) {
+				t.Fatalf("Message.AckWithBody() trailers = %v, want %v", rsp.Trailer, tt.wantTrailers)
+			}
+		})
+	}
+}
+
+func TestMessage_PublishedAt(t *testing.T) {
+	signature, err := GenerateSignature([]byte("message"), "key", "Upstash", time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateSignature() error = %v", err)
+	}
+	q := Receiver{expectedIssuer: "Upstash"}
+	signed, err := q.verify([]byte("message"), signature, "key")
+	if err != nil {
+		t.Fatalf("Receiver.verify() error = %v", err)
+	}
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   time.Time
+		wantOK bool
+	}{{
+		name:   "Signed token",
+		claims: signed,
+		want:   time.Unix(int64(signed["iat"].(float64)), 0),
+		wantOK: true,
+	}, {
+		name:   "Json number claim",
+		claims: jwt.MapClaims{"iat": json.Number("1700000000")},
+		want:   time.Unix(1700000000, 0),
+		wantOK: true,
+	}, {
+		name:   "Missing claim",
+		claims: jwt.MapClaims{},
+	}, {
+		name:   "Invalid claim",
+		claims: jwt.MapClaims{"iat": "yesterday"},
+	}, {
+		name: "No claims",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Message{claims: tt.claims}
+			got, ok := m.PublishedAt()
+			if ok != tt.wantOK {
+				t.Fatalf("Message.PublishedAt() ok = %v, want %v", ok, tt.wantOK)
+			} else if !got.Equal(tt.want) {
+				t.Fatalf("Message.PublishedAt() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessage_Claims(t *testing.T) {
+	q, err := NewReceiver(WithSigningKey("key"), WithNextSigningKey("next key"))
+	if err != nil {
+		t.Fatalf("NewReceiver() error = %v", err)
+	}
+	signature, err := GenerateSignature([]byte("message"), "key", "Upstash", time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateSignature() error = %v", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("message")))
+	r.Header.Set("Upstash-Signature", signature)
+	var claims jwt.MapClaims
+	q.Receive(func(_ context.Context, m *Message) {
+		claims = m.Claims()
+		claims["iss"] = "changed"
+		claims = m.Claims()
+		m.Ack()
+	}).ServeHTTP(httptest.NewRecorder(), r)
+	if claims["iss"] != "Upstash" {
+		t.Fatalf("Message.Claims() iss = %v, want %v", claims["iss"], "Upstash")
+	}
+	for _, claim := range []string{"iat", "nbf", "exp", "body"} {
+		if _, ok := claims[claim]; !ok {
+			t.Fatalf("Message.Claims() = %v, want the %s claim", claims, claim)
+		}
+	}
+}
+
+func TestMessage_Meta(t *testing.T) {
+	m := &Message{
+		Headers: http.Header{
+			"Upstash-Forward-Tenant":       []string{"tenant"},
+			"Upstash-Forward-X-Request-Id": []string{"request-id"},
+			"upstash-forward-lowercase":    []string{"lowercase"},
+			"Upstash-Message-Id":           []string{"message-id"},
+			"Content-Type":                 []string{"application/json"},
+		},
+	}
+	want := map[string]string{
+		"tenant":       "tenant",
+		"x-request-id": "request-id",
+		"lowercase":    "lowercase",
+	}
+	got := m.Meta()
+	if len(got) != len(want) {
+		t.Fatalf("Message.Meta() = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("Message.Meta() %v = %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestMessage_BodyReader(t *testing.T) {
+	m := &Message{Body: []byte("message")}
+	for i := 0; i < 2; i++ {
+		if bs, err := io.ReadAll(m.BodyReader()); err != nil {
+			t.Fatalf("Message.BodyReader() error = %v", err)
+		} else if string(bs) != "message" {
+			t.Fatalf("Message.BodyReader() read %d = %s, want %s", i+1, bs, "message")
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package qstash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrMessageNotFound is returned when qstash has no pending message with the id
+var ErrMessageNotFound = errors.New("message not found")
+
+// Messages manages the messages that have been published to qstash
+type Messages struct {
+	p *Publisher
+}
+
+// Messages returns the messages api of the publisher's qstash instance
+func (q *Publisher) Messages() *Messages {
+	return &Messages{p: q}
+}
+
+// Cancel cancels a message that has not been delivered yet, like a message published
+// with WithDelay that is waiting for its delivery time or a message that is waiting to be retried.
+// Messages that have already been delivered, have failed or are being delivered right now
+// can not be canceled and return ErrMessageNotFound
+func (ms *Messages) Cancel(ctx context.Context, id string) error {
+	if len(id) == 0 {
+		return fmt.Errorf("message id is required")
+	}
+	r, err := http.NewRequest(http.MethodDelete, ms.p.apiURL("messages", url.PathEscape(id)), nil)
+	if err != nil {
+		return fmt.Errorf("could not create request %w", err)
+	}
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ms.p.token))
+	r.Header.Set("User-Agent", UserAgent())
+
+	// Cancel the message
+	rsp, err := ms.p.client.Do(r.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("could not complete request %w", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrMessageNotFound, id)
+	} else if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		bs, _ := io.ReadAll(rsp.Body)
+		return fmt.Errorf("bad request status %d: %s", rsp.StatusCode, string(bs))
+	}
+	return nil
+}
+
+// CancelPending cancels the messages published with WithDelay or WithNotBefore that qstash has not delivered yet,
+// e.g. before an endpoint is decommissioned, and returns the number of messages that were canceled.
+// Note: only the messages published by this process are known, so messages published by other
+// processes or before a restart are not canceled. Messages that could not be canceled are
+// kept, so that CancelPending can be called again
+func (q *Publisher) CancelPending(ctx context.Context) (int, error) {
+	q.pendingMu.Lock()
+	pending := q.pending
+	q.pending = nil
+	q.pendingMu.Unlock()
+
+	var (
+		canceled int
+		errs     []error
+	)
+	for id, deliverAt := range pending {
+		if err := q.Messages().Cancel(ctx, id); errors.Is(err, ErrMessageNotFound) {
+			// The message has already been delivered
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			q.addPending(id, deliverAt)
+			continue
+		}
+		canceled++
+	}
+	return canceled, errors.Join(errs...)
+}
+
+// trackPending records the ids of a delayed message, so that CancelPending can cancel it
+func (q *Publisher) trackPending(res *PublishResult, deliverAt time.Time) {
+	if len(res.MessageID) > 0 {
+		q.addPending(res.MessageID, deliverAt)
+	}
+	for _, e := range res.Endpoints {
+		q.addPending(e.MessageID, deliverAt)
+	}
+}
+
+// minPendingPrune is the number of delayed messages tracked before the delivered ones are forgotten
+const minPendingPrune = 1024
+
+// addPending records the id of a delayed message. Once the number of tracked messages
+// doubles, the messages that are past their delivery time are forgotten
+func (q *Publisher) addPending(id string, deliverAt time.Time) {
+	q.pendingMu.Lock()
+	defer q.pendingMu.Unlock()
+	if q.pending == nil {
+		q.pending = make(map[string]time.Time)
+	}
+	if len(q.pending) >= q.pendingPruneAt && len(q.pending) >= minPendingPrune {
+		now := time.Now()
+		for id, t := range q.pending {
+			if t.Before(now) {
+				delete(q.pending, id)
+			}
+		}
+		q.pendingPruneAt = 2 * len(q.pending)
+	}
+	q.pending[id] = deliverAt
+}
+
+// MessageStatus is the status of a message that qstash has not finished delivering
+type MessageStatus struct {
+	MessageID string
+	URL       string
+	// State is the qstash state of the message, e.g. CREATED, ACTIVE or RETRY
+	State string
+	// Time is when the message entered the state
+	Time time.Time
+	// NextDeliveryTime is when qstash delivers the message next, if it is scheduled
+	NextDeliveryTime time.Time
+	// Error is the error of the last failed delivery
+	Error string
+}
+
+// pendingStates are the states of messages that qstash has not finished delivering
+var pendingStates = map[string]bool{
+	"CREATED": true,
+	"ACTIVE":  true,
+	"RETRY":   true,
+}
+
+// eventsResponse is a page of the qstash events api
+type eventsResponse struct {
+	Cursor string `json:"cursor"`
+	Events []struct {
+		Time             int64  `json:"time"`
+		MessageID        string `json:"messageId"`
+		State            string `json:"state"`
+		URL              string `json:"url"`
+		Error            string `json:"error"`
+		NextDeliveryTime int64  `json:"nextDeliveryTime"`
+	} `json:"events"`
+}
+
+// ListByDestination lists the messages to the destination url that qstash has not finished delivering,
+// like delayed messages and messages that are waiting to be retried. It follows the cursor of the qstash
+// events api until the last page (see WithMaxPages). The events are listed newest first, so each message
+// is reported in its latest state
+func (ms *Messages) ListByDestination(ctx context.Context, destURL string, opts ...ListOption) ([]MessageStatus, error) {
+	if len(destURL) == 0 {
+		return nil, fmt.Errorf("destination url is required")
+	}
+	var o ListOptions
+	if err := o.apply(opts...); err != nil {
+		return nil, err
+	}
+
+	var (
+		statuses []MessageStatus
+		seen     = make(map[string]bool)
+		cursor   string
+	)
+	for page := 0; o.MaxPages == 0 || page < o.MaxPages; page++ {
+		res, err := ms.listEvents(ctx, destURL, cursor, o.PageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range res.Events {
+			if seen[e.MessageID] {
+				continue
+			}
+			seen[e.MessageID] = true
+			if !pendingStates[e.State] {
+				continue
+			}
+			status := MessageStatus{
+				MessageID: e.MessageID,
+				URL:       e.URL,
+				State:     e.State,
+				Time:      time.UnixMilli(e.Time),
+				Error:     e.Error,
+			}
+			if e.NextDeliveryTime > 0 {
+				status.NextDeliveryTime = time.UnixMilli(e.NextDeliveryTime)
+			}
+			statuses = append(statuses, status)
+		}
+		if cursor = res.Cursor; len(cursor) == 0 {
+			break
+		}
+	}
+	return statuses, nil
+}
+
+// listEvents requests a page of the events of the destination url
+func (ms *Messages) listEvents(ctx context.Context, destURL, cursor string, pageSize int) (*eventsResponse, error) {
+	query := url.Values{"url": {destURL}}
+	if len(cursor) > 0 {
+		query.Set("cursor", cursor)
+	}
+	if pageSize > 0 {
+		query.Set("count", strconv.Itoa(pageSize))
+	}
+	r, err := http.NewRequest(http.MethodGet, ms.p.apiURL("events")+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request %w", err)
+	}
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ms.p.token))
+	r.Header.Set("User-Agent", UserAgent())
+
+	// List the events
+	rsp, err := ms.p.client.Do(r.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("could not complete request %w", err)
+	}
+	defer rsp.Body.Close()
+	bs, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read response %w", err)
+	} else if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return nil, fmt.Errorf("bad request status %d: %s", rsp.StatusCode, string(bs))
+	}
+	var res eventsResponse
+	if err := ms.p.json.Unmarshal(bs, &res); err != nil {
+		return nil, fmt.Errorf("could not decode response %w", err)
+	}
+	return &res, nil
+}
+
+// apiURL returns the url of a qstash api endpoint relative to the publish url
+func (q *Publisher) apiURL(path ...string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(q.url, "/"), "/publish") + "/" + strings.Join(path, "/")
+}
@@ -0,0 +1,217 @@
+package qstash
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// mockStatusClient responds to every request with the status code
+type mockStatusClient struct {
+	statusCode int
+	header     http.Header
+	r          *http.Request
+}
+
+func (c *mockStatusClient) Do(r *http.Request) (*http.Response, error) {
+	c.r = r
+	return &http.Response{
+		StatusCode: c.statusCode,
+		Header:     c.header,
+		Body:       io.NopCloser(bytes.NewBufferString("")),
+	}, nil
+}
+
+func TestMessages_Cancel(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         string
+		statusCode int
+		wantURL    string
+		wantErr    bool
+		wantErrIs  error
+	}{{
+		name:       "Cancel a pending message",
+		id:         "msg_1",
+		statusCode: http.StatusAccepted,
+		wantURL:    "https://qstash.upstash.io/v2/messages/msg_1",
+	}, {
+		name:       "Cancel escapes the message id",
+		id:         "msg/1",
+		statusCode: http.StatusAccepted,
+		wantURL:    "https://qstash.upstash.io/v2/messages/msg%2F1",
+	}, {
+		name:       "Cancel a delivered message fails",
+		id:         "msg_1",
+		statusCode: http.StatusNotFound,
+		wantURL:    "https://qstash.upstash.io/v2/messages/msg_1",
+		wantErr:    true,
+		wantErrIs:  ErrMessageNotFound,
+	}, {
+		name:       "Cancel fails with a bad status",
+		id:         "msg_1",
+		statusCode: http.StatusInternalServerError,
+		wantURL:    "https://qstash.upstash.io/v2/messages/msg_1",
+		wantErr:    true,
+	}, {
+		name:    "Cancel without an id fails",
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockStatusClient{statusCode: tt.statusCode}
+			q := &Publisher{
+				token:  "token",
+				url:    "https://qstash.upstash.io/v2/publish",
+				topic:  "topic",
+				client: client,
+			}
+			if err := q.Messages().Cancel(context.TODO(), tt.id); err != nil {
+				if !tt.wantErr {
+					t.Fatalf("Messages.Cancel() error = %v, wantErr %v", err, tt.wantErr)
+				} else if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+					t.Fatalf("Messages.Cancel() error = %v, want %v", err, tt.wantErrIs)
+				}
+			} else if tt.wantErr {
+				t.Fatalf("Messages.Cancel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(tt.wantURL) == 0 {
+				return
+			} else if client.r.Method != http.MethodDelete {
+				t.Fatalf("Messages.Cancel() method = %v, want %v", client.r.Method, http.MethodDelete)
+			} else if got := client.r.URL.String(); got != tt.wantURL {
+				t.Fatalf("Messages.Cancel() url = %v, want %v", got, tt.wantURL)
+			} else if got := client.r.Header.Get("Authorization"); got != "Bearer token" {
+				t.Fatalf("Messages.Cancel() authorization = %v, want %v", got, "Bearer token")
+			}
+		})
+	}
+}
+
+func TestMessages_ListByDestination(t *testing.T) {
+	client := &mockRecordingClient{bodies: []string{
+		`{"cursor":"page-2","events":[
+			{"time":3000,"messageId":"msg_1","state":"RETRY","url":"https://a.example.com","error":"bad gateway","nextDeliveryTime":5000},
+			{"time":2000,"messageId":"msg_2","state":"DELIVERED","url":"https://a.example.com"},
+			{"time":1000,"messageId":"msg_1","state":"ACTIVE","url":"https://a.example.com"}
+		]}`,
+		`{"events":[
+			{"time":900,"messageId":"msg_2","state":"CREATED","url":"https://a.example.com"},
+			{"time":800,"messageId":"msg_3","state":"CREATED","url":"https://a.example.com","nextDeliveryTime":60000}
+		]}`,
+	}}
+	q := &Publisher{
+		token:  "token",
+		url:    "https://qstash.upstash.io/v2/publish",
+		topic:  "topic",
+		client: client,
+	}
+	statuses, err := q.Messages().ListByDestination(context.TODO(), "https://a.example.com", WithPageSize(3))
+	if err != nil {
+		t.Fatalf("Messages.ListByDestination() error = %v", err)
+	}
+	want := []MessageStatus{{
+		MessageID:        "msg_1",
+		URL:              "https://a.example.com",
+		State:            "RETRY",
+		Time:             time.UnixMilli(3000),
+		NextDeliveryTime: time.UnixMilli(5000),
+		Error:            "bad gateway",
+	}, {
+		MessageID:        "msg_3",
+		URL:              "https://a.example.com",
+		State:            "CREATED",
+		Time:             time.UnixMilli(800),
+		NextDeliveryTime: time.UnixMilli(60000),
+	}}
+	if !reflect.DeepEqual(statuses, want) {
+		t.Fatalf("Messages.ListByDestination() = %+v, want %+v", statuses, want)
+	}
+
+	// Check the requests follow the cursor
+	wantURLs := []string{
+		"https://qstash.upstash.io/v2/events?count=3&url=https%3A%2F%2Fa.example.com",
+		"https://qstash.upstash.io/v2/events?count=3&cursor=page-2&url=https%3A%2F%2Fa.example.com",
+	}
+	if len(client.requests) != len(wantURLs) {
+		t.Fatalf("Messages.ListByDestination() requests = %v, want %v", len(client.requests), len(wantURLs))
+	}
+	for i, r := range client.requests {
+		if r.Method != http.MethodGet {
+			t.Fatalf("Messages.ListByDestination() method = %v, want %v", r.Method, http.MethodGet)
+		} else if got := r.URL.String(); got != wantURLs[i] {
+			t.Fatalf("Messages.ListByDestination() url = %v, want %v", got, wantURLs[i])
+		} else if got := client.headers[i].Get("Authorization"); got != "Bearer token" {
+			t.Fatalf("Messages.ListByDestination() authorization = %v, want %v", got, "Bearer token")
+		}
+	}
+
+	// Check the listing stops after the max pages
+	client = &mockRecordingClient{bodies: client.bodies}
+	q.client = client
+	if statuses, err := q.Messages().ListByDestination(context.TODO(), "https://a.example.com", WithMaxPages(1)); err != nil {
+		t.Fatalf("Messages.ListByDestination() error = %v", err)
+	} else if len(statuses) != 1 || len(client.requests) != 1 {
+		t.Fatalf("Messages.ListByDestination() statuses = %v, requests = %v, want 1 page", len(statuses), len(client.requests))
+	}
+}
+
+func TestPublisher_CancelPending(t *testing.T) {
+	client := &mockRecordingClient{}
+	q := &Publisher{
+		token:  "token",
+		url:    "https://qstash.upstash.io/v2/publish",
+		topic:  "topic",
+		client: client,
+		uuid:   &mockUUID{uuid: "uuid"},
+	}
+	for _, opts := range [][]PublishOption{
+		{WithDelay(time.Hour)},
+		{WithNotBefore(time.Now().Add(time.Hour))},
+		nil,
+	} {
+		if err := q.Publish(context.TODO(), &Message{Body: []byte("message")}, opts...); err != nil {
+			t.Fatalf("Publisher.Publish() error = %v", err)
+		}
+	}
+
+	// Cancel the delayed messages, failing once
+	q.client = &mockStatusClient{statusCode: http.StatusInternalServerError}
+	if canceled, err := q.CancelPending(context.TODO()); err == nil {
+		t.Fatalf("Publisher.CancelPending() error = %v, want an error", err)
+	} else if canceled != 0 {
+		t.Fatalf("Publisher.CancelPending() canceled = %v, want %v", canceled, 0)
+	}
+	client = &mockRecordingClient{}
+	q.client = client
+	canceled, err := q.CancelPending(context.TODO())
+	if err != nil {
+		t.Fatalf("Publisher.CancelPending() error = %v", err)
+	} else if canceled != 2 {
+		t.Fatalf("Publisher.CancelPending() canceled = %v, want %v", canceled, 2)
+	}
+	got := make(map[string]bool)
+	for _, r := range client.requests {
+		if r.Method != http.MethodDelete {
+			t.Fatalf("Publisher.CancelPending() method = %v, want %v", r.Method, http.MethodDelete)
+		}
+		got[r.URL.String()] = true
+	}
+	want := map[string]bool{
+		"https://qstash.upstash.io/v2/messages/mock-id-1": true,
+		"https://qstash.upstash.io/v2/messages/mock-id-2": true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Publisher.CancelPending() canceled = %v, want %v", got, want)
+	}
+
+	// Check the canceled messages are forgotten
+	if canceled, err := q.CancelPending(context.TODO()); err != nil || canceled != 0 {
+		t.Fatalf("Publisher.CancelPending() = %v, %v, want 0, nil", canceled, err)
+	}
+}
@@ -0,0 +1,78 @@
+package qstash
+
+import (
+	"net/http"
+	"time"
+)
+
+// ReceiverMetrics observes the messages received by a Receiver (see WithReceiverMetrics)
+type ReceiverMetrics interface {
+	// IncReceive is called with the response status code of every received request
+	IncReceive(status int)
+	// ObserveHandlerLatency is called with the duration of every call to the receive handler
+	ObserveHandlerLatency(d time.Duration)
+	// IncVerifyFailure is called every time a message fails signature verification
+	IncVerifyFailure()
+}
+
+// PublisherStats is a snapshot of the cumulative counters of a Publisher (see Publisher.Stats)
+type PublisherStats struct {
+	// Published is the number of messages that were published, including the ones buffered by WithBatching
+	Published int64
+	// Failed is the number of messages that could not be published
+	Failed int64
+	// Retried is the number of publish requests that took more than one attempt
+	Retried int64
+	// Deduplicated is the number of published messages that qstash reported as duplicates
+	Deduplicated int64
+	// Attempts is the total number of publish requests sent to qstash
+	Attempts int64
+}
+
+// PublisherMetrics observes the messages published by a Publisher (see WithPublisherMetrics)
+type PublisherMetrics interface {
+	// IncDeduplicated is called every time qstash reports a published message as a duplicate
+	IncDeduplicated()
+}
+
+// statusWriter records the status code written to the response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code and writes it to the response
+func (w *statusWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write writes the body to the response, implicitly writing a 200 status code
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush flushes the response if the underlying response writer supports it
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying response writer for http.ResponseController
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Status returns the status code written to the response
+func (w *statusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
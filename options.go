@@ -1,32 +1,105 @@
 package qstash
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 )
 
 // ReceiverOptions come from the environment or they can be overridden
 type ReceiverOptions struct {
-	SigningKey     string
-	NextSigningKey string
+	SigningKey      string
+	NextSigningKey  string
+	SignatureHeader string
+	MaxMessageSize  int
+	MaxRetries      int
+	MaxMessageAge   time.Duration
+	OnLastAttempt   func(ctx context.Context, m *Message)
+	HandlerTimeout  time.Duration
+	StopAfter       context.Context
+	ExpectedIssuer  string
+	// ExpectedAudience is not checked when it is empty
+	ExpectedAudience string
+	Metrics          ReceiverMetrics
+	Tracer           Tracer
+	RequireTLS       bool
+	// ForwardedProtoHeader is trusted to carry the protocol of requests when RequireTLS is set.
+	// It is not trusted when it is empty
+	ForwardedProtoHeader string
+	Verifier             Verifier
+	BodyStore            BodyStore
+	// InsecureSkipVerify only takes effect when the QSTASH_INSECURE_SKIP_VERIFY environment variable is "true"
+	InsecureSkipVerify bool
+	OnVerifyFailure    func(r *http.Request, err error)
+	Unacknowledged     struct {
+		StatusCode int
+		Body       string
+	}
 }
 
-func (o *ReceiverOptions) apply(opts ...ReceiverOption) error {
-	// Apply the receiver options
+// NewReceiverOptions returns the default receiver options overridden by opts,
+// e.g. to check the configuration with Validate before the receiver is built
+func NewReceiverOptions(opts ...ReceiverOption) ReceiverOptions {
+	var o ReceiverOptions
 	for _, opt := range append(defaultReceiverOptions, opts...) {
-		opt(o)
+		opt(&o)
 	}
-	// Validate the options
-	if o.SigningKey == "" {
+	return o
+}
+
+func (o *ReceiverOptions) apply(opts ...ReceiverOption) error {
+	// Apply the receiver options
+	*o = NewReceiverOptions(opts...)
+	return o.Validate()
+}
+
+// Validate checks the receiver options without side effects, so that configuration
+// can be checked before the receiver is built. Options that are not built with
+// NewReceiverOptions must set every option that has a default
+func (o *ReceiverOptions) Validate() error {
+	// Note: the signing keys are only used by the default verifier
+	if o.SigningKey == "" && o.Verifier == nil && !o.insecureSkipVerify() {
 		return fmt.Errorf("'QSTASH_SIGNING_KEY' is required")
 	}
-	if o.NextSigningKey == "" {
+	if o.NextSigningKey == "" && o.Verifier == nil && !o.insecureSkipVerify() {
 		return fmt.Errorf("'QSTASH_NEXT_SIGNING_KEY' is required")
 	}
+	if o.SignatureHeader == "" {
+		return fmt.Errorf("signature header is required")
+	}
+	if o.ExpectedIssuer == "" {
+		return fmt.Errorf("expected issuer is required")
+	}
+	if o.MaxMessageSize < 0 {
+		return fmt.Errorf("max message size must be at least 0")
+	}
+	if o.MaxRetries < 0 {
+		return fmt.Errorf("max retries must be at least 0")
+	}
+	if o.MaxMessageAge < 0 {
+		return fmt.Errorf("max message age must be at least 0")
+	}
+	if o.HandlerTimeout < 0 {
+		return fmt.Errorf("handler timeout must be at least 0")
+	}
+	if o.Unacknowledged.StatusCode < 300 || o.Unacknowledged.StatusCode > 599 {
+		return fmt.Errorf("unacknowledged status code must be between 300 and 599")
+	}
 	return nil
 }
 
+// insecureSkipVerify reports whether both WithInsecureSkipVerify and its environment gate are set
+func (o *ReceiverOptions) insecureSkipVerify() bool {
+	return o.InsecureSkipVerify && os.Getenv("QSTASH_INSECURE_SKIP_VERIFY") == "true"
+}
+
 // ReceiverOption overrides on of the default options
 type ReceiverOption func(*ReceiverOptions)
 
@@ -44,10 +117,172 @@ func WithNextSigningKey(signingKey string) ReceiverOption {
 	}
 }
 
+// WithSignatureHeader overrides the header the jwt signature is read from.
+// This is useful when a proxy renames the 'Upstash-Signature' header
+func WithSignatureHeader(header string) ReceiverOption {
+	return func(o *ReceiverOptions) {
+		o.SignatureHeader = header
+	}
+}
+
+// WithMaxMessageSize rejects messages with a body larger than maxSize bytes
+// with a 413 status code. A size of 0 means there is no limit.
+// Note: qstash treats the rejection like any other failure and will retry the message
+func WithMaxMessageSize(maxSize int) ReceiverOption {
+	return func(o *ReceiverOptions) {
+		o.MaxMessageSize = maxSize
+	}
+}
+
+// WithMaxRetries sets the number of retries qstash makes before giving up on a message.
+// This must match the retries the messages were published with. The default is 3
+func WithMaxRetries(retries int) ReceiverOption {
+	return func(o *ReceiverOptions) {
+		o.MaxRetries = retries
+	}
+}
+
+// WithMaxMessageAge drops messages that were signed more than maxAge ago (see Message.PublishedAt),
+// e.g. to skip stale work after an outage. Stale messages are intentionally acknowledged with a 200
+// without calling the handler, so that qstash stops retrying them. An age of 0 means there is no limit
+func WithMaxMessageAge(maxAge time.Duration) ReceiverOption {
+	return func(o *ReceiverOptions) {
+		o.MaxMessageAge = maxAge
+	}
+}
+
+// WithOnLastAttempt is called before the receive handler when the message is being delivered
+// for the last time (see WithMaxRetries). This is useful for persisting the message to
+// a fallback store before qstash gives up on it
+func WithOnLastAttempt(onLastAttempt func(ctx context.Context, m *Message)) ReceiverOption {
+	return func(o *ReceiverOptions) {
+		o.OnLastAttempt = onLastAttempt
+	}
+}
+
+// WithHandlerTimeout cancels the context passed to the receive handler after the timeout.
+// The resulting deadline is available to the handler through Message.Deadline
+func WithHandlerTimeout(timeout time.Duration) ReceiverOption {
+	return func(o *ReceiverOptions) {
+		o.HandlerTimeout = timeout
+	}
+}
+
+// WithStopAfter makes the receiver respond with a 503 to new messages once the context is done,
+// so that qstash retries them later instead of the receiver starting work it can't finish.
+// This is useful for serverless functions that are about to hit their execution limit
+func WithStopAfter(ctx context.Context) ReceiverOption {
+	return func(o *ReceiverOptions) {
+		o.StopAfter = ctx
+	}
+}
+
+// WithExpectedIssuer overrides the issuer that the jwt signature must be issued by.
+// This is useful when a gateway re-signs the messages. The default issuer is Upstash
+func WithExpectedIssuer(issuer string) ReceiverOption {
+	return func(o *ReceiverOptions) {
+		o.ExpectedIssuer = issuer
+	}
+}
+
+// WithExpectedAudience rejects messages whose jwt signature does not have the audience in its 'aud' claim.
+// This prevents a message meant for one endpoint from being accepted by another that shares the signing keys.
+// By default the audience is not checked
+func WithExpectedAudience(audience string) ReceiverOption {
+	return func(o *ReceiverOptions) {
+		o.ExpectedAudience = audience
+	}
+}
+
+// WithReceiverMetrics observes the received messages with the metrics.
+// A nil metrics is a no-op
+func WithReceiverMetrics(metrics ReceiverMetrics) ReceiverOption {
+	return func(o *ReceiverOptions) {
+		o.Metrics = metrics
+	}
+}
+
+// WithReceiverTracer wraps each received request in a 'qstash.receive' span with the message id,
+// the number of times it was retried and the response status code.
+// Responses outside of the 2xx range are recorded as errors.
+// Use qstashotel.WithReceiverTracer to trace with an OpenTelemetry tracer
+func WithReceiverTracer(tracer Tracer) ReceiverOption {
+	return func(o *ReceiverOptions) {
+		o.Tracer = tracer
+	}
+}
+
+// WithUnacknowledgedResponse overrides the response to messages the receive handler does not acknowledge.
+// The status code must not be a 2xx, or qstash would not retry the message.
+// The default is a 422 with the body "message was not acknowledged by the receiver"
+func WithUnacknowledgedResponse(statusCode int, body string) ReceiverOption {
+	return func(o *ReceiverOptions) {
+		o.Unacknowledged.StatusCode = statusCode
+		o.Unacknowledged.Body = body
+	}
+}
+
+// WithOnVerificationFailure is called with the request and the reason every time a message
+// fails verification, before the receiver responds with a 401. This is useful for audit logging
+// and alerting on forged requests. The reason never includes the signing keys
+func WithOnVerificationFailure(onFailure func(r *http.Request, err error)) ReceiverOption {
+	return func(o *ReceiverOptions) {
+		o.OnVerifyFailure = onFailure
+	}
+}
+
+// WithVerifier replaces the default signature verification with a custom verifier.
+// The signing keys are not required when a verifier is set
+func WithVerifier(verifier Verifier) ReceiverOption {
+	return func(o *ReceiverOptions) {
+		o.Verifier = verifier
+	}
+}
+
+// WithReceiverBodyStore gets the bodies of messages published with WithBodyStore back from the store
+// before the message is handled. A body that can not be got responds with a 500, so qstash retries the message
+func WithReceiverBodyStore(store BodyStore) ReceiverOption {
+	return func(o *ReceiverOptions) {
+		o.BodyStore = store
+	}
+}
+
+// WithInsecureSkipVerify accepts messages without verifying their signatures, so that handlers can be
+// tested locally with self-posted requests. It logs a warning on every request.
+// To prevent it from being enabled by accident, it only takes effect when the
+// QSTASH_INSECURE_SKIP_VERIFY environment variable is also set to "true". Never use it in production
+func WithInsecureSkipVerify() ReceiverOption {
+	return func(o *ReceiverOptions) {
+		o.InsecureSkipVerify = true
+	}
+}
+
+// WithRequireTLS rejects requests that were not received over tls with a 400 before they are verified.
+// Behind a proxy that terminates tls, use WithForwardedProtoHeader to also accept requests that the
+// proxy forwarded from https
+func WithRequireTLS() ReceiverOption {
+	return func(o *ReceiverOptions) {
+		o.RequireTLS = true
+	}
+}
+
+// WithForwardedProtoHeader sets the header WithRequireTLS trusts to carry the protocol of requests
+// forwarded by a proxy, e.g. X-Forwarded-Proto. Only set it when the proxy overwrites the header,
+// otherwise a client can send it. By default only requests received over tls are accepted
+func WithForwardedProtoHeader(header string) ReceiverOption {
+	return func(o *ReceiverOptions) {
+		o.ForwardedProtoHeader = header
+	}
+}
+
 // defaultOptions are the default options
 var defaultReceiverOptions = []ReceiverOption{
 	WithSigningKey(os.Getenv("QSTASH_SIGNING_KEY")),
 	WithNextSigningKey(os.Getenv("QSTASH_NEXT_SIGNING_KEY")),
+	WithSignatureHeader("Upstash-Signature"),
+	WithMaxRetries(3),
+	WithExpectedIssuer("Upstash"),
+	WithUnacknowledgedResponse(http.StatusUnprocessableEntity, "message was not acknowledged by the receiver"),
 }
 
 // PublisherOptions represents the options for a qstash.Publisher
@@ -55,37 +290,131 @@ type PublisherOptions struct {
 	QStashURL   string
 	QStashToken string
 	Client      struct {
-		Timeout    time.Duration
-		MaxBackOff time.Duration
-		MinBackOff time.Duration
-		Retries    int
+		Timeout               time.Duration
+		DialTimeout           time.Duration
+		TLSHandshakeTimeout   time.Duration
+		ResponseHeaderTimeout time.Duration
+		MaxBackOff            time.Duration
+		MinBackOff            time.Duration
+		Retries               int
+		RetryConcurrency      int
+		MaintenanceBackOff    time.Duration
+		RateLimitMaxWait      time.Duration
+		MaxIdleConns          int
+		MaxIdleConnsPerHost   int
+		RetryableStatuses     []int
+		BackOffJitter         bool
+		MinTLSVersion         uint16
+	}
+	JSON struct {
+		Marshal   func(v any) ([]byte, error)
+		Unmarshal func(data []byte, v any) error
 	}
-	Verbose bool
-	topic   string
+	Batching struct {
+		MaxSize  int
+		MaxDelay time.Duration
+	}
+	BodyStore struct {
+		Store     BodyStore
+		Threshold int
+	}
+	Verbose                     bool
+	DeduplicationHeader         string
+	RequestIDHeader             string
+	NoDeduplicationContentTypes []string
+	DeduplicationFunc           func(m *Message) (id string, contentBased bool, err error)
+	MaxHeaderSize               int
+	MaxLogBodySize              int
+	Metrics                     PublisherMetrics
+	Tracer                      Tracer
+	AuditLogger                 func(entry AuditEntry)
+	Filter                      func(m *Message) bool
+	Sequence                    bool
+	IDBytes                     int
+	RetryOnIDCollision          bool
+	topic                       string
+}
+
+// NewPublisherOptions returns the default publisher options overridden by opts,
+// e.g. to check the configuration with Validate before the publisher is built
+func NewPublisherOptions(opts ...PublisherOption) PublisherOptions {
+	var o PublisherOptions
+	for _, opt := range append(defaultPublisherOptions, opts...) {
+		opt(&o)
+	}
+	return o
 }
 
 // apply applies the publisher options and validates them
 func (o *PublisherOptions) apply(opts ...PublisherOption) error {
 	// Apply the publisher options
-	for _, opt := range append(defaultPublisherOptions, opts...) {
-		opt(o)
+	*o = NewPublisherOptions(opts...)
+	if o.topic == "" {
+		return fmt.Errorf("topic is required")
 	}
-	// Validate the options
+	return o.Validate()
+}
+
+// Validate checks the publisher options without side effects, so that configuration
+// can be checked before the publisher is built. The topic is checked by NewPublisher.
+// Options that are not built with NewPublisherOptions must set every option that has a default
+func (o *PublisherOptions) Validate() error {
 	if o.QStashToken == "" {
 		return fmt.Errorf("'QSTASH_TOKEN' is required")
 	}
+	if strings.HasPrefix(strings.ToLower(o.QStashToken), "bearer ") {
+		return fmt.Errorf("'QSTASH_TOKEN' must not include the 'Bearer ' prefix")
+	}
+	if strings.ContainsAny(o.QStashToken, " \t\r\n") {
+		return fmt.Errorf("'QSTASH_TOKEN' must not contain whitespace")
+	}
+	if strings.HasPrefix(o.QStashToken, "sig_") {
+		return fmt.Errorf("'QSTASH_TOKEN' looks like a signing key, use the qstash token instead")
+	}
 	if o.QStashURL == "" {
 		return fmt.Errorf("qstash url is required")
 	}
-	if o.topic == "" {
-		return fmt.Errorf("topic is required")
+	if o.RequestIDHeader != "" && !strings.HasPrefix(strings.ToLower(o.RequestIDHeader), "upstash-forward-") {
+		return fmt.Errorf("request id header must start with 'Upstash-Forward-'")
+	}
+	if o.IDBytes < 8 {
+		return fmt.Errorf("id bytes must be at least 8")
+	}
+	if o.MaxHeaderSize < 0 {
+		return fmt.Errorf("max header size must be at least 0")
+	}
+	if o.MaxLogBodySize < 0 {
+		return fmt.Errorf("max log body size must be at least 0")
 	}
 	if o.Client.Timeout < time.Millisecond {
 		return fmt.Errorf("http client timeout must at least 1 millisecond")
 	}
+	if o.Client.DialTimeout < 0 || o.Client.TLSHandshakeTimeout < 0 || o.Client.ResponseHeaderTimeout < 0 {
+		return fmt.Errorf("http client transport timeouts must be at least 0")
+	}
 	if o.Client.Retries < 0 {
 		return fmt.Errorf("http client retries must be at least 0")
 	}
+	if o.Client.MaxIdleConns < 0 || o.Client.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("http client max idle connections must be at least 0")
+	}
+	if o.Client.RateLimitMaxWait < 0 {
+		return fmt.Errorf("http client rate limit max wait must be at least 0")
+	}
+	if o.Client.MaintenanceBackOff < 0 {
+		return fmt.Errorf("http client maintenance back off must be at least 0")
+	}
+	if o.Client.RetryConcurrency < 0 {
+		return fmt.Errorf("http client retry concurrency must be at least 0")
+	}
+	if o.Client.MinTLSVersion < tls.VersionTLS10 || o.Client.MinTLSVersion > tls.VersionTLS13 {
+		return fmt.Errorf("http client min tls version must be between tls 1.0 and tls 1.3")
+	}
+	for _, statusCode := range o.Client.RetryableStatuses {
+		if statusCode < 300 || statusCode > 599 {
+			return fmt.Errorf("http client retryable status codes must be between 300 and 599")
+		}
+	}
 	if o.Client.MinBackOff < time.Millisecond {
 		return fmt.Errorf("http client min back off must at least 1 millisecond")
 	}
@@ -95,6 +424,18 @@ func (o *PublisherOptions) apply(opts ...PublisherOption) error {
 	if o.Client.MinBackOff > o.Client.MaxBackOff {
 		return fmt.Errorf("http client min back off must be less than or equal to max back off")
 	}
+	if o.Batching.MaxSize < 0 {
+		return fmt.Errorf("batching max size must be at least 0")
+	}
+	if o.Batching.MaxDelay < 0 {
+		return fmt.Errorf("batching max delay must be at least 0")
+	}
+	if o.BodyStore.Threshold < 0 {
+		return fmt.Errorf("body store threshold must be at least 0")
+	}
+	if o.JSON.Marshal == nil || o.JSON.Unmarshal == nil {
+		return fmt.Errorf("json marshal and unmarshal functions are required")
+	}
 	return nil
 }
 
@@ -115,6 +456,32 @@ func WithClientMinBackOff(minBackOff time.Duration) PublisherOption {
 	}
 }
 
+// WithBackOffJitter randomizes each exponential back off between half and all of its duration,
+// so that publishers that fail at the same time do not all retry at the same time. It is on by default
+func WithBackOffJitter(enabled bool) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.Client.BackOffJitter = enabled
+	}
+}
+
+// WithMaintenanceBackoff overrides the back off for 503 responses, which qstash returns during
+// maintenance windows that can outlast the default exponential back off.
+// A back off of 0 uses the default exponential back off
+func WithMaintenanceBackoff(backOff time.Duration) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.Client.MaintenanceBackOff = backOff
+	}
+}
+
+// WithBlockOnRateLimit makes publish wait out 429 responses for up to maxWait instead of
+// using up its retries. The wait respects the 'Retry-After' header and publish gives up
+// once the next wait would exceed maxWait. A max wait of 0 retries 429s like any other failure
+func WithBlockOnRateLimit(maxWait time.Duration) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.Client.RateLimitMaxWait = maxWait
+	}
+}
+
 // WithClientRetries overrides the default http client retries
 func WithClientRetries(retries int) PublisherOption {
 	return func(o *PublisherOptions) {
@@ -122,6 +489,23 @@ func WithClientRetries(retries int) PublisherOption {
 	}
 }
 
+// WithRetryableStatuses overrides the status codes the http client retries.
+// By default 429s and 5xxs are retried and other 4xxs are returned right away
+func WithRetryableStatuses(statusCodes []int) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.Client.RetryableStatuses = statusCodes
+	}
+}
+
+// WithGlobalRetryConcurrency limits the number of retries that can wait and execute at the
+// same time across all of the publishes of the publisher. This protects against retry storms.
+// A limit of 0 means there is no limit
+func WithGlobalRetryConcurrency(n int) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.Client.RetryConcurrency = n
+	}
+}
+
 // WithClientTimeout overrides the default http client timeout
 func WithClientTimeout(timeout time.Duration) PublisherOption {
 	return func(o *PublisherOptions) {
@@ -129,6 +513,76 @@ func WithClientTimeout(timeout time.Duration) PublisherOption {
 	}
 }
 
+// WithClientTransportTimeouts overrides the dial, tls handshake and response header timeouts
+// of the http client's transport. A timeout of 0 keeps the transport's default
+func WithClientTransportTimeouts(dial, tlsHandshake, responseHeader time.Duration) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.Client.DialTimeout = dial
+		o.Client.TLSHandshakeTimeout = tlsHandshake
+		o.Client.ResponseHeaderTimeout = responseHeader
+	}
+}
+
+// WithClientMaxIdleConns overrides the max number of idle connections the http client's transport keeps
+// across all hosts. 0 means no limit. The default is 100
+func WithClientMaxIdleConns(n int) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.Client.MaxIdleConns = n
+	}
+}
+
+// WithClientMaxIdleConnsPerHost overrides the max number of idle connections the http client's transport
+// keeps to the qstash host. The default is 100, rather than the standard library's 2, since a publisher
+// sends all of its requests to a single host
+func WithClientMaxIdleConnsPerHost(n int) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.Client.MaxIdleConnsPerHost = n
+	}
+}
+
+// WithMinTLSVersion sets the minimum tls version of the connections to qstash, e.g. tls.VersionTLS13.
+// The default is tls.VersionTLS12
+func WithMinTLSVersion(version uint16) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.Client.MinTLSVersion = version
+	}
+}
+
+// WithBatching buffers published messages and sends them to the qstash batch endpoint
+// once maxSize messages are buffered or maxDelay has passed since the first buffered message.
+// Call Flush or Close to publish the remaining buffered messages. Flush and Close also return the errors
+// of the batches that were sent since the last Flush. A batch that failed with a transient error is sent
+// again with the next batch and a batch that qstash rejected is dropped. Publishing returns ErrBatchFull
+// while the batches that failed fill the buffer of 10 batches.
+// A body that is not valid utf-8 is base64 encoded and sent with a 'Go-Qstash-Body-Encoding: base64' header,
+// which the Receiver uses to decode it
+func WithBatching(maxSize int, maxDelay time.Duration) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.Batching.MaxSize = maxSize
+		o.Batching.MaxDelay = maxDelay
+	}
+}
+
+// WithBodyStore puts the bodies of messages larger than threshold bytes in the store and publishes their
+// reference instead, so that messages can be larger than qstash's size limit. The receiver must use
+// WithReceiverBodyStore with the same store. Streamed bodies (see Message.BodyStream) are not offloaded.
+// Note: the reference of an offloaded body is unique, so content based deduplication does not apply to it
+func WithBodyStore(store BodyStore, threshold int) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.BodyStore.Store = store
+		o.BodyStore.Threshold = threshold
+	}
+}
+
+// WithJSONCodec overrides the json library used to marshal message bodies and decode responses.
+// The default codec is encoding/json. DecodeEvent always decodes events with encoding/json
+func WithJSONCodec(marshal func(v any) ([]byte, error), unmarshal func(data []byte, v any) error) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.JSON.Marshal = marshal
+		o.JSON.Unmarshal = unmarshal
+	}
+}
+
 // WithQStashURL sets the url for the qstash publisher
 // The default url is https://qstash.upstash.io/v1/publish
 func WithQStashURL(url string) PublisherOption {
@@ -153,6 +607,121 @@ func WithVerbose() PublisherOption {
 	}
 }
 
+// WithMaxLogBodySize caps the number of bytes of each response body logged by WithVerbose.
+// Longer bodies are truncated. The default is 4KiB
+func WithMaxLogBodySize(maxSize int) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.MaxLogBodySize = maxSize
+	}
+}
+
+// WithDeduplicationHeader overrides the deduplication id header sent with each message.
+// The default header is Upstash-Deduplication-Id
+func WithDeduplicationHeader(header string) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.DeduplicationHeader = header
+	}
+}
+
+// WithoutDeduplicationFor disables the generated deduplication id for messages published
+// with one of the content types (see WithContentType). This is useful when binary or
+// streaming content is published alongside json events that should be deduplicated.
+// Deduplication ids set explicitly on the message or with the publish options still apply
+func WithoutDeduplicationFor(contentTypes ...string) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.NoDeduplicationContentTypes = append(o.NoDeduplicationContentTypes, contentTypes...)
+	}
+}
+
+// WithDeduplicationFunc computes the deduplication id or content based deduplication of each
+// message when it is published. It is not called when the publish options set a deduplication
+// strategy, and its result must not conflict with the message id
+func WithDeduplicationFunc(fn func(m *Message) (id string, contentBased bool, err error)) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.DeduplicationFunc = fn
+	}
+}
+
+// WithMaxHeaderSize overrides the max total size in bytes of the 'Upstash-Forward-' headers
+// of a message, which is checked before the message is published. A size of 0 disables the check.
+// The default is 16KiB
+func WithMaxHeaderSize(maxSize int) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.MaxHeaderSize = maxSize
+	}
+}
+
+// WithPublisherMetrics observes the published messages with the metrics.
+// A nil metrics is a no-op
+func WithPublisherMetrics(metrics PublisherMetrics) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.Metrics = metrics
+	}
+}
+
+// WithAuditLogger calls the logger with an AuditEntry after each message is published,
+// including the messages of a batch once it is sent (see WithBatching)
+func WithAuditLogger(logger func(entry AuditEntry)) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.AuditLogger = logger
+	}
+}
+
+// WithPublishFilter skips publishing the messages the filter returns false for, e.g. empty bodies or test traffic.
+// Skipped messages are not sent to qstash and their publish returns ErrFiltered
+func WithPublishFilter(filter func(m *Message) bool) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.Filter = filter
+	}
+}
+
+// WithTracer wraps each publish in a 'qstash.publish' span with the destination, the message id,
+// the status code of the response and the number of attempts. Failed publishes are recorded as errors.
+// Use qstashotel.WithTracer to trace with an OpenTelemetry tracer
+func WithTracer(tracer Tracer) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.Tracer = tracer
+	}
+}
+
+// WithSequence numbers the messages of the publisher to each destination with a 'Upstash-Forward-Sequence'
+// header that starts at 1 and a 'Upstash-Forward-Stream-Id' header that is unique to the publisher and destination.
+// Messages to the same destination are published one at a time, so that a failed publish does not leave a gap.
+// Use a Sequencer to receive the messages of each stream in order
+func WithSequence() PublisherOption {
+	return func(o *PublisherOptions) {
+		o.Sequence = true
+	}
+}
+
+// WithIDBytes overrides the number of random bytes in the generated deduplication and request ids.
+// Fewer bytes make shorter ids and more bytes make collisions less likely.
+// The default is 16 and the minimum is 8
+func WithIDBytes(n int) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.IDBytes = n
+	}
+}
+
+// WithRetryOnIDCollision publishes a message again with a new id when qstash reports its generated
+// deduplication id as a duplicate. The collision means a new message would have been dropped,
+// which is more likely with short ids (see WithIDBytes). The message is published again once
+func WithRetryOnIDCollision() PublisherOption {
+	return func(o *PublisherOptions) {
+		o.RetryOnIDCollision = true
+	}
+}
+
+// WithRequestIDHeader overrides the header used to trace each published message.
+// A request id is generated for every message that does not already have one and
+// is returned in PublishResult.RequestID. An empty header disables the request id.
+// The default header is Upstash-Forward-X-Request-Id
+func WithRequestIDHeader(header string) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.RequestIDHeader = header
+	}
+}
+
 // withTopic sets the topic for the qstash publisher
 func withTopic(topic string) PublisherOption {
 	return func(o *PublisherOptions) {
@@ -168,6 +737,15 @@ var defaultPublisherOptions = []PublisherOption{
 	WithClientMaxBackOff(time.Second),
 	WithClientMinBackOff(200 * time.Millisecond),
 	WithClientRetries(5),
+	WithBackOffJitter(true),
+	WithClientMaxIdleConns(100),
+	WithClientMaxIdleConnsPerHost(100),
+	WithMinTLSVersion(tls.VersionTLS12),
+	WithJSONCodec(json.Marshal, json.Unmarshal),
+	WithRequestIDHeader("Upstash-Forward-X-Request-Id"),
+	WithMaxHeaderSize(16 * 1024),
+	WithMaxLogBodySize(4 * 1024),
+	WithIDBytes(16),
 }
 
 // PublishOptions represents the options for an individual publish request
@@ -175,17 +753,55 @@ type PublishOptions struct {
 	Delay                     time.Duration
 	Retries                   int
 	ContentBasedDeduplication bool
+	DeduplicationID           string
+	DeduplicationScope        string
+	Callback                  string
+	ContentType               string
+	Timeout                   time.Duration
+	NotBefore                 time.Time
+	CorrelationID             string
 }
 
+// ErrConflictingDelay is returned when a message is published with both a delay and a not before time
+var ErrConflictingDelay = errors.New("conflicting delay options")
+
 // apply applies the publish options and validates them
+// Note: the options are applied before any headers are set, so the order of the options does not matter
 func (o *PublishOptions) apply(opts ...PublishOption) error {
 	// Apply the publish options
 	for _, opt := range opts {
 		opt(o)
 	}
+	// Validate the options
+	if o.Delay < 0 {
+		return fmt.Errorf("delay must be at least 0")
+	}
+	if o.Delay > 0 && !o.NotBefore.IsZero() {
+		return fmt.Errorf("%w: a message can not have both a delay and a not before time", ErrConflictingDelay)
+	}
+	if o.Retries < 0 {
+		return fmt.Errorf("retries must be at least 0")
+	}
+	if o.Timeout < 0 {
+		return fmt.Errorf("timeout must be at least 0")
+	}
+	if o.Callback != "" {
+		if u, err := url.Parse(o.Callback); err != nil || !u.IsAbs() || u.Host == "" {
+			return fmt.Errorf("callback must be an absolute url")
+		}
+	}
 	return nil
 }
 
+// deliverAt returns when qstash delivers a message published with the options,
+// or the zero time when it is delivered right away
+func (o *PublishOptions) deliverAt() time.Time {
+	if o.Delay > 0 {
+		return time.Now().Add(o.Delay)
+	}
+	return o.NotBefore
+}
+
 // PublishOption overrides one of the default publish options
 type PublishOption func(*PublishOptions)
 
@@ -196,6 +812,13 @@ func WithDelay(delay time.Duration) PublishOption {
 	}
 }
 
+// WithNotBefore delays the message until the time. It can not be combined with WithDelay
+func WithNotBefore(t time.Time) PublishOption {
+	return func(o *PublishOptions) {
+		o.NotBefore = t
+	}
+}
+
 // WithContentBasedDeduplication sets the content base deduplication header
 // WARNING: this will override the unique message ids generated by the qstash publisher
 //
@@ -206,9 +829,98 @@ func WithContentBasedDeduplication() PublishOption {
 	}
 }
 
+// WithDeduplicationID sets a custom deduplication id for the message.
+// It cannot be combined with content based deduplication or a custom message id.
+// Like a custom message id, it must be at most 256 letters, digits, '-', '_', '.' or ':'
+func WithDeduplicationID(id string) PublishOption {
+	return func(o *PublishOptions) {
+		o.DeduplicationID = id
+	}
+}
+
+// WithCallback sets the url qstash calls with the response of the destination
+func WithCallback(callback string) PublishOption {
+	return func(o *PublishOptions) {
+		o.Callback = callback
+	}
+}
+
+// WithContentType overrides the content type of the message
+// The default content type is application/json
+func WithContentType(contentType string) PublishOption {
+	return func(o *PublishOptions) {
+		o.ContentType = contentType
+	}
+}
+
+// WithDeduplicationScope namespaces the generated and content based deduplication ids
+// by prefixing them with the scope. This prevents deduplication collisions between
+// logical streams that share a publisher. Custom deduplication ids are not scoped.
+// Note: scoped content based deduplication ids are computed on the client from the destination, the forwarded headers and the body
+func WithDeduplicationScope(scope string) PublishOption {
+	return func(o *PublishOptions) {
+		o.DeduplicationScope = scope
+	}
+}
+
+// WithTimeout overrides how long qstash waits for the destination to respond to each delivery of the message.
+// qstash can not extend a delivery that is in flight, so set it at publish time for long running handlers,
+// or acknowledge the message early (see Message.Ack)
+func WithTimeout(timeout time.Duration) PublishOption {
+	return func(o *PublishOptions) {
+		o.Timeout = timeout
+	}
+}
+
+// WithCorrelationID forwards the correlation id to the destination in a 'Correlation-Id' header
+// and echoes it in PublishResult.CorrelationID, to join the published message to local records
+func WithCorrelationID(id string) PublishOption {
+	return func(o *PublishOptions) {
+		o.CorrelationID = id
+	}
+}
+
 // WithRetries overrides the number of retries for the message
 func WithRetries(retries int) PublishOption {
 	return func(o *PublishOptions) {
 		o.Retries = retries
 	}
 }
+
+// ListOptions represents the options for listing messages
+type ListOptions struct {
+	PageSize int
+	MaxPages int
+}
+
+// apply applies the list options and validates them
+func (o *ListOptions) apply(opts ...ListOption) error {
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.PageSize < 0 {
+		return fmt.Errorf("page size must be at least 0")
+	}
+	if o.MaxPages < 0 {
+		return fmt.Errorf("max pages must be at least 0")
+	}
+	return nil
+}
+
+// ListOption overrides one of the default list options
+type ListOption func(*ListOptions)
+
+// WithPageSize sets the number of events requested from qstash per page.
+// The default is qstash's own page size
+func WithPageSize(n int) ListOption {
+	return func(o *ListOptions) {
+		o.PageSize = n
+	}
+}
+
+// WithMaxPages stops listing after n pages. The default is to follow the cursor to the last page
+func WithMaxPages(n int) ListOption {
+	return func(o *ListOptions) {
+		o.MaxPages = n
+	}
+}
@@ -0,0 +1,180 @@
+package qstash
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestPublisherOptions_apply(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []PublisherOption
+		wantErr bool
+	}{{
+		name: "Valid token",
+		opts: []PublisherOption{WithQStashToken("token")},
+	}, {
+		name:    "Empty token fails",
+		opts:    []PublisherOption{WithQStashToken("")},
+		wantErr: true,
+	}, {
+		name:    "Token with a bearer prefix fails",
+		opts:    []PublisherOption{WithQStashToken("Bearer token")},
+		wantErr: true,
+	}, {
+		name:    "Token with whitespace fails",
+		opts:    []PublisherOption{WithQStashToken("token\n")},
+		wantErr: true,
+	}, {
+		name:    "Signing key as token fails",
+		opts:    []PublisherOption{WithQStashToken("sig_key")},
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var o PublisherOptions
+			if err := o.apply(append(tt.opts, withTopic("topic"))...); (err != nil) != tt.wantErr {
+				t.Fatalf("PublisherOptions.apply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPublisherOptions_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(o *PublisherOptions)
+		wantErr bool
+	}{
+		{name: "Default options are valid", modify: func(o *PublisherOptions) {}},
+		{name: "Empty token fails", modify: func(o *PublisherOptions) { o.QStashToken = "" }, wantErr: true},
+		{name: "Token with a bearer prefix fails", modify: func(o *PublisherOptions) { o.QStashToken = "Bearer token" }, wantErr: true},
+		{name: "Token with whitespace fails", modify: func(o *PublisherOptions) { o.QStashToken = "token\n" }, wantErr: true},
+		{name: "Signing key as token fails", modify: func(o *PublisherOptions) { o.QStashToken = "sig_key" }, wantErr: true},
+		{name: "Empty url fails", modify: func(o *PublisherOptions) { o.QStashURL = "" }, wantErr: true},
+		{name: "Request id header without the forward prefix fails", modify: func(o *PublisherOptions) { o.RequestIDHeader = "X-Request-Id" }, wantErr: true},
+		{name: "Small id bytes fails", modify: func(o *PublisherOptions) { o.IDBytes = 4 }, wantErr: true},
+		{name: "Negative max header size fails", modify: func(o *PublisherOptions) { o.MaxHeaderSize = -1 }, wantErr: true},
+		{name: "Negative max log body size fails", modify: func(o *PublisherOptions) { o.MaxLogBodySize = -1 }, wantErr: true},
+		{name: "Small client timeout fails", modify: func(o *PublisherOptions) { o.Client.Timeout = 0 }, wantErr: true},
+		{name: "Negative dial timeout fails", modify: func(o *PublisherOptions) { o.Client.DialTimeout = -1 }, wantErr: true},
+		{name: "Negative tls handshake timeout fails", modify: func(o *PublisherOptions) { o.Client.TLSHandshakeTimeout = -1 }, wantErr: true},
+		{name: "Negative response header timeout fails", modify: func(o *PublisherOptions) { o.Client.ResponseHeaderTimeout = -1 }, wantErr: true},
+		{name: "Negative max idle conns fails", modify: func(o *PublisherOptions) { o.Client.MaxIdleConns = -1 }, wantErr: true},
+		{name: "Negative max idle conns per host fails", modify: func(o *PublisherOptions) { o.Client.MaxIdleConnsPerHost = -1 }, wantErr: true},
+		{name: "Unknown min tls version fails", modify: func(o *PublisherOptions) { o.Client.MinTLSVersion = 0 }, wantErr: true},
+		{name: "Negative retries fails", modify: func(o *PublisherOptions) { o.Client.Retries = -1 }, wantErr: true},
+		{name: "Negative rate limit max wait fails", modify: func(o *PublisherOptions) { o.Client.RateLimitMaxWait = -1 }, wantErr: true},
+		{name: "Negative maintenance back off fails", modify: func(o *PublisherOptions) { o.Client.MaintenanceBackOff = -1 }, wantErr: true},
+		{name: "Negative retry concurrency fails", modify: func(o *PublisherOptions) { o.Client.RetryConcurrency = -1 }, wantErr: true},
+		{name: "Retryable status that is not an error fails", modify: func(o *PublisherOptions) { o.Client.RetryableStatuses = []int{http.StatusOK} }, wantErr: true},
+		{name: "Small min back off fails", modify: func(o *PublisherOptions) { o.Client.MinBackOff = 0 }, wantErr: true},
+		{name: "Small max back off fails", modify: func(o *PublisherOptions) { o.Client.MaxBackOff = 0 }, wantErr: true},
+		{name: "Min back off above max back off fails", modify: func(o *PublisherOptions) { o.Client.MinBackOff = o.Client.MaxBackOff + 1 }, wantErr: true},
+		{name: "Negative batching max size fails", modify: func(o *PublisherOptions) { o.Batching.MaxSize = -1 }, wantErr: true},
+		{name: "Negative batching max delay fails", modify: func(o *PublisherOptions) { o.Batching.MaxDelay = -1 }, wantErr: true},
+		{name: "Missing json codec fails", modify: func(o *PublisherOptions) { o.JSON.Marshal = nil }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := NewPublisherOptions(WithQStashToken("token"))
+			tt.modify(&o)
+			if err := o.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("PublisherOptions.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReceiverOptions_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(o *ReceiverOptions)
+		wantErr bool
+	}{
+		{name: "Default options are valid", modify: func(o *ReceiverOptions) {}},
+		{name: "Empty signing key fails", modify: func(o *ReceiverOptions) { o.SigningKey = "" }, wantErr: true},
+		{name: "Empty next signing key fails", modify: func(o *ReceiverOptions) { o.NextSigningKey = "" }, wantErr: true},
+		{name: "Empty signing keys with a verifier are valid", modify: func(o *ReceiverOptions) {
+			o.SigningKey, o.NextSigningKey = "", ""
+			o.Verifier = VerifierFunc(func(*http.Request, []byte) (jwt.MapClaims, error) { return nil, nil })
+		}},
+		{name: "Empty signature header fails", modify: func(o *ReceiverOptions) { o.SignatureHeader = "" }, wantErr: true},
+		{name: "Empty expected issuer fails", modify: func(o *ReceiverOptions) { o.ExpectedIssuer = "" }, wantErr: true},
+		{name: "Negative max message size fails", modify: func(o *ReceiverOptions) { o.MaxMessageSize = -1 }, wantErr: true},
+		{name: "Negative max retries fails", modify: func(o *ReceiverOptions) { o.MaxRetries = -1 }, wantErr: true},
+		{name: "Negative max message age fails", modify: func(o *ReceiverOptions) { o.MaxMessageAge = -1 }, wantErr: true},
+		{name: "Negative handler timeout fails", modify: func(o *ReceiverOptions) { o.HandlerTimeout = -1 }, wantErr: true},
+		{name: "Successful unacknowledged status fails", modify: func(o *ReceiverOptions) { o.Unacknowledged.StatusCode = http.StatusOK }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := NewReceiverOptions(WithSigningKey("key"), WithNextSigningKey("next key"))
+			tt.modify(&o)
+			if err := o.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("ReceiverOptions.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewPublisherOptions(t *testing.T) {
+	// Configuration that is loaded into the options outside of the functional options
+	o := NewPublisherOptions()
+	o.QStashToken = "token"
+	o.Client.Retries = 1
+	if err := o.Validate(); err != nil {
+		t.Fatalf("PublisherOptions.Validate() error = %v", err)
+	} else if o.IDBytes != 16 || o.Client.MinTLSVersion != tls.VersionTLS12 || o.JSON.Marshal == nil {
+		t.Fatalf("NewPublisherOptions() = %+v, want the defaults", o)
+	}
+}
+
+func TestNewReceiverOptions(t *testing.T) {
+	// Configuration that is loaded into the options outside of the functional options
+	o := NewReceiverOptions()
+	o.SigningKey = "key"
+	o.NextSigningKey = "next key"
+	o.MaxRetries = 1
+	if err := o.Validate(); err != nil {
+		t.Fatalf("ReceiverOptions.Validate() error = %v", err)
+	} else if o.SignatureHeader != "Upstash-Signature" || o.ExpectedIssuer != "Upstash" || o.Unacknowledged.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("NewReceiverOptions() = %+v, want the defaults", o)
+	}
+}
+
+func TestPublishOptions_apply(t *testing.T) {
+	notBefore := time.Now().Add(time.Hour)
+	tests := []struct {
+		name    string
+		opts    []PublishOption
+		wantErr error
+	}{{
+		name: "Delay only",
+		opts: []PublishOption{WithDelay(time.Minute)},
+	}, {
+		name: "Not before only",
+		opts: []PublishOption{WithNotBefore(notBefore)},
+	}, {
+		name:    "Delay and not before fails",
+		opts:    []PublishOption{WithDelay(time.Minute), WithNotBefore(notBefore)},
+		wantErr: ErrConflictingDelay,
+	}, {
+		name:    "Not before and delay fails",
+		opts:    []PublishOption{WithNotBefore(notBefore), WithDelay(time.Minute)},
+		wantErr: ErrConflictingDelay,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var o PublishOptions
+			if err := o.apply(tt.opts...); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("PublishOptions.apply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
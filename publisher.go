@@ -3,12 +3,21 @@ package qstash
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,9 +32,120 @@ type Publisher struct {
 	uuid interface {
 		NewV4() (string, error)
 	}
-	verbose bool
+	verbose             bool
+	maxLogBodySize      int
+	logf                func(format string, v ...any)
+	deduplicationHeader string
+	requestIDHeader     string
+	json                jsonCodec
+	batch               *batcher
+	bodyStore           BodyStore
+	bodyStoreThreshold  int
+	// noDeduplicationContentTypes are the media types published without a generated deduplication id
+	noDeduplicationContentTypes map[string]bool
+	deduplicationFunc           func(m *Message) (id string, contentBased bool, err error)
+	maxHeaderSize               int
+	retryOnIDCollision          bool
+	metrics                     PublisherMetrics
+	tracer                      Tracer
+	auditLogger                 func(entry AuditEntry)
+	filter                      func(m *Message) bool
+	deduplicated                atomic.Int64
+	published                   atomic.Int64
+	failed                      atomic.Int64
+	retried                     atomic.Int64
+	attempts                    atomic.Int64
+	// deduplicationScope scopes the generated deduplication ids of publishes without a deduplication scope
+	deduplicationScope atomic.Pointer[string]
+	// streamID and the sequences of each destination number the published messages when WithSequence is set
+	streamID    string
+	sequencesMu sync.Mutex
+	sequences   map[string]*destinationSequence
+	// pending are the delivery times of the delayed messages by id (see CancelPending)
+	pendingMu      sync.Mutex
+	pending        map[string]time.Time
+	pendingPruneAt int
 }
 
+// ErrMarshal is returned when a message body can not be marshaled
+var ErrMarshal = errors.New("could not marshal message")
+
+// ErrConflictingDedup is returned when more than one deduplication strategy is set for a message
+var ErrConflictingDedup = errors.New("conflicting deduplication options")
+
+// ErrInvalidDeduplicationID is returned when a custom deduplication id is too long or has illegal characters
+var ErrInvalidDeduplicationID = errors.New("invalid deduplication id")
+
+// ErrHeadersTooLarge is returned when the forwarded headers of a message exceed the max header size
+var ErrHeadersTooLarge = errors.New("message headers are too large")
+
+// ErrFiltered is returned when the publish filter skips a message (see WithPublishFilter)
+var ErrFiltered = errors.New("message was filtered")
+
+// ErrGone is returned when a publish fails with a permanent 410 Gone. It is not retried
+var ErrGone = errors.New("destination is gone")
+
+// PublishError is returned when qstash could not be reached or responded with a status outside of the 2xx range.
+// A publish that is cancelled by its context returns the context error instead
+type PublishError struct {
+	// StatusCode is the status code qstash responded with. It is 0 when no response was received
+	StatusCode int
+	// Body is the body qstash responded with
+	Body string
+	// Err is the underlying error, e.g. a network error or ErrGone
+	Err error
+}
+
+// Error returns the error message
+func (e *PublishError) Error() string {
+	if e.StatusCode == 0 && e.Err == nil {
+		return "could not complete request"
+	} else if e.StatusCode == 0 {
+		return e.Err.Error()
+	} else if e.Err != nil {
+		return fmt.Sprintf("%v: %s", e.Err, e.Body)
+	}
+	return fmt.Sprintf("bad request status %d: %s", e.StatusCode, e.Body)
+}
+
+// Unwrap returns the underlying error
+func (e *PublishError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient returns true if the publish may succeed when it is tried again later,
+// i.e. it failed with a network error, a 5xx or a 429. Other 4xxs are permanent,
+// so the message should be fixed or dead lettered rather than retried
+func (e *PublishError) IsTransient() bool {
+	return e.StatusCode == 0 || e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// jsonCodec marshals and unmarshals json with a custom codec (see WithJSONCodec)
+// and falls back to encoding/json
+type jsonCodec struct {
+	marshal   func(v any) ([]byte, error)
+	unmarshal func(data []byte, v any) error
+}
+
+// Marshal marshals v to json
+func (c jsonCodec) Marshal(v any) ([]byte, error) {
+	if c.marshal == nil {
+		return json.Marshal(v)
+	}
+	return c.marshal(v)
+}
+
+// Unmarshal unmarshals json data into v
+func (c jsonCodec) Unmarshal(data []byte, v any) error {
+	if c.unmarshal == nil {
+		return json.Unmarshal(data, v)
+	}
+	return c.unmarshal(data, v)
+}
+
+// defaultDeduplicationHeader is the header qstash reads the deduplication id from. It is the same for the v1 and v2 apis
+const defaultDeduplicationHeader = "Upstash-Deduplication-Id"
+
 // NewPublisher creates a new qstash publisher
 func NewPublisher(topic string, opts ...PublisherOption) (*Publisher, error) {
 	// Apply the options
@@ -33,103 +153,821 @@ func NewPublisher(topic string, opts ...PublisherOption) (*Publisher, error) {
 	if err := os.apply(append(opts, withTopic(topic))...); err != nil {
 		return nil, err
 	}
+	var retrySemaphore chan struct{}
+	if os.Client.RetryConcurrency > 0 {
+		retrySemaphore = make(chan struct{}, os.Client.RetryConcurrency)
+	}
+	var retryableStatuses map[int]bool
+	if os.Client.RetryableStatuses != nil {
+		retryableStatuses = make(map[int]bool, len(os.Client.RetryableStatuses))
+		for _, statusCode := range os.Client.RetryableStatuses {
+			retryableStatuses[statusCode] = true
+		}
+	}
+	var batch *batcher
+	if os.Batching.MaxSize > 0 {
+		batch = &batcher{
+			maxSize:     os.Batching.MaxSize,
+			maxDelay:    os.Batching.MaxDelay,
+			maxBuffered: maxBufferedBatches * os.Batching.MaxSize,
+		}
+	}
+	var streamID string
+	if os.Sequence {
+		id, err := new(uuid).NewV4()
+		if err != nil {
+			return nil, fmt.Errorf("could not generate stream id %w", err)
+		}
+		streamID = id
+	}
+	noDeduplicationContentTypes := make(map[string]bool, len(os.NoDeduplicationContentTypes))
+	for _, contentType := range os.NoDeduplicationContentTypes {
+		noDeduplicationContentTypes[mediaType(contentType)] = true
+	}
 	return &Publisher{
 		token: os.QStashToken,
 		url:   os.QStashURL,
 		topic: os.topic,
-		uuid:  new(uuid),
+		uuid:  &uuid{size: os.IDBytes},
 		client: &httpClient{
 			client: &http.Client{
-				Timeout: os.Client.Timeout,
+				Timeout:   os.Client.Timeout,
+				Transport: newTransport(&os),
 			},
-			MaxBackOff: os.Client.MaxBackOff,
-			MinBackOff: os.Client.MinBackOff,
-			Retries:    os.Client.Retries,
+			MaxBackOff:         os.Client.MaxBackOff,
+			MinBackOff:         os.Client.MinBackOff,
+			Retries:            os.Client.Retries,
+			MaintenanceBackOff: os.Client.MaintenanceBackOff,
+			RateLimitMaxWait:   os.Client.RateLimitMaxWait,
+			Jitter:             os.Client.BackOffJitter,
+			RetryableStatuses:  retryableStatuses,
+			retrySemaphore:     retrySemaphore,
 		},
-		verbose: os.Verbose,
+		verbose:             os.Verbose,
+		maxLogBodySize:      os.MaxLogBodySize,
+		logf:                log.Printf,
+		deduplicationHeader: os.DeduplicationHeader,
+		requestIDHeader:     os.RequestIDHeader,
+		json: jsonCodec{
+			marshal:   os.JSON.Marshal,
+			unmarshal: os.JSON.Unmarshal,
+		},
+		noDeduplicationContentTypes: noDeduplicationContentTypes,
+		deduplicationFunc:           os.DeduplicationFunc,
+		maxHeaderSize:               os.MaxHeaderSize,
+		metrics:                     os.Metrics,
+		tracer:                      os.Tracer,
+		auditLogger:                 os.AuditLogger,
+		filter:                      os.Filter,
+		retryOnIDCollision:          os.RetryOnIDCollision,
+		streamID:                    streamID,
+		batch:                       batch,
+		bodyStore:                   os.BodyStore.Store,
+		bodyStoreThreshold:          os.BodyStore.Threshold,
 	}, nil
 }
 
-// Publish publishes a message to the QStash
+// NewPublisherFromURL creates a new qstash publisher from a url of the form
+// 'qstash://token@host/destination', e.g. 'qstash://token@qstash.upstash.io/https://example.com/api'.
+// Use the 'qstash+http' scheme for a qstash server without tls.
+// The options are applied after the url, so they override its token and host
+func NewPublisherFromURL(dsn string, opts ...PublisherOption) (*Publisher, error) {
+	// Parse the scheme
+	var scheme, rest string
+	if rest = strings.TrimPrefix(dsn, "qstash://"); rest != dsn {
+		scheme = "https"
+	} else if rest = strings.TrimPrefix(dsn, "qstash+http://"); rest != dsn {
+		scheme = "http"
+	} else {
+		return nil, fmt.Errorf("qstash url must start with 'qstash://' or 'qstash+http://'")
+	}
+	// Parse the token, host and destination. The token is only looked for before the destination,
+	// which may contain an '@' of its own
+	authority, destination, _ := strings.Cut(rest, "/")
+	at := strings.LastIndex(authority, "@")
+	if at < 0 {
+		return nil, fmt.Errorf("qstash url is missing the token")
+	}
+	token, err := url.PathUnescape(authority[:at])
+	if err != nil {
+		return nil, fmt.Errorf("could not unescape the qstash url token %w", err)
+	} else if len(token) == 0 {
+		return nil, fmt.Errorf("qstash url is missing the token")
+	}
+	host := authority[at+1:]
+	if len(host) == 0 {
+		return nil, fmt.Errorf("qstash url is missing the host")
+	} else if len(destination) == 0 {
+		return nil, fmt.Errorf("qstash url is missing the destination")
+	}
+	return NewPublisher(destination, append([]PublisherOption{
+		WithQStashURL(fmt.Sprintf("%s://%s/v2/publish", scheme, host)),
+		WithQStashToken(token),
+	}, opts...)...)
+}
+
+// PublishResult is the result of publishing a message
+type PublishResult struct {
+	MessageID string
+	Attempts  int
+	// URL is the endpoint of a url group that the message was published to
+	URL string
+	// Deduplicated is true when qstash dropped the message as a duplicate of an earlier message
+	Deduplicated bool
+	// DeduplicationID is the deduplication id qstash computed for content based deduplication.
+	// It is empty when qstash does not return one
+	DeduplicationID string
+	// CorrelationID is the correlation id the message was published with (see WithCorrelationID)
+	CorrelationID string
+	// RequestID is the request id the message was traced with (see WithRequestIDHeader)
+	RequestID string
+	// Endpoints are the results for each endpoint when the message was published to a url group.
+	// MessageID is the id of the first endpoint's message
+	Endpoints []PublishResult
+}
+
+// Publish publishes a message to the QStash and sets the message id
+// Note: when WithBatching is enabled, the message is buffered and its id is not set
+//
+// Deprecated: Publish overwrites m.ID, the message's deduplication id, with the id qstash assigned to it.
+// Use PublishWithResult, which returns the message id and whether the message was deduplicated instead
 func (q *Publisher) Publish(ctx context.Context, m *Message, opts ...PublishOption) error {
+	res, err := q.PublishWithResult(ctx, m, opts...)
+	if err != nil {
+		return err
+	} else if len(res.MessageID) > 0 {
+		m.ID = res.MessageID
+	}
+	return nil
+}
+
+// PublishWithResult publishes a message to the QStash and returns the result. The message is not modified
+// Note: when WithBatching is enabled, the message is buffered and the result is empty
+func (q *Publisher) PublishWithResult(ctx context.Context, m *Message, opts ...PublishOption) (*PublishResult, error) {
+	return q.publish(ctx, q.topic, m, opts...)
+}
+
+// PublishRaw publishes a message to the QStash and returns the response with its body unread,
+// as an escape hatch to the parts of the response the library does not model, like its headers.
+// The response is returned whatever its status code and the caller must close its body.
+// Note: the message is never batched and, as the response is not read, the message id is not
+// set, delayed messages can not be cancelled with CancelPending and the audit log has no message id
+func (q *Publisher) PublishRaw(ctx context.Context, m *Message, opts ...PublishOption) (*http.Response, error) {
+	var rsp *http.Response
+	_, err := q.observePublish(ctx, q.topic, m, func(ctx context.Context) (res *PublishResult, err error) {
+		rsp, res, err = q.publishRawMessage(ctx, m, opts...)
+		return res, err
+	})
+	if rsp != nil {
+		return rsp, nil
+	}
+	return nil, err
+}
+
+// publishRawMessage publishes the message like publishMessage, but returns the response with its body unread.
+// A response that is not a 2xx is returned with a PublishError
+func (q *Publisher) publishRawMessage(ctx context.Context, m *Message, opts ...PublishOption) (_ *http.Response, _ *PublishResult, err error) {
+	size := messageSize(m)
+	if m, err = q.offloadBody(ctx, m); err != nil {
+		return nil, nil, err
+	}
+	pr, err := q.newPublishRequest(ctx, q.topic, m, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := pr.Request
+
+	// Publish the message in its destination's stream
+	done := q.nextSequence(r, q.topic)
+	rsp, attempts, err := q.do(ctx, r)
+	if err != nil {
+		done(true)
+		return nil, nil, err
+	} else if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		done(false)
+		return rsp, nil, &PublishError{StatusCode: rsp.StatusCode}
+	}
+	done(true)
+	q.audit(q.topic, "", r.Header.Get(q.deduplicationIDHeader()), size)
+	return rsp, &PublishResult{
+		Attempts:      attempts,
+		CorrelationID: pr.correlationID,
+		RequestID:     pr.requestID,
+	}, nil
+}
+
+// publish publishes a message to the destination
+func (q *Publisher) publish(ctx context.Context, destination string, m *Message, opts ...PublishOption) (*PublishResult, error) {
+	return q.observePublish(ctx, destination, m, func(ctx context.Context) (*PublishResult, error) {
+		return q.publishMessage(ctx, destination, m, opts...)
+	})
+}
+
+// observePublish filters, traces and counts a publish of the message to the destination
+func (q *Publisher) observePublish(ctx context.Context, destination string, m *Message, publish func(ctx context.Context) (*PublishResult, error)) (*PublishResult, error) {
+	if q.filter != nil && !q.filter(m) {
+		return nil, ErrFiltered
+	}
+	res, err := q.tracePublish(ctx, destination, publish)
+	if err != nil {
+		q.failed.Add(1)
+		return nil, err
+	}
+	q.published.Add(1)
+	return res, nil
+}
+
+// publishRequest is a request to the publish endpoint
+type publishRequest struct {
+	*http.Request
+	// generatedID is true when the deduplication id was generated with the generatedScope
+	generatedID    bool
+	generatedScope string
+	correlationID  string
+	requestID      string
+	// deliverAt is when qstash delivers a delayed message
+	deliverAt time.Time
+}
+
+// newPublishRequest validates the message and creates the request that publishes it to the destination
+func (q *Publisher) newPublishRequest(ctx context.Context, destination string, m *Message, opts ...PublishOption) (*publishRequest, error) {
 	// Parse the publish options
 	var os PublishOptions
 	if opts != nil {
 		if err := os.apply(opts...); err != nil {
-			return fmt.Errorf("bad options: %w", err)
+			return nil, fmt.Errorf("bad options: %w", err)
 		}
 	}
 	// Create the request
+	body, err := newRequestBody(m)
+	if err != nil {
+		return nil, err
+	}
 	r, err := http.NewRequest(
 		"POST",
-		fmt.Sprintf("%s/%s", q.url, q.topic),
-		bytes.NewBuffer(m.Body),
+		fmt.Sprintf("%s/%s", q.url, destination),
+		body,
 	)
 	if err != nil {
-		return fmt.Errorf("could not create request %w", err)
+		return nil, fmt.Errorf("could not create request %w", err)
+	}
+	if m.BodyStream != nil {
+		setStreamLength(r, m)
 	}
 
 	// Validate and add the optional message headers
 	if m.Headers != nil {
-		for k := range m.Headers {
+		size := 0
+		for k, v := range m.Headers {
 			if !strings.HasPrefix(strings.ToLower(k), "upstash-forward-") {
-				return fmt.Errorf("headers must start with 'Upstash-Forward-'")
+				return nil, fmt.Errorf("headers must start with 'Upstash-Forward-'")
+			}
+			for _, vv := range v {
+				size += len(k) + len(vv)
+			}
+		}
+		if q.maxHeaderSize > 0 && size > q.maxHeaderSize {
+			return nil, fmt.Errorf("%w: %d bytes is over the limit of %d bytes", ErrHeadersTooLarge, size, q.maxHeaderSize)
+		}
+		r.Header = m.Headers.Clone()
+	}
+
+	// Add a request id to trace the message unless the caller has already set one
+	var requestID string
+	if len(q.requestIDHeader) > 0 {
+		if requestID = m.Headers.Get(q.requestIDHeader); len(requestID) == 0 {
+			if requestID, err = q.uuid.NewV4(); err != nil {
+				return nil, fmt.Errorf("could not generate request id %w", err)
 			}
+			r.Header.Set(q.requestIDHeader, requestID)
 		}
-		r.Header = m.Headers
+	}
+
+	// Compute the deduplication strategy unless the publish options set one
+	if q.deduplicationFunc != nil && len(os.DeduplicationID) == 0 && !os.ContentBasedDeduplication {
+		if os.DeduplicationID, os.ContentBasedDeduplication, err = q.deduplicationFunc(m); err != nil {
+			return nil, fmt.Errorf("could not compute deduplication %w", err)
+		}
+	}
+
+	// Scope the generated deduplication ids by the publisher's scope unless the publish options set one
+	generatedScope := os.DeduplicationScope
+	if len(generatedScope) == 0 {
+		generatedScope = q.getDeduplicationScope()
 	}
 
 	// Determine the deduplication id
-	if hasID := len(m.ID) > 0; hasID && os.ContentBasedDeduplication {
-		return fmt.Errorf("you cannot set 'content based deduplication' and pass a custom deduplication id")
+	contentType := os.ContentType
+	if len(contentType) == 0 {
+		contentType = "application/json"
+	}
+	var generatedID bool
+	if err := validateDeduplication(m, &os); err != nil {
+		return nil, err
+	} else if os.ContentBasedDeduplication && len(os.DeduplicationScope) > 0 && m.BodyStream != nil {
+		return nil, fmt.Errorf("%w: a scoped content based deduplication id can not be computed from a body stream", ErrConflictingDedup)
+	} else if os.ContentBasedDeduplication && len(os.DeduplicationScope) > 0 {
+		// Namespace the content based deduplication id by hashing the content on the client
+		r.Header.Set(q.deduplicationIDHeader(), scopeDeduplicationID(os.DeduplicationScope, contentDeduplicationID(destination, m)))
 	} else if os.ContentBasedDeduplication {
 		r.Header.Set("Upstash-Content-Based-Deduplication", "true")
-	} else if hasID {
-		r.Header.Set("Upstash-Deduplication-ID", m.ID)
+	} else if len(os.DeduplicationID) > 0 {
+		r.Header.Set(q.deduplicationIDHeader(), os.DeduplicationID)
+	} else if len(m.ID) > 0 {
+		r.Header.Set(q.deduplicationIDHeader(), m.ID)
+	} else if deduplicationID, ok := deduplicationIDFromContext(ctx); ok {
+		r.Header.Set(q.deduplicationIDHeader(), deduplicationID)
+	} else if q.noDeduplicationContentTypes[mediaType(contentType)] {
+		// Deduplication is disabled for this content type
 	} else if deduplicationID, err := q.uuid.NewV4(); err != nil {
-		return fmt.Errorf("could not generate uuid %w", err)
+		return nil, fmt.Errorf("could not generate uuid %w", err)
 	} else {
 		// By default, generate a uuid to allow for retries on publish
-		r.Header.Set("Upstash-Deduplication-ID", deduplicationID)
+		r.Header.Set(q.deduplicationIDHeader(), scopeDeduplicationID(generatedScope, deduplicationID))
+		generatedID = true
+	}
+
+	// Validate the deduplication id once its scope is added, as the scope and the context id are not validated on their own
+	if err := validateDeduplicationID(r.Header.Get(q.deduplicationIDHeader())); err != nil {
+		return nil, err
 	}
 
 	// Set the standard request headers
 	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", q.token))
-	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("User-Agent", UserAgent())
+	r.Header.Set("Content-Type", contentType)
 
-	// Configure scheduling and retry functionality
+	// Configure scheduling, retry and callback functionality
 	if os.Delay > 0 {
 		r.Header.Set("Upstash-Delay", os.Delay.String())
 	}
+	if !os.NotBefore.IsZero() {
+		r.Header.Set("Upstash-Not-Before", strconv.FormatInt(os.NotBefore.Unix(), 10))
+	}
 	if os.Retries > 0 {
 		r.Header.Set("Upstash-Retries", strconv.Itoa(os.Retries))
 	}
+	if len(os.Callback) > 0 {
+		r.Header.Set("Upstash-Callback", os.Callback)
+	}
+	if os.Timeout > 0 {
+		r.Header.Set("Upstash-Timeout", os.Timeout.String())
+	}
+	if len(os.CorrelationID) > 0 {
+		r.Header.Set("Upstash-Forward-Correlation-Id", os.CorrelationID)
+	}
+
+	return &publishRequest{
+		Request:        r,
+		generatedID:    generatedID,
+		generatedScope: generatedScope,
+		correlationID:  os.CorrelationID,
+		requestID:      requestID,
+		deliverAt:      os.deliverAt(),
+	}, nil
+}
+
+// newRequestBody returns the reader of the message body or its body stream
+func newRequestBody(m *Message) (io.Reader, error) {
+	if m.BodyStream == nil {
+		return bytes.NewBuffer(m.Body), nil
+	} else if len(m.Body) > 0 {
+		return nil, fmt.Errorf("a message can not have both a body and a body stream")
+	} else if m.BodyLength < 0 {
+		return nil, fmt.Errorf("body length must be at least 0")
+	}
+	return m.BodyStream, nil
+}
+
+// setStreamLength sets the content length of a request with a streamed body and,
+// if the stream can seek, rewinds it in the request's GetBody so that it can be resent
+func setStreamLength(r *http.Request, m *Message) {
+	if m.BodyLength > 0 {
+		r.ContentLength = m.BodyLength
+	}
+	if r.GetBody != nil {
+		return
+	}
+	seeker, ok := m.BodyStream.(io.Seeker)
+	if !ok {
+		return
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+	r.GetBody = func() (io.ReadCloser, error) {
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(m.BodyStream), nil
+	}
+}
+
+// publishMessage publishes a message to the destination
+func (q *Publisher) publishMessage(ctx context.Context, destination string, m *Message, opts ...PublishOption) (_ *PublishResult, err error) {
+	size := messageSize(m)
+	if m, err = q.offloadBody(ctx, m); err != nil {
+		return nil, err
+	}
+	pr, err := q.newPublishRequest(ctx, destination, m, opts...)
+	if err != nil {
+		return nil, err
+	}
+	r := pr.Request
+
+	// Number the message in its destination's stream. The number is used up
+	// unless the message was never sent or qstash rejected it
+	var sent bool
+	done := q.nextSequence(r, destination)
+	defer func() {
+		var publishErr *PublishError
+		done(sent && !(errors.As(err, &publishErr) && publishErr.StatusCode != 0))
+	}()
+
+	// Buffer the message until the batch is flushed
+	if q.batch != nil {
+		if m.BodyStream != nil {
+			return nil, fmt.Errorf("a message with a body stream can not be batched")
+		}
+		if err := q.addToBatch(ctx, destination, r.Header, m.Body); err != nil {
+			return nil, err
+		}
+		sent = true
+		return &PublishResult{CorrelationID: pr.correlationID, RequestID: pr.requestID}, nil
+	}
 
 	// Publish the message
-	rsp, err := q.client.Do(r.WithContext(ctx))
+	sent = true
+	res, err := q.send(ctx, r)
 	if err != nil {
-		return fmt.Errorf("could not complete request %w", err)
-	} else if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
-		bs, _ := io.ReadAll(rsp.Body)
-		rsp.Body.Close()
-		return fmt.Errorf("bad request status %d: %s", rsp.StatusCode, string(bs))
+		return nil, err
 	}
 
-	// Return the message id
-	var body struct {
-		MessageID string `json:"messageId"`
+	// A duplicate of a generated id is a collision that dropped a new message, so publish it again with a new id
+	if res.Deduplicated && pr.generatedID && q.retryOnIDCollision {
+		deduplicationID, err := q.uuid.NewV4()
+		if err != nil {
+			return nil, fmt.Errorf("could not generate uuid %w", err)
+		}
+		r.Header.Set(q.deduplicationIDHeader(), scopeDeduplicationID(pr.generatedScope, deduplicationID))
+		if r.GetBody == nil {
+			return nil, fmt.Errorf("could not reset request body: the body stream can not seek")
+		} else if r.Body, err = r.GetBody(); err != nil {
+			return nil, fmt.Errorf("could not reset request body %w", err)
+		}
+		attempts := res.Attempts
+		if res, err = q.send(ctx, r); err != nil {
+			return nil, err
+		}
+		res.Attempts += attempts
 	}
-	defer rsp.Body.Close()
-	if err := json.NewDecoder(rsp.Body).Decode(&body); err != nil {
-		return fmt.Errorf("could not decode response %w", err)
+
+	// Count the duplicates
+	if res.Deduplicated {
+		q.deduplicated.Add(1)
+		if q.metrics != nil {
+			q.metrics.IncDeduplicated()
+		}
 	}
-	m.ID = body.MessageID
 
 	// Success
-	return nil
+	result := PublishResult{
+		MessageID:       res.MessageID,
+		Attempts:        res.Attempts,
+		Deduplicated:    res.Deduplicated,
+		DeduplicationID: res.DeduplicationID,
+		CorrelationID:   pr.correlationID,
+		RequestID:       pr.requestID,
+	}
+	for _, e := range res.Endpoints {
+		result.Endpoints = append(result.Endpoints, PublishResult{
+			MessageID:       e.MessageID,
+			Attempts:        res.Attempts,
+			URL:             e.URL,
+			Deduplicated:    e.Deduplicated,
+			DeduplicationID: e.DeduplicationID,
+			CorrelationID:   pr.correlationID,
+			RequestID:       pr.requestID,
+		})
+	}
+	if !pr.deliverAt.IsZero() {
+		q.trackPending(&result, pr.deliverAt)
+	}
+	deduplicationID := r.Header.Get(q.deduplicationIDHeader())
+	if len(deduplicationID) == 0 {
+		deduplicationID = res.DeduplicationID
+	}
+	q.audit(destination, result.MessageID, deduplicationID, size)
+	return &result, nil
+}
+
+// publishResponse is the response of the publish endpoint
+type publishResponse struct {
+	MessageID       string `json:"messageId"`
+	URL             string `json:"url"`
+	Deduplicated    bool   `json:"deduplicated"`
+	DeduplicationID string `json:"deduplicationId"`
+	// SnakeMessageID and ID are the message id as renamed by some proxies and compatible apis
+	SnakeMessageID string `json:"message_id"`
+	ID             string `json:"id"`
+	// Endpoints are the responses for each endpoint of a url group
+	Endpoints []publishResponse `json:"-"`
+	// Attempts is the number of requests it took to publish the message
+	Attempts int `json:"-"`
+}
+
+// messageID returns the message id of the response under any of its field names
+func (res *publishResponse) messageID() string {
+	if len(res.MessageID) > 0 {
+		return res.MessageID
+	} else if len(res.SnakeMessageID) > 0 {
+		return res.SnakeMessageID
+	}
+	return res.ID
+}
+
+// decodePublishResponse decodes the response of the publish endpoint.
+// The message id is read from 'messageId', 'message_id' or 'id'.
+// Publishing to a url group responds with an array of responses, one for each endpoint.
+// A url group publish is deduplicated when the message was deduplicated for every endpoint.
+// An empty body, which some proxies respond with, is a success without a message id
+func (q *Publisher) decodePublishResponse(bs []byte) (*publishResponse, error) {
+	var res publishResponse
+	trimmed := bytes.TrimSpace(bs)
+	if len(trimmed) == 0 {
+		return &res, nil
+	} else if trimmed[0] != '[' {
+		if err := q.json.Unmarshal(bs, &res); err != nil {
+			return nil, err
+		}
+		res.MessageID = res.messageID()
+		return &res, nil
+	}
+	if err := q.json.Unmarshal(bs, &res.Endpoints); err != nil {
+		return nil, err
+	}
+	for i := range res.Endpoints {
+		e := &res.Endpoints[i]
+		e.MessageID = e.messageID()
+		if i == 0 {
+			res.MessageID = e.MessageID
+			res.Deduplicated = e.Deduplicated
+			res.DeduplicationID = e.DeduplicationID
+		}
+		res.Deduplicated = res.Deduplicated && e.Deduplicated
+	}
+	return &res, nil
+}
+
+// send sends the publish request to qstash and decodes the response
+func (q *Publisher) send(ctx context.Context, r *http.Request) (*publishResponse, error) {
+	rsp, attempts, err := q.do(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	bs, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read response %w", err)
+	}
+	if q.verbose {
+		q.logf("qstash: %s %s responded %d: %s", r.Method, r.URL, rsp.StatusCode, truncateLogBody(bs, q.maxLogBodySize))
+	}
+	if rsp.StatusCode == http.StatusGone {
+		return nil, &PublishError{StatusCode: rsp.StatusCode, Body: string(bs), Err: ErrGone}
+	} else if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return nil, &PublishError{StatusCode: rsp.StatusCode, Body: string(bs)}
+	}
+
+	// Decode the response
+	res, err := q.decodePublishResponse(bs)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode response %w", err)
+	}
+	res.Attempts = attempts
+	return res, nil
+}
+
+// do sends the request with the publisher's client and counts its attempts
+func (q *Publisher) do(ctx context.Context, r *http.Request) (*http.Response, int, error) {
+	// Note: clients that do not report their attempts make a single attempt
+	attempts := 1
+	rsp, err := q.client.Do(r.WithContext(withAttempts(ctx, &attempts)))
+	q.attempts.Add(int64(attempts))
+	if attempts > 1 {
+		q.retried.Add(1)
+	}
+	// A cancelled publish is not a failure of qstash, so the context error is returned as is
+	if err != nil && ctx.Err() != nil {
+		return nil, attempts, ctx.Err()
+	} else if err != nil {
+		return nil, attempts, &PublishError{Err: fmt.Errorf("could not complete request %w", err)}
+	}
+	setSpanAttribute(ctx, statusAttribute, rsp.StatusCode)
+	return rsp, attempts, nil
+}
+
+// truncateLogBody caps the body at maxSize bytes for logging and notes how many bytes were left out
+func truncateLogBody(body []byte, maxSize int) string {
+	if len(body) <= maxSize {
+		return string(body)
+	}
+	return fmt.Sprintf("%s... (truncated %d bytes)", body[:maxSize], len(body)-maxSize)
+}
+
+// Warmup opens a connection to qstash with a cheap HEAD request, so that the first publish does not pay
+// for the tls handshake, e.g. during the cold start of a serverless function.
+// Any response means the connection is ready, so only network errors are returned
+func (q *Publisher) Warmup(ctx context.Context) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodHead, q.url, nil)
+	if err != nil {
+		return fmt.Errorf("could not create request %w", err)
+	}
+	r.Header.Set("User-Agent", UserAgent())
+
+	// Skip the retries, the status code does not matter
+	client := q.client
+	if c, ok := client.(*httpClient); ok {
+		client = c.client
+	}
+	rsp, err := client.Do(r)
+	if err != nil {
+		return fmt.Errorf("could not complete request %w", err)
+	}
+	_, _ = io.Copy(io.Discard, rsp.Body)
+	return rsp.Body.Close()
 }
 
-// PublishWithDelay publishes a message to the QStash with a delay
+// Stats returns a snapshot of the publisher's cumulative counters.
+// The counters are updated atomically, so it is safe to call while messages are being published
+func (q *Publisher) Stats() PublisherStats {
+	return PublisherStats{
+		Published:    q.published.Load(),
+		Failed:       q.failed.Load(),
+		Retried:      q.retried.Load(),
+		Deduplicated: q.deduplicated.Load(),
+		Attempts:     q.attempts.Load(),
+	}
+}
+
+// DeduplicatedCount returns the number of published messages that qstash reported as duplicates.
+// A growing count can be a sign of a buggy retry loop
+func (q *Publisher) DeduplicatedCount() int64 {
+	return q.deduplicated.Load()
+}
+
+// PublishJSON marshals v to json and publishes it to the QStash
+// Marshal errors wrap ErrMarshal
+func (q *Publisher) PublishJSON(ctx context.Context, v any, opts ...PublishOption) (*PublishResult, error) {
+	body, err := q.json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMarshal, err)
+	}
+	return q.PublishWithResult(ctx, &Message{Body: body}, append([]PublishOption{WithContentType("application/json")}, opts...)...)
+}
+
+// PublishTarget is a destination of PublishToMany with its own publish options
+type PublishTarget struct {
+	URL     string
+	Options []PublishOption
+}
+
+// PublishToMany publishes the message to each of the targets with the target's publish options.
+// The results are in the same order as the targets and the result of a target that failed is nil.
+// The errors of the failed targets are joined together.
+// Note: a message id would be used as the deduplication id of every target, so it must be empty
+func (q *Publisher) PublishToMany(ctx context.Context, m *Message, targets []PublishTarget) ([]*PublishResult, error) {
+	if len(m.ID) > 0 {
+		return nil, fmt.Errorf("%w: you cannot publish a message with an id to many targets", ErrConflictingDedup)
+	}
+	results := make([]*PublishResult, len(targets))
+	var errs []error
+	for i, target := range targets {
+		if len(target.URL) == 0 {
+			errs = append(errs, fmt.Errorf("target %d: url is required", i))
+			continue
+		}
+		// Publish a copy of the message to the target
+		tm := *m
+		tm.Headers = m.Headers.Clone()
+		res, err := q.publish(ctx, target.URL, &tm, target.Options...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("target %s: %w", target.URL, err))
+			continue
+		}
+		results[i] = res
+	}
+	return results, errors.Join(errs...)
+}
+
+// PublishWithDelay publishes a message to the QStash with a delay.
+// Use PublishWithResult with WithDelay to get the result of the publish
 func (q *Publisher) PublishWithDelay(ctx context.Context, message *Message, delay time.Duration, opts ...PublishOption) error {
 	return q.Publish(ctx, message, append(opts, WithDelay(delay))...)
 }
+
+// validateDeduplication makes sure that at most one deduplication strategy is set for the message
+func validateDeduplication(m *Message, os *PublishOptions) error {
+	hasID, hasOptionID := len(m.ID) > 0, len(os.DeduplicationID) > 0
+	if hasID && os.ContentBasedDeduplication {
+		return fmt.Errorf("%w: you cannot set 'content based deduplication' and pass a custom deduplication id", ErrConflictingDedup)
+	} else if hasOptionID && os.ContentBasedDeduplication {
+		return fmt.Errorf("%w: you cannot set 'content based deduplication' and a deduplication id option", ErrConflictingDedup)
+	} else if hasID && hasOptionID {
+		return fmt.Errorf("%w: you cannot pass a custom deduplication id and a deduplication id option", ErrConflictingDedup)
+	}
+	if err := validateDeduplicationID(m.ID); err != nil {
+		return err
+	}
+	return validateDeduplicationID(os.DeduplicationID)
+}
+
+// maxDeduplicationIDLength is the max length of a custom deduplication id
+const maxDeduplicationIDLength = 256
+
+// validateDeduplicationID makes sure that a custom deduplication id is at most 256 characters long
+// and only contains letters, digits, '-', '_', '.' and ':', so that qstash does not reject it
+func validateDeduplicationID(id string) error {
+	if len(id) > maxDeduplicationIDLength {
+		return fmt.Errorf("%w: %d characters is over the limit of %d characters", ErrInvalidDeduplicationID, len(id), maxDeduplicationIDLength)
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return fmt.Errorf("%w: illegal character %q in '%s'", ErrInvalidDeduplicationID, c, id)
+		}
+	}
+	return nil
+}
+
+// deduplicationIDKey is the context key of the deduplication id set by ContextWithDeduplicationID
+type deduplicationIDKey struct{}
+
+// ContextWithDeduplicationID returns a copy of ctx that carries a deduplication id.
+// Publish uses it when neither the message nor the publish options set a deduplication id
+func ContextWithDeduplicationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, deduplicationIDKey{}, id)
+}
+
+// deduplicationIDFromContext returns the deduplication id set by ContextWithDeduplicationID
+func deduplicationIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(deduplicationIDKey{}).(string)
+	return id, ok && len(id) > 0
+}
+
+// mediaType returns the lowercased media type of the content type without its parameters
+func mediaType(contentType string) string {
+	if t, _, err := mime.ParseMediaType(contentType); err == nil {
+		return t
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// SetDeduplicationScope sets the scope of the deduplication ids generated for publishes without
+// a deduplication scope (see WithDeduplicationScope). It is safe to call while messages are being published,
+// e.g. to rotate the scope to the new version at the cutover of a blue-green deploy. An empty scope removes it
+func (q *Publisher) SetDeduplicationScope(scope string) {
+	q.deduplicationScope.Store(&scope)
+}
+
+// getDeduplicationScope returns the scope set with SetDeduplicationScope
+func (q *Publisher) getDeduplicationScope() string {
+	if scope := q.deduplicationScope.Load(); scope != nil {
+		return *scope
+	}
+	return ""
+}
+
+// contentDeduplicationID hashes the destination, the forwarded headers and the body of the message
+// like qstash does, so that the same body published to different destinations does not collide
+func contentDeduplicationID(destination string, m *Message) string {
+	headers := make([]string, 0, len(m.Headers))
+	for k, v := range m.Headers {
+		headers = append(headers, http.CanonicalHeaderKey(k)+":"+strings.Join(v, ","))
+	}
+	sort.Strings(headers)
+	h := sha256.New()
+	io.WriteString(h, destination)
+	for _, header := range headers {
+		io.WriteString(h, "\n"+header)
+	}
+	io.WriteString(h, "\n\n")
+	h.Write(m.Body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// scopeDeduplicationID prefixes the deduplication id with the deduplication scope
+func scopeDeduplicationID(scope, id string) string {
+	if len(scope) == 0 {
+		return id
+	}
+	return scope + ":" + id
+}
+
+// deduplicationIDHeader returns the deduplication id header set with WithDeduplicationHeader, or the default header
+func (q *Publisher) deduplicationIDHeader() string {
+	if q.deduplicationHeader != "" {
+		return q.deduplicationHeader
+	}
+	return defaultDeduplicationHeader
+}
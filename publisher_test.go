@@ -3,8 +3,16 @@ package qstash
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -69,6 +77,7 @@ func TestPublisher_Publish(t *testing.T) {
 		wantErr: false,
 		wantHeader: http.Header{
 			"Authorization":            []string{"Bearer token"},
+			"User-Agent":               []string{UserAgent()},
 			"Content-Type":             []string{"application/json"},
 			"Upstash-Deduplication-ID": []string{"uuid"},
 		},
@@ -96,12 +105,180 @@ func TestPublisher_Publish(t *testing.T) {
 		wantErr: false,
 		wantHeader: http.Header{
 			"Authorization":            []string{"Bearer token"},
+			"User-Agent":               []string{UserAgent()},
 			"Content-Type":             []string{"application/json"},
 			"Upstash-Deduplication-ID": []string{"uuid"},
 			"Upstash-Delay":            []string{"1s"},
 		},
 		wantURL:  "url/topic",
 		wantBody: []byte("message"),
+	}, {
+		name: "Publish with delay, callback, retries and content type",
+		fields: fields{
+			token:  "token",
+			url:    "url",
+			topic:  "topic",
+			client: &mockClient{},
+			uuid: &mockUUID{
+				uuid: "uuid",
+			},
+		},
+		args: args{
+			message: Message{
+				Body: []byte("message"),
+			},
+			opts: []PublishOption{
+				WithDelay(time.Second),
+				WithCallback("https://example.com/callback"),
+				WithRetries(2),
+				WithContentType("text/plain"),
+			},
+		},
+		wantErr: false,
+		wantHeader: http.Header{
+			"Authorization":            []string{"Bearer token"},
+			"User-Agent":               []string{UserAgent()},
+			"Content-Type":             []string{"text/plain"},
+			"Upstash-Deduplication-ID": []string{"uuid"},
+			"Upstash-Delay":            []string{"1s"},
+			"Upstash-Callback":         []string{"https://example.com/callback"},
+			"Upstash-Retries":          []string{"2"},
+		},
+		wantURL:  "url/topic",
+		wantBody: []byte("message"),
+	}, {
+		name: "Publish with content type, retries, callback and delay",
+		fields: fields{
+			token:  "token",
+			url:    "url",
+			topic:  "topic",
+			client: &mockClient{},
+			uuid: &mockUUID{
+				uuid: "uuid",
+			},
+		},
+		args: args{
+			message: Message{
+				Body: []byte("message"),
+			},
+			opts: []PublishOption{
+				WithContentType("text/plain"),
+				WithRetries(2),
+				WithCallback("https://example.com/callback"),
+				WithDelay(time.Second),
+			},
+		},
+		wantErr: false,
+		wantHeader: http.Header{
+			"Authorization":            []string{"Bearer token"},
+			"User-Agent":               []string{UserAgent()},
+			"Content-Type":             []string{"text/plain"},
+			"Upstash-Deduplication-ID": []string{"uuid"},
+			"Upstash-Delay":            []string{"1s"},
+			"Upstash-Callback":         []string{"https://example.com/callback"},
+			"Upstash-Retries":          []string{"2"},
+		},
+		wantURL:  "url/topic",
+		wantBody: []byte("message"),
+	}, {
+		name: "Publish with a timeout",
+		fields: fields{
+			token:  "token",
+			url:    "url",
+			topic:  "topic",
+			client: &mockClient{},
+			uuid: &mockUUID{
+				uuid: "uuid",
+			},
+		},
+		args: args{
+			message: Message{
+				Body: []byte("message"),
+			},
+			opts: []PublishOption{
+				WithTimeout(5 * time.Minute),
+			},
+		},
+		wantErr: false,
+		wantHeader: http.Header{
+			"Authorization":            []string{"Bearer token"},
+			"User-Agent":               []string{UserAgent()},
+			"Content-Type":             []string{"application/json"},
+			"Upstash-Deduplication-ID": []string{"uuid"},
+			"Upstash-Timeout":          []string{"5m0s"},
+		},
+		wantURL:  "url/topic",
+		wantBody: []byte("message"),
+	}, {
+		name: "Publish with a not before time",
+		fields: fields{
+			token:  "token",
+			url:    "url",
+			topic:  "topic",
+			client: &mockClient{},
+			uuid: &mockUUID{
+				uuid: "uuid",
+			},
+		},
+		args: args{
+			message: Message{
+				Body: []byte("message"),
+			},
+			opts: []PublishOption{
+				WithNotBefore(time.Unix(1700000000, 0)),
+			},
+		},
+		wantErr: false,
+		wantHeader: http.Header{
+			"Authorization":            []string{"Bearer token"},
+			"User-Agent":               []string{UserAgent()},
+			"Content-Type":             []string{"application/json"},
+			"Upstash-Deduplication-ID": []string{"uuid"},
+			"Upstash-Not-Before":       []string{"1700000000"},
+		},
+		wantURL:  "url/topic",
+		wantBody: []byte("message"),
+	}, {
+		name: "Publish with a negative timeout fails",
+		fields: fields{
+			token:  "token",
+			url:    "url",
+			topic:  "topic",
+			client: &mockClient{},
+			uuid: &mockUUID{
+				uuid: "uuid",
+			},
+		},
+		args: args{
+			message: Message{
+				Body: []byte("message"),
+			},
+			opts: []PublishOption{
+				WithTimeout(-time.Second),
+			},
+		},
+		wantErr: true,
+	}, {
+		name: "Publish with a relative callback fails",
+		fields: fields{
+			token:  "token",
+			url:    "url",
+			topic:  "topic",
+			client: &mockClient{},
+			uuid: &mockUUID{
+				uuid: "uuid",
+			},
+		},
+		args: args{
+			message: Message{
+				Body: []byte("message"),
+			},
+			opts: []PublishOption{
+				WithDelay(time.Second),
+				WithCallback("/callback"),
+			},
+		},
+		wantErr: true,
 	}, {
 		name: "Publish with custom headers",
 		fields: fields{
@@ -124,6 +301,7 @@ func TestPublisher_Publish(t *testing.T) {
 		wantErr: false,
 		wantHeader: http.Header{
 			"Authorization":            []string{"Bearer token"},
+			"User-Agent":               []string{UserAgent()},
 			"Content-Type":             []string{"application/json"},
 			"Upstash-Deduplication-ID": []string{"uuid"},
 			"Upstash-Forward-Key":      []string{"value"},
@@ -170,6 +348,7 @@ func TestPublisher_Publish(t *testing.T) {
 		wantErr: false,
 		wantHeader: http.Header{
 			"Authorization":            []string{"Bearer token"},
+			"User-Agent":               []string{UserAgent()},
 			"Content-Type":             []string{"application/json"},
 			"Upstash-Deduplication-ID": []string{"custom-deduplication-id"},
 		},
@@ -197,11 +376,126 @@ func TestPublisher_Publish(t *testing.T) {
 		wantErr: false,
 		wantHeader: http.Header{
 			"Authorization":                       []string{"Bearer token"},
+			"User-Agent":                          []string{UserAgent()},
 			"Content-Type":                        []string{"application/json"},
 			"Upstash-Content-Based-Deduplication": []string{"true"},
 		},
 		wantURL:  "url/topic",
 		wantBody: []byte("message"),
+	}, {
+		name: "Publish with a deduplication id option",
+		fields: fields{
+			token:  "token",
+			url:    "url",
+			topic:  "topic",
+			client: &mockClient{},
+			uuid: &mockUUID{
+				uuid: "uuid",
+			},
+		},
+		args: args{
+			message: Message{
+				Body: []byte("message"),
+			},
+			opts: []PublishOption{
+				WithDeduplicationID("option-deduplication-id"),
+			},
+		},
+		wantErr: false,
+		wantHeader: http.Header{
+			"Authorization":            []string{"Bearer token"},
+			"User-Agent":               []string{UserAgent()},
+			"Content-Type":             []string{"application/json"},
+			"Upstash-Deduplication-ID": []string{"option-deduplication-id"},
+		},
+		wantURL:  "url/topic",
+		wantBody: []byte("message"),
+	}, {
+		name: "Publish with a deduplication scope",
+		fields: fields{
+			token:  "token",
+			url:    "url",
+			topic:  "topic",
+			client: &mockClient{},
+			uuid: &mockUUID{
+				uuid: "uuid",
+			},
+		},
+		args: args{
+			message: Message{
+				Body: []byte("message"),
+			},
+			opts: []PublishOption{
+				WithDeduplicationScope("tenant"),
+			},
+		},
+		wantErr: false,
+		wantHeader: http.Header{
+			"Authorization":            []string{"Bearer token"},
+			"User-Agent":               []string{UserAgent()},
+			"Content-Type":             []string{"application/json"},
+			"Upstash-Deduplication-ID": []string{"tenant:uuid"},
+		},
+		wantURL:  "url/topic",
+		wantBody: []byte("message"),
+	}, {
+		name: "Publish with a deduplication scope and content based deduplication",
+		fields: fields{
+			token:  "token",
+			url:    "url",
+			topic:  "topic",
+			client: &mockClient{},
+			uuid: &mockUUID{
+				uuid: "uuid",
+			},
+		},
+		args: args{
+			message: Message{
+				Body: []byte("message"),
+			},
+			opts: []PublishOption{
+				WithDeduplicationScope("tenant"),
+				WithContentBasedDeduplication(),
+			},
+		},
+		wantErr: false,
+		wantHeader: http.Header{
+			"Authorization":            []string{"Bearer token"},
+			"User-Agent":               []string{UserAgent()},
+			"Content-Type":             []string{"application/json"},
+			"Upstash-Deduplication-ID": []string{"tenant:7cb875cd82b614e9849c34d68e52ebd8aa116572fbdce107f05ae785d820f81c"},
+		},
+		wantURL:  "url/topic",
+		wantBody: []byte("message"),
+	}, {
+		name: "Publish with a deduplication scope and a deduplication id option",
+		fields: fields{
+			token:  "token",
+			url:    "url",
+			topic:  "topic",
+			client: &mockClient{},
+			uuid: &mockUUID{
+				uuid: "uuid",
+			},
+		},
+		args: args{
+			message: Message{
+				Body: []byte("message"),
+			},
+			opts: []PublishOption{
+				WithDeduplicationScope("tenant"),
+				WithDeduplicationID("option-deduplication-id"),
+			},
+		},
+		wantErr: false,
+		wantHeader: http.Header{
+			"Authorization":            []string{"Bearer token"},
+			"User-Agent":               []string{UserAgent()},
+			"Content-Type":             []string{"application/json"},
+			"Upstash-Deduplication-ID": []string{"option-deduplication-id"},
+		},
+		wantURL:  "url/topic",
+		wantBody: []byte("message"),
 	}, {
 		name: "Publish with custom id and content based deduplication fails",
 		fields: fields{
@@ -238,6 +532,8 @@ func TestPublisher_Publish(t *testing.T) {
 					t.Fatalf("Publisher.Publish() error = %v, wantErr %v", err, tt.wantErr)
 				}
 				return
+			} else if tt.wantErr {
+				t.Fatalf("Publisher.Publish() error = %v, wantErr %v", err, tt.wantErr)
 			}
 			// Verify the url
 			if tt.wantURL != tt.fields.client.r.URL.String() {
@@ -264,3 +560,1615 @@ func TestPublisher_Publish(t *testing.T) {
 		})
 	}
 }
+
+func TestPublisher_deduplicationIDHeader(t *testing.T) {
+	tests := []struct {
+		name                string
+		deduplicationHeader string
+		want                string
+	}{{
+		name: "Default header",
+		want: "Upstash-Deduplication-Id",
+	}, {
+		name:                "Overridden header",
+		deduplicationHeader: "Custom-Deduplication-Id",
+		want:                "Custom-Deduplication-Id",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockClient{}
+			q := &Publisher{
+				token:               "token",
+				url:                 "https://qstash.upstash.io/v2/publish",
+				topic:               "topic",
+				client:              client,
+				uuid:                &mockUUID{uuid: "uuid"},
+				deduplicationHeader: tt.deduplicationHeader,
+			}
+			if got := q.deduplicationIDHeader(); got != tt.want {
+				t.Fatalf("Publisher.deduplicationIDHeader() = %v, want %v", got, tt.want)
+			}
+			if err := q.Publish(context.TODO(), &Message{Body: []byte("message")}); err != nil {
+				t.Fatalf("Publisher.Publish() error = %v", err)
+			} else if got := client.r.Header.Get(tt.want); got != "uuid" {
+				t.Fatalf("Publisher.Publish() header %v = %v, want %v", tt.want, got, "uuid")
+			}
+		})
+	}
+}
+
+func TestValidateDeduplication(t *testing.T) {
+	tests := []struct {
+		name    string
+		message Message
+		opts    []PublishOption
+		wantErr error
+	}{{
+		name: "No deduplication",
+	}, {
+		name:    "Custom id",
+		message: Message{ID: "id"},
+	}, {
+		name: "Deduplication id option",
+		opts: []PublishOption{WithDeduplicationID("id")},
+	}, {
+		name: "Content based deduplication",
+		opts: []PublishOption{WithContentBasedDeduplication()},
+	}, {
+		name:    "Custom id and content based deduplication conflict",
+		message: Message{ID: "id"},
+		opts:    []PublishOption{WithContentBasedDeduplication()},
+		wantErr: ErrConflictingDedup,
+	}, {
+		name:    "Deduplication id option and content based deduplication conflict",
+		opts:    []PublishOption{WithDeduplicationID("id"), WithContentBasedDeduplication()},
+		wantErr: ErrConflictingDedup,
+	}, {
+		name:    "Custom id and deduplication id option conflict",
+		message: Message{ID: "id"},
+		opts:    []PublishOption{WithDeduplicationID("other-id")},
+		wantErr: ErrConflictingDedup,
+	}, {
+		name:    "Custom id with every legal character",
+		message: Message{ID: "scope:Order_42-v1.0"},
+	}, {
+		name:    "Custom id with the max length",
+		message: Message{ID: strings.Repeat("a", 256)},
+	}, {
+		name:    "Over-long custom id fails",
+		message: Message{ID: strings.Repeat("a", 257)},
+		wantErr: ErrInvalidDeduplicationID,
+	}, {
+		name:    "Custom id with illegal characters fails",
+		message: Message{ID: "order 42/v1"},
+		wantErr: ErrInvalidDeduplicationID,
+	}, {
+		name:    "Over-long deduplication id option fails",
+		opts:    []PublishOption{WithDeduplicationID(strings.Repeat("a", 257))},
+		wantErr: ErrInvalidDeduplicationID,
+	}, {
+		name:    "Deduplication id option with illegal characters fails",
+		opts:    []PublishOption{WithDeduplicationID("order\n42")},
+		wantErr: ErrInvalidDeduplicationID,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var os PublishOptions
+			if err := os.apply(tt.opts...); err != nil {
+				t.Fatalf("PublishOptions.apply() error = %v", err)
+			}
+			if err := validateDeduplication(&tt.message, &os); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("validateDeduplication() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishInvalidDeduplicationID(t *testing.T) {
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		scope   string
+		wantErr error
+	}{{
+		name:  "Valid scope",
+		ctx:   context.TODO(),
+		scope: "v1",
+	}, {
+		name:    "Context id with illegal characters fails",
+		ctx:     ContextWithDeduplicationID(context.TODO(), "order 42"),
+		wantErr: ErrInvalidDeduplicationID,
+	}, {
+		name:    "Scope with illegal characters fails",
+		ctx:     context.TODO(),
+		scope:   "blue green",
+		wantErr: ErrInvalidDeduplicationID,
+	}, {
+		name:    "Scope that makes the id over-long fails",
+		ctx:     context.TODO(),
+		scope:   strings.Repeat("a", 256),
+		wantErr: ErrInvalidDeduplicationID,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockClient{}
+			q := &Publisher{
+				token:  "token",
+				url:    "url",
+				topic:  "topic",
+				client: client,
+				uuid:   &mockUUID{uuid: "uuid"},
+			}
+			q.SetDeduplicationScope(tt.scope)
+			if _, err := q.PublishWithResult(tt.ctx, &Message{Body: []byte("message")}); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Publisher.PublishWithResult() error = %v, wantErr %v", err, tt.wantErr)
+			} else if tt.wantErr != nil && client.r != nil {
+				t.Fatalf("Publisher.PublishWithResult() sent the request with deduplication id %v", client.r.Header.Get("Upstash-Deduplication-Id"))
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishRequestID(t *testing.T) {
+	tests := []struct {
+		name            string
+		requestIDHeader string
+		headers         http.Header
+		wantRequestID   string
+	}{{
+		name:            "Publish generates a request id",
+		requestIDHeader: "Upstash-Forward-X-Request-Id",
+		wantRequestID:   "uuid",
+	}, {
+		name:            "Publish preserves the callers request id",
+		requestIDHeader: "Upstash-Forward-X-Request-Id",
+		headers: http.Header{
+			"Upstash-Forward-X-Request-Id": []string{"request-id"},
+		},
+		wantRequestID: "request-id",
+	}, {
+		name:            "Publish generates a request id with a custom header",
+		requestIDHeader: "Upstash-Forward-Trace-Id",
+		wantRequestID:   "uuid",
+	}, {
+		name: "Publish without a request id header",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockClient{}
+			q := &Publisher{
+				token:           "token",
+				url:             "url",
+				topic:           "topic",
+				client:          client,
+				uuid:            &mockUUID{uuid: "uuid"},
+				requestIDHeader: tt.requestIDHeader,
+			}
+			m := Message{
+				Headers: tt.headers,
+				Body:    []byte("message"),
+			}
+			res, err := q.PublishWithResult(context.TODO(), &m)
+			if err != nil {
+				t.Fatalf("Publisher.PublishWithResult() error = %v", err)
+			}
+			if !reflect.DeepEqual(m.Headers, tt.headers) {
+				t.Fatalf("Publisher.PublishWithResult() message headers = %v, want %v", m.Headers, tt.headers)
+			} else if res.RequestID != tt.wantRequestID {
+				t.Fatalf("Publisher.PublishWithResult() RequestID = %v, want %v", res.RequestID, tt.wantRequestID)
+			} else if tt.requestIDHeader == "" {
+				return
+			} else if got := client.r.Header.Get(tt.requestIDHeader); got != tt.wantRequestID {
+				t.Fatalf("Publisher.PublishWithResult() header %v = %v, want %v", tt.requestIDHeader, got, tt.wantRequestID)
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishJSONCodec(t *testing.T) {
+	var unmarshaled int
+	q, err := NewPublisher("topic",
+		WithQStashToken("token"),
+		WithJSONCodec(json.Marshal, func(data []byte, v any) error {
+			unmarshaled++
+			return json.Unmarshal(data, v)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("NewPublisher() error = %v", err)
+	}
+	q.client = &mockClient{}
+	m := Message{Body: []byte("message")}
+	if err := q.Publish(context.TODO(), &m); err != nil {
+		t.Fatalf("Publisher.Publish() error = %v", err)
+	} else if unmarshaled != 1 {
+		t.Fatalf("Publisher.Publish() unmarshaled %d times, want 1", unmarshaled)
+	} else if m.ID != "mock-id" {
+		t.Fatalf("Publisher.Publish() message id = %v, want %v", m.ID, "mock-id")
+	}
+}
+
+func TestPublisher_PublishWithResultAttempts(t *testing.T) {
+	tests := []struct {
+		name         string
+		statusCodes  []int
+		wantAttempts int
+		wantErr      bool
+		wantGone     bool
+	}{{
+		name:         "Publish on the first attempt",
+		statusCodes:  []int{http.StatusOK},
+		wantAttempts: 1,
+	}, {
+		name:         "Publish after failing twice",
+		statusCodes:  []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK},
+		wantAttempts: 3,
+	}, {
+		name:        "Publish fails after all retries",
+		statusCodes: []int{http.StatusInternalServerError},
+		wantErr:     true,
+	}, {
+		name:         "Publish fails fast on 410",
+		statusCodes:  []int{http.StatusGone, http.StatusOK},
+		wantAttempts: 1,
+		wantErr:      true,
+		wantGone:     true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &mockTransport{statusCodes: tt.statusCodes}
+			q := &Publisher{
+				token: "token",
+				url:   "url",
+				topic: "topic",
+				client: &httpClient{
+					client:     &http.Client{Transport: transport},
+					MinBackOff: time.Millisecond,
+					MaxBackOff: time.Millisecond,
+					Retries:    3,
+				},
+				uuid: &mockUUID{uuid: "uuid"},
+			}
+			res, err := q.PublishWithResult(context.TODO(), &Message{Body: []byte("message")})
+			if err != nil {
+				if !tt.wantErr {
+					t.Fatalf("Publisher.PublishWithResult() error = %v, wantErr %v", err, tt.wantErr)
+				} else if tt.wantGone && !errors.Is(err, ErrGone) {
+					t.Fatalf("Publisher.PublishWithResult() error = %v, want %v", err, ErrGone)
+				} else if requests := transport.requests; tt.wantAttempts > 0 && requests != tt.wantAttempts {
+					t.Fatalf("Publisher.PublishWithResult() attempts = %v, want %v", requests, tt.wantAttempts)
+				}
+				return
+			} else if tt.wantErr {
+				t.Fatalf("Publisher.PublishWithResult() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if res.Attempts != tt.wantAttempts {
+				t.Fatalf("Publisher.PublishWithResult() attempts = %v, want %v", res.Attempts, tt.wantAttempts)
+			} else if res.MessageID != "mock-id" {
+				t.Fatalf("Publisher.PublishWithResult() message id = %v, want %v", res.MessageID, "mock-id")
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishJSON(t *testing.T) {
+	tests := []struct {
+		name       string
+		v          any
+		wantErr    error
+		wantBody   string
+		wantResult PublishResult
+	}{{
+		name: "Publish a struct",
+		v: struct {
+			Name string `json:"name"`
+		}{Name: "name"},
+		wantBody:   `{"name":"name"}`,
+		wantResult: PublishResult{MessageID: "mock-id", Attempts: 1},
+	}, {
+		name:    "Publish a value that can not be marshaled fails",
+		v:       make(chan int),
+		wantErr: ErrMarshal,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockClient{}
+			q := &Publisher{
+				token:  "token",
+				url:    "url",
+				topic:  "topic",
+				client: client,
+				uuid:   &mockUUID{uuid: "uuid"},
+			}
+			res, err := q.PublishJSON(context.TODO(), tt.v)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Publisher.PublishJSON() error = %v, wantErr %v", err, tt.wantErr)
+			} else if err != nil {
+				var unsupported *json.UnsupportedTypeError
+				if !errors.As(err, &unsupported) {
+					t.Fatalf("Publisher.PublishJSON() error = %v, want a json.UnsupportedTypeError", err)
+				} else if client.r != nil {
+					t.Fatalf("Publisher.PublishJSON() sent a request")
+				}
+				return
+			}
+			if !reflect.DeepEqual(*res, tt.wantResult) {
+				t.Fatalf("Publisher.PublishJSON() = %v, want %v", *res, tt.wantResult)
+			} else if got := client.r.Header.Get("Content-Type"); got != "application/json" {
+				t.Fatalf("Publisher.PublishJSON() header Content-Type = %v, want %v", got, "application/json")
+			} else if bs, _ := io.ReadAll(client.r.Body); string(bs) != tt.wantBody {
+				t.Fatalf("Publisher.PublishJSON() body = %s, want %s", bs, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishContextDeduplicationID(t *testing.T) {
+	tests := []struct {
+		name                string
+		ctx                 context.Context
+		id                  string
+		opts                []PublishOption
+		wantDeduplicationID string
+	}{{
+		name:                "Publish uses the context deduplication id",
+		ctx:                 ContextWithDeduplicationID(context.TODO(), "context-id"),
+		wantDeduplicationID: "context-id",
+	}, {
+		name:                "Publish prefers the deduplication id option",
+		ctx:                 ContextWithDeduplicationID(context.TODO(), "context-id"),
+		opts:                []PublishOption{WithDeduplicationID("option-id")},
+		wantDeduplicationID: "option-id",
+	}, {
+		name:                "Publish prefers the message id",
+		ctx:                 ContextWithDeduplicationID(context.TODO(), "context-id"),
+		id:                  "message-id",
+		wantDeduplicationID: "message-id",
+	}, {
+		name:                "Publish ignores an empty context deduplication id",
+		ctx:                 ContextWithDeduplicationID(context.TODO(), ""),
+		wantDeduplicationID: "uuid",
+	}, {
+		name:                "Publish generates a deduplication id without a context id",
+		ctx:                 context.TODO(),
+		wantDeduplicationID: "uuid",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockClient{}
+			q := &Publisher{
+				token:  "token",
+				url:    "url",
+				topic:  "topic",
+				client: client,
+				uuid:   &mockUUID{uuid: "uuid"},
+			}
+			m := Message{
+				ID:   tt.id,
+				Body: []byte("message"),
+			}
+			if err := q.Publish(tt.ctx, &m, tt.opts...); err != nil {
+				t.Fatalf("Publisher.Publish() error = %v", err)
+			} else if got := client.r.Header.Get("Upstash-Deduplication-Id"); got != tt.wantDeduplicationID {
+				t.Fatalf("Publisher.Publish() deduplication id = %v, want %v", got, tt.wantDeduplicationID)
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishWithoutDeduplicationFor(t *testing.T) {
+	tests := []struct {
+		name                string
+		contentTypes        []string
+		opts                []PublishOption
+		wantDeduplicationID string
+	}{{
+		name:                "Publish a json message with deduplication",
+		contentTypes:        []string{"application/octet-stream"},
+		wantDeduplicationID: "uuid",
+	}, {
+		name:         "Publish a binary message without deduplication",
+		contentTypes: []string{"application/octet-stream"},
+		opts:         []PublishOption{WithContentType("application/octet-stream")},
+	}, {
+		name:         "Publish a message with content type parameters without deduplication",
+		contentTypes: []string{"Text/Plain"},
+		opts:         []PublishOption{WithContentType("text/plain; charset=utf-8")},
+	}, {
+		name:         "Publish a json message without deduplication",
+		contentTypes: []string{"application/json"},
+	}, {
+		name:                "Publish a binary message with an explicit deduplication id",
+		contentTypes:        []string{"application/octet-stream"},
+		opts:                []PublishOption{WithContentType("application/octet-stream"), WithDeduplicationID("id")},
+		wantDeduplicationID: "id",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewPublisher("topic", WithQStashToken("token"), WithoutDeduplicationFor(tt.contentTypes...))
+			if err != nil {
+				t.Fatalf("NewPublisher() error = %v", err)
+			}
+			client := &mockClient{}
+			q.client = client
+			q.uuid = &mockUUID{uuid: "uuid"}
+			if err := q.Publish(context.TODO(), &Message{Body: []byte("message")}, tt.opts...); err != nil {
+				t.Fatalf("Publisher.Publish() error = %v", err)
+			} else if got := client.r.Header.Get("Upstash-Deduplication-Id"); got != tt.wantDeduplicationID {
+				t.Fatalf("Publisher.Publish() deduplication id = %v, want %v", got, tt.wantDeduplicationID)
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishWithDeduplicationFunc(t *testing.T) {
+	tests := []struct {
+		name                 string
+		id                   string
+		opts                 []PublishOption
+		deduplicationFunc    func(m *Message) (string, bool, error)
+		wantDeduplicationID  string
+		wantContentBased     bool
+		wantErr              bool
+		wantConflictingDedup bool
+	}{{
+		name: "Publish with a computed deduplication id",
+		deduplicationFunc: func(m *Message) (string, bool, error) {
+			return "computed-" + string(m.Body), false, nil
+		},
+		wantDeduplicationID: "computed-message",
+	}, {
+		name: "Publish with computed content based deduplication",
+		deduplicationFunc: func(m *Message) (string, bool, error) {
+			return "", true, nil
+		},
+		wantContentBased: true,
+	}, {
+		name: "Publish with the default deduplication id",
+		deduplicationFunc: func(m *Message) (string, bool, error) {
+			return "", false, nil
+		},
+		wantDeduplicationID: "uuid",
+	}, {
+		name: "Publish options take precedence over the computed deduplication",
+		opts: []PublishOption{WithDeduplicationID("option-id")},
+		deduplicationFunc: func(m *Message) (string, bool, error) {
+			return "computed", false, nil
+		},
+		wantDeduplicationID: "option-id",
+	}, {
+		name: "Publish with a computed deduplication id that conflicts with the message id fails",
+		id:   "message-id",
+		deduplicationFunc: func(m *Message) (string, bool, error) {
+			return "computed", false, nil
+		},
+		wantErr:              true,
+		wantConflictingDedup: true,
+	}, {
+		name: "Publish with a computed id and content based deduplication fails",
+		deduplicationFunc: func(m *Message) (string, bool, error) {
+			return "computed", true, nil
+		},
+		wantErr:              true,
+		wantConflictingDedup: true,
+	}, {
+		name: "Publish with a failing deduplication func fails",
+		deduplicationFunc: func(m *Message) (string, bool, error) {
+			return "", false, errors.New("failed")
+		},
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockClient{}
+			q := &Publisher{
+				token:             "token",
+				url:               "url",
+				topic:             "topic",
+				client:            client,
+				uuid:              &mockUUID{uuid: "uuid"},
+				deduplicationFunc: tt.deduplicationFunc,
+			}
+			err := q.Publish(context.TODO(), &Message{ID: tt.id, Body: []byte("message")}, tt.opts...)
+			if err != nil {
+				if !tt.wantErr {
+					t.Fatalf("Publisher.Publish() error = %v, wantErr %v", err, tt.wantErr)
+				} else if tt.wantConflictingDedup && !errors.Is(err, ErrConflictingDedup) {
+					t.Fatalf("Publisher.Publish() error = %v, want %v", err, ErrConflictingDedup)
+				}
+				return
+			} else if tt.wantErr {
+				t.Fatalf("Publisher.Publish() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := client.r.Header.Get("Upstash-Deduplication-Id"); got != tt.wantDeduplicationID {
+				t.Fatalf("Publisher.Publish() deduplication id = %v, want %v", got, tt.wantDeduplicationID)
+			} else if got := client.r.Header.Get("Upstash-Content-Based-Deduplication") == "true"; got != tt.wantContentBased {
+				t.Fatalf("Publisher.Publish() content based deduplication = %v, want %v", got, tt.wantContentBased)
+			}
+		})
+	}
+}
+
+// mockRecordingClient records every request and its header.
+// It responds with the next body or with a numbered message id once they run out
+type mockRecordingClient struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	headers  []http.Header
+	bodies   []string
+}
+
+func (c *mockRecordingClient) Do(r *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, r)
+	c.headers = append(c.headers, r.Header.Clone())
+	body := fmt.Sprintf("{ \"messageId\":\"mock-id-%d\" }", len(c.requests))
+	if len(c.requests) <= len(c.bodies) {
+		body = c.bodies[len(c.requests)-1]
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(bytes.NewBufferString(body)),
+	}, nil
+}
+
+func TestPublisher_PublishToMany(t *testing.T) {
+	client := &mockRecordingClient{}
+	q := &Publisher{
+		token:  "token",
+		url:    "url",
+		topic:  "topic",
+		client: client,
+		uuid:   &mockUUID{uuid: "uuid"},
+	}
+	targets := []PublishTarget{{
+		URL:     "https://a.example.com",
+		Options: []PublishOption{WithRetries(1), WithDelay(time.Minute)},
+	}, {
+		URL:     "https://b.example.com",
+		Options: []PublishOption{WithRetries(5)},
+	}, {
+		URL:     "https://c.example.com",
+		Options: []PublishOption{WithDelay(-time.Second)},
+	}}
+	m := Message{Body: []byte("message")}
+	results, err := q.PublishToMany(context.TODO(), &m, targets)
+	if err == nil {
+		t.Fatalf("Publisher.PublishToMany() error = %v, want the invalid delay error", err)
+	} else if len(results) != len(targets) {
+		t.Fatalf("Publisher.PublishToMany() results = %v, want %v", len(results), len(targets))
+	} else if results[2] != nil {
+		t.Fatalf("Publisher.PublishToMany() result = %v, want nil for the failed target", results[2])
+	} else if len(client.requests) != 2 {
+		t.Fatalf("Publisher.PublishToMany() requests = %v, want %v", len(client.requests), 2)
+	} else if len(m.ID) > 0 || m.Headers != nil {
+		t.Fatalf("Publisher.PublishToMany() modified the message = %v", m)
+	}
+	want := []struct {
+		url       string
+		retries   string
+		delay     string
+		messageID string
+	}{
+		{"url/https://a.example.com", "1", "1m0s", "mock-id-1"},
+		{"url/https://b.example.com", "5", "", "mock-id-2"},
+	}
+	for i, w := range want {
+		r := client.requests[i]
+		if got := r.URL.String(); got != w.url {
+			t.Fatalf("Publisher.PublishToMany() url = %v, want %v", got, w.url)
+		} else if got := r.Header.Get("Upstash-Retries"); got != w.retries {
+			t.Fatalf("Publisher.PublishToMany() %v retries = %v, want %v", w.url, got, w.retries)
+		} else if got := r.Header.Get("Upstash-Delay"); got != w.delay {
+			t.Fatalf("Publisher.PublishToMany() %v delay = %v, want %v", w.url, got, w.delay)
+		} else if got := results[i].MessageID; got != w.messageID {
+			t.Fatalf("Publisher.PublishToMany() %v message id = %v, want %v", w.url, got, w.messageID)
+		}
+	}
+
+	// Messages with an id are rejected
+	if _, err := q.PublishToMany(context.TODO(), &Message{ID: "id"}, targets); !errors.Is(err, ErrConflictingDedup) {
+		t.Fatalf("Publisher.PublishToMany() error = %v, want %v", err, ErrConflictingDedup)
+	}
+}
+
+func TestPublisher_PublishToManyScopedContentDeduplication(t *testing.T) {
+	client := &mockRecordingClient{}
+	q := &Publisher{
+		token:  "token",
+		url:    "url",
+		topic:  "topic",
+		client: client,
+		uuid:   &mockUUID{uuid: "uuid"},
+	}
+	opts := []PublishOption{WithDeduplicationScope("tenant"), WithContentBasedDeduplication()}
+	targets := []PublishTarget{{
+		URL:     "https://a.example.com",
+		Options: opts,
+	}, {
+		URL:     "https://b.example.com",
+		Options: opts,
+	}}
+	m := Message{Body: []byte("message")}
+	if _, err := q.PublishToMany(context.TODO(), &m, targets); err != nil {
+		t.Fatalf("Publisher.PublishToMany() error = %v", err)
+	} else if len(client.requests) != len(targets) {
+		t.Fatalf("Publisher.PublishToMany() requests = %v, want %v", len(client.requests), len(targets))
+	}
+	a := client.requests[0].Header.Get("Upstash-Deduplication-Id")
+	b := client.requests[1].Header.Get("Upstash-Deduplication-Id")
+	if !strings.HasPrefix(a, "tenant:") || !strings.HasPrefix(b, "tenant:") {
+		t.Fatalf("Publisher.PublishToMany() deduplication ids = %v, %v, want the tenant scope", a, b)
+	} else if a == b {
+		t.Fatalf("Publisher.PublishToMany() deduplication ids = %v, want a different id for each destination", a)
+	}
+
+	// The forwarded headers are part of the content
+	m.Headers = http.Header{"Upstash-Forward-Tenant": []string{"red"}}
+	if _, err := q.PublishToMany(context.TODO(), &m, targets[:1]); err != nil {
+		t.Fatalf("Publisher.PublishToMany() error = %v", err)
+	} else if got := client.requests[2].Header.Get("Upstash-Deduplication-Id"); got == a {
+		t.Fatalf("Publisher.PublishToMany() deduplication id = %v, want a different id for different headers", got)
+	}
+}
+
+func TestPublisher_PublishMaxHeaderSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxHeaderSize int
+		headers       http.Header
+		wantErr       bool
+	}{{
+		name:          "Publish headers under the limit",
+		maxHeaderSize: 64,
+		headers: http.Header{
+			"Upstash-Forward-A": []string{strings.Repeat("a", 10)},
+			"Upstash-Forward-B": []string{strings.Repeat("b", 10)},
+		},
+	}, {
+		name:          "Publish headers over the limit fails",
+		maxHeaderSize: 64,
+		headers: http.Header{
+			"Upstash-Forward-A": []string{strings.Repeat("a", 10)},
+			"Upstash-Forward-B": []string{strings.Repeat("b", 10), strings.Repeat("b", 10)},
+		},
+		wantErr: true,
+	}, {
+		name: "Publish headers without a limit",
+		headers: http.Header{
+			"Upstash-Forward-A": []string{strings.Repeat("a", 1024)},
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockClient{}
+			q := &Publisher{
+				token:         "token",
+				url:           "url",
+				topic:         "topic",
+				client:        client,
+				uuid:          &mockUUID{uuid: "uuid"},
+				maxHeaderSize: tt.maxHeaderSize,
+			}
+			err := q.Publish(context.TODO(), &Message{Headers: tt.headers, Body: []byte("message")})
+			if err != nil {
+				if !tt.wantErr || !errors.Is(err, ErrHeadersTooLarge) {
+					t.Fatalf("Publisher.Publish() error = %v, wantErr %v", err, tt.wantErr)
+				} else if client.r != nil {
+					t.Fatalf("Publisher.Publish() sent the request")
+				}
+			} else if tt.wantErr {
+				t.Fatalf("Publisher.Publish() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+type mockPublisherMetrics struct {
+	deduplicated int
+}
+
+func (m *mockPublisherMetrics) IncDeduplicated() {
+	m.deduplicated++
+}
+
+func TestPublisher_DeduplicatedCount(t *testing.T) {
+	metrics := &mockPublisherMetrics{}
+	q := &Publisher{
+		token: "token",
+		url:   "url",
+		topic: "topic",
+		client: &httpClient{
+			client: &http.Client{Transport: &mockTransport{
+				statusCodes: []int{http.StatusCreated},
+				bodies: []string{
+					`{"messageId":"msg_1"}`,
+					`{"messageId":"msg_1","deduplicated":true}`,
+					`{"messageId":"msg_1","deduplicated":true}`,
+					`{"messageId":"msg_2","deduplicated":false}`,
+				},
+			}},
+			MinBackOff: time.Millisecond,
+			MaxBackOff: time.Millisecond,
+		},
+		uuid:    &mockUUID{uuid: "uuid"},
+		metrics: metrics,
+	}
+	for i, want := range []int64{0, 1, 2, 2} {
+		if err := q.Publish(context.TODO(), &Message{Body: []byte("message")}, WithDeduplicationID("id")); err != nil {
+			t.Fatalf("Publisher.Publish() error = %v", err)
+		} else if got := q.DeduplicatedCount(); got != want {
+			t.Fatalf("Publisher.DeduplicatedCount() after %d publishes = %v, want %v", i+1, got, want)
+		} else if metrics.deduplicated != int(want) {
+			t.Fatalf("PublisherMetrics.IncDeduplicated() calls after %d publishes = %v, want %v", i+1, metrics.deduplicated, want)
+		}
+	}
+}
+
+func TestNewPublisherFromURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		dsn       string
+		opts      []PublisherOption
+		wantToken string
+		wantURL   string
+		wantTopic string
+		wantErr   bool
+	}{{
+		name:      "Parse a qstash url",
+		dsn:       "qstash://token@qstash.upstash.io/https://example.com/api",
+		wantToken: "token",
+		wantURL:   "https://qstash.upstash.io/v2/publish",
+		wantTopic: "https://example.com/api",
+	}, {
+		name:      "Parse a qstash url without tls",
+		dsn:       "qstash+http://token@localhost:8080/topic",
+		wantToken: "token",
+		wantURL:   "http://localhost:8080/v2/publish",
+		wantTopic: "topic",
+	}, {
+		name:      "Parse a qstash url with an escaped token",
+		dsn:       "qstash://to%40ken@qstash.upstash.io/topic",
+		wantToken: "to@ken",
+		wantURL:   "https://qstash.upstash.io/v2/publish",
+		wantTopic: "topic",
+	}, {
+		name:      "Parse a qstash url with an '@' in the destination",
+		dsn:       "qstash://token@qstash.upstash.io/https://example.com/users/@me",
+		wantToken: "token",
+		wantURL:   "https://qstash.upstash.io/v2/publish",
+		wantTopic: "https://example.com/users/@me",
+	}, {
+		name:    "Parse a url with an '@' only in the destination fails",
+		dsn:     "qstash://qstash.upstash.io/https://example.com/users/@me",
+		wantErr: true,
+	}, {
+		name:      "Options override the qstash url",
+		dsn:       "qstash://token@qstash.upstash.io/topic",
+		opts:      []PublisherOption{WithQStashToken("other")},
+		wantToken: "other",
+		wantURL:   "https://qstash.upstash.io/v2/publish",
+		wantTopic: "topic",
+	}, {
+		name:    "Parse a url with the wrong scheme fails",
+		dsn:     "https://token@qstash.upstash.io/topic",
+		wantErr: true,
+	}, {
+		name:    "Parse a url without a token fails",
+		dsn:     "qstash://qstash.upstash.io/topic",
+		wantErr: true,
+	}, {
+		name:    "Parse a url with an empty token fails",
+		dsn:     "qstash://@qstash.upstash.io/topic",
+		wantErr: true,
+	}, {
+		name:    "Parse a url without a host fails",
+		dsn:     "qstash://token@/topic",
+		wantErr: true,
+	}, {
+		name:    "Parse a url without a destination fails",
+		dsn:     "qstash://token@qstash.upstash.io/",
+		wantErr: true,
+	}, {
+		name:    "Parse a url with a bad escape fails",
+		dsn:     "qstash://to%zzken@qstash.upstash.io/topic",
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewPublisherFromURL(tt.dsn, tt.opts...)
+			if err != nil {
+				if !tt.wantErr {
+					t.Fatalf("NewPublisherFromURL() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				return
+			} else if tt.wantErr {
+				t.Fatalf("NewPublisherFromURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if q.token != tt.wantToken {
+				t.Fatalf("NewPublisherFromURL() token = %v, want %v", q.token, tt.wantToken)
+			} else if q.url != tt.wantURL {
+				t.Fatalf("NewPublisherFromURL() url = %v, want %v", q.url, tt.wantURL)
+			} else if q.topic != tt.wantTopic {
+				t.Fatalf("NewPublisherFromURL() topic = %v, want %v", q.topic, tt.wantTopic)
+			}
+		})
+	}
+}
+
+// mockSequenceUUID generates numbered ids
+type mockSequenceUUID struct {
+	n int
+}
+
+func (u *mockSequenceUUID) NewV4() (string, error) {
+	u.n++
+	return fmt.Sprintf("uuid-%d", u.n), nil
+}
+
+func TestPublisher_PublishRetryOnIDCollision(t *testing.T) {
+	tests := []struct {
+		name                 string
+		retryOnIDCollision   bool
+		opts                 []PublishOption
+		wantDeduplicationIDs []string
+		wantMessageID        string
+		wantDeduplicated     int64
+	}{{
+		name:                 "Publish again after a collision",
+		retryOnIDCollision:   true,
+		wantDeduplicationIDs: []string{"uuid-1", "uuid-2"},
+		wantMessageID:        "msg_2",
+	}, {
+		name:                 "Publish once without retrying collisions",
+		wantDeduplicationIDs: []string{"uuid-1"},
+		wantMessageID:        "msg_1",
+		wantDeduplicated:     1,
+	}, {
+		name:                 "Publish once with an explicit deduplication id",
+		retryOnIDCollision:   true,
+		opts:                 []PublishOption{WithDeduplicationID("id")},
+		wantDeduplicationIDs: []string{"id"},
+		wantMessageID:        "msg_1",
+		wantDeduplicated:     1,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockRecordingClient{bodies: []string{
+				`{"messageId":"msg_1","deduplicated":true}`,
+				`{"messageId":"msg_2"}`,
+			}}
+			q := &Publisher{
+				token:              "token",
+				url:                "url",
+				topic:              "topic",
+				client:             client,
+				uuid:               &mockSequenceUUID{},
+				retryOnIDCollision: tt.retryOnIDCollision,
+			}
+			res, err := q.PublishWithResult(context.TODO(), &Message{Body: []byte("message")}, tt.opts...)
+			if err != nil {
+				t.Fatalf("Publisher.PublishWithResult() error = %v", err)
+			} else if res.MessageID != tt.wantMessageID {
+				t.Fatalf("Publisher.PublishWithResult() message id = %v, want %v", res.MessageID, tt.wantMessageID)
+			} else if res.Attempts != len(tt.wantDeduplicationIDs) {
+				t.Fatalf("Publisher.PublishWithResult() attempts = %v, want %v", res.Attempts, len(tt.wantDeduplicationIDs))
+			} else if got := q.DeduplicatedCount(); got != tt.wantDeduplicated {
+				t.Fatalf("Publisher.DeduplicatedCount() = %v, want %v", got, tt.wantDeduplicated)
+			} else if len(client.headers) != len(tt.wantDeduplicationIDs) {
+				t.Fatalf("Publisher.PublishWithResult() requests = %v, want %v", len(client.headers), len(tt.wantDeduplicationIDs))
+			}
+			for i, header := range client.headers {
+				if got := header.Get("Upstash-Deduplication-Id"); got != tt.wantDeduplicationIDs[i] {
+					t.Fatalf("Publisher.PublishWithResult() deduplication id = %v, want %v", got, tt.wantDeduplicationIDs[i])
+				}
+				if bs, _ := io.ReadAll(client.requests[i].Body); string(bs) != "message" {
+					t.Fatalf("Publisher.PublishWithResult() body = %s, want %s", bs, "message")
+				}
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishVerbose(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		maxLogBodySize int
+		wantLog        string
+	}{{
+		name:           "Publish logs the response body",
+		body:           `{"messageId":"msg_1"}`,
+		maxLogBodySize: 4 * 1024,
+		wantLog:        `responded 200: {"messageId":"msg_1"}`,
+	}, {
+		name:           "Publish truncates a large response body",
+		body:           `{"messageId":"msg_1","padding":"` + strings.Repeat("x", 10*1024) + `"}`,
+		maxLogBodySize: 10,
+		wantLog:        `responded 200: {"messageI... (truncated 10264 bytes)`,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs []string
+			q := &Publisher{
+				token:          "token",
+				url:            "url",
+				topic:          "topic",
+				client:         &mockRecordingClient{bodies: []string{tt.body}},
+				uuid:           &mockUUID{uuid: "uuid"},
+				verbose:        true,
+				maxLogBodySize: tt.maxLogBodySize,
+				logf: func(format string, v ...any) {
+					logs = append(logs, fmt.Sprintf(format, v...))
+				},
+			}
+			if _, err := q.PublishWithResult(context.TODO(), &Message{Body: []byte("message")}); err != nil {
+				t.Fatalf("Publisher.PublishWithResult() error = %v", err)
+			} else if len(logs) != 1 {
+				t.Fatalf("Publisher.PublishWithResult() logs = %v, want 1 log", logs)
+			} else if !strings.HasSuffix(logs[0], tt.wantLog) {
+				t.Fatalf("Publisher.PublishWithResult() log = %v, want suffix %v", logs[0], tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishURLGroup(t *testing.T) {
+	tests := []struct {
+		name             string
+		body             string
+		wantResult       PublishResult
+		wantDeduplicated int64
+	}{{
+		name: "Publish to an endpoint",
+		body: `{"messageId":"msg_1"}`,
+		wantResult: PublishResult{
+			MessageID: "msg_1",
+			Attempts:  1,
+		},
+	}, {
+		name: "Publish to a url group",
+		body: `[{"messageId":"msg_1","url":"https://example.com/a"},{"messageId":"msg_2","url":"https://example.com/b","deduplicated":true}]`,
+		wantResult: PublishResult{
+			MessageID: "msg_1",
+			Attempts:  1,
+			Endpoints: []PublishResult{
+				{MessageID: "msg_1", Attempts: 1, URL: "https://example.com/a"},
+				{MessageID: "msg_2", Attempts: 1, URL: "https://example.com/b", Deduplicated: true},
+			},
+		},
+	}, {
+		name: "Publish a duplicate to a url group",
+		body: `[{"messageId":"msg_1","url":"https://example.com/a","deduplicated":true},{"messageId":"msg_2","url":"https://example.com/b","deduplicated":true}]`,
+		wantResult: PublishResult{
+			MessageID:    "msg_1",
+			Attempts:     1,
+			Deduplicated: true,
+			Endpoints: []PublishResult{
+				{MessageID: "msg_1", Attempts: 1, URL: "https://example.com/a", Deduplicated: true},
+				{MessageID: "msg_2", Attempts: 1, URL: "https://example.com/b", Deduplicated: true},
+			},
+		},
+		wantDeduplicated: 1,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &Publisher{
+				token:  "token",
+				url:    "url",
+				topic:  "group",
+				client: &mockRecordingClient{bodies: []string{tt.body}},
+				uuid:   &mockUUID{uuid: "uuid"},
+			}
+			res, err := q.PublishWithResult(context.TODO(), &Message{Body: []byte("message")})
+			if err != nil {
+				t.Fatalf("Publisher.PublishWithResult() error = %v", err)
+			} else if !reflect.DeepEqual(*res, tt.wantResult) {
+				t.Fatalf("Publisher.PublishWithResult() = %+v, want %+v", *res, tt.wantResult)
+			} else if got := q.DeduplicatedCount(); got != tt.wantDeduplicated {
+				t.Fatalf("Publisher.DeduplicatedCount() = %v, want %v", got, tt.wantDeduplicated)
+			}
+		})
+	}
+}
+
+// mockErrorClient fails every request with the error
+type mockErrorClient struct {
+	err error
+}
+
+func (c *mockErrorClient) Do(*http.Request) (*http.Response, error) {
+	return nil, c.err
+}
+
+func TestPublishError_IsTransient(t *testing.T) {
+	tests := []struct {
+		name   string
+		client interface {
+			Do(*http.Request) (*http.Response, error)
+		}
+		wantStatus    int
+		wantTransient bool
+	}{{
+		name:          "Network error is transient",
+		client:        &mockErrorClient{err: errors.New("connection reset by peer")},
+		wantTransient: true,
+	}, {
+		name:          "500 is transient",
+		client:        &mockStatusClient{statusCode: http.StatusInternalServerError},
+		wantStatus:    http.StatusInternalServerError,
+		wantTransient: true,
+	}, {
+		name:          "503 is transient",
+		client:        &mockStatusClient{statusCode: http.StatusServiceUnavailable},
+		wantStatus:    http.StatusServiceUnavailable,
+		wantTransient: true,
+	}, {
+		name:          "429 is transient",
+		client:        &mockStatusClient{statusCode: http.StatusTooManyRequests},
+		wantStatus:    http.StatusTooManyRequests,
+		wantTransient: true,
+	}, {
+		name:       "400 is permanent",
+		client:     &mockStatusClient{statusCode: http.StatusBadRequest},
+		wantStatus: http.StatusBadRequest,
+	}, {
+		name:       "401 is permanent",
+		client:     &mockStatusClient{statusCode: http.StatusUnauthorized},
+		wantStatus: http.StatusUnauthorized,
+	}, {
+		name:       "410 is permanent",
+		client:     &mockStatusClient{statusCode: http.StatusGone},
+		wantStatus: http.StatusGone,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &Publisher{
+				token:  "token",
+				url:    "url",
+				topic:  "topic",
+				client: tt.client,
+				uuid:   &mockUUID{uuid: "uuid"},
+			}
+			var publishErr *PublishError
+			if err := q.Publish(context.TODO(), &Message{Body: []byte("message")}); !errors.As(err, &publishErr) {
+				t.Fatalf("Publisher.Publish() error = %v, want a *PublishError", err)
+			} else if publishErr.StatusCode != tt.wantStatus {
+				t.Fatalf("PublishError.StatusCode = %v, want %v", publishErr.StatusCode, tt.wantStatus)
+			} else if got := publishErr.IsTransient(); got != tt.wantTransient {
+				t.Fatalf("PublishError.IsTransient() = %v, want %v", got, tt.wantTransient)
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishCancelled(t *testing.T) {
+	q := &Publisher{
+		token:  "token",
+		url:    "url",
+		topic:  "topic",
+		client: &mockErrorClient{err: context.Canceled},
+		uuid:   &mockUUID{uuid: "uuid"},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var publishErr *PublishError
+	if _, err := q.PublishWithResult(ctx, &Message{Body: []byte("message")}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Publisher.PublishWithResult() error = %v, want %v", err, context.Canceled)
+	} else if errors.As(err, &publishErr) {
+		t.Fatalf("Publisher.PublishWithResult() error = %#v, want the context error", err)
+	}
+}
+
+func TestPublishError_Error(t *testing.T) {
+	tests := []struct {
+		name string
+		err  *PublishError
+		want string
+	}{{
+		name: "No response and no error",
+		err:  &PublishError{},
+		want: "could not complete request",
+	}, {
+		name: "No response",
+		err:  &PublishError{Err: errors.New("connection reset by peer")},
+		want: "connection reset by peer",
+	}, {
+		name: "Status code",
+		err:  &PublishError{StatusCode: http.StatusBadRequest, Body: "bad request"},
+		want: "bad request status 400: bad request",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.err.Error(); got != tt.want {
+				t.Fatalf("PublishError.Error() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublisher_SetDeduplicationScope(t *testing.T) {
+	client := &mockRecordingClient{}
+	q := &Publisher{
+		token:  "token",
+		url:    "url",
+		topic:  "topic",
+		client: client,
+		uuid:   &uuid{},
+	}
+	q.SetDeduplicationScope("blue")
+
+	// Rotate the scope while messages are being published
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				if err := q.Publish(context.TODO(), &Message{Body: []byte("message")}); err != nil {
+					t.Errorf("Publisher.Publish() error = %v", err)
+				}
+			}
+		}()
+	}
+	q.SetDeduplicationScope("green")
+	wg.Wait()
+	for _, header := range client.headers {
+		if id := header.Get("Upstash-Deduplication-Id"); !strings.HasPrefix(id, "blue:") && !strings.HasPrefix(id, "green:") {
+			t.Fatalf("Publisher.Publish() deduplication id = %v, want a blue or green scope", id)
+		}
+	}
+
+	// Publishes after the rotation use the new scope unless they set their own
+	tests := []struct {
+		name       string
+		opts       []PublishOption
+		wantPrefix string
+	}{{
+		name:       "Publish with the rotated scope",
+		wantPrefix: "green:",
+	}, {
+		name:       "Publish with the scope of the publish options",
+		opts:       []PublishOption{WithDeduplicationScope("red")},
+		wantPrefix: "red:",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := q.Publish(context.TODO(), &Message{Body: []byte("message")}, tt.opts...); err != nil {
+				t.Fatalf("Publisher.Publish() error = %v", err)
+			} else if id := client.headers[len(client.headers)-1].Get("Upstash-Deduplication-Id"); !strings.HasPrefix(id, tt.wantPrefix) {
+				t.Fatalf("Publisher.Publish() deduplication id = %v, want prefix %v", id, tt.wantPrefix)
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishRaw(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		wantStats  PublisherStats
+	}{{
+		name:       "Publish returns the raw response",
+		statusCode: http.StatusCreated,
+		wantStats:  PublisherStats{Published: 1, Attempts: 1},
+	}, {
+		name:       "Publish returns the raw response of a failed publish",
+		statusCode: http.StatusTooManyRequests,
+		wantStats:  PublisherStats{Failed: 1, Attempts: 1},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockStatusClient{
+				statusCode: tt.statusCode,
+				header:     http.Header{"Ratelimit-Remaining": []string{"99"}},
+			}
+			q := &Publisher{
+				token:  "token",
+				url:    "url",
+				topic:  "topic",
+				client: client,
+				uuid:   &mockUUID{uuid: "uuid"},
+			}
+			m := &Message{Body: []byte("message")}
+			rsp, err := q.PublishRaw(context.TODO(), m, WithDelay(time.Minute))
+			if err != nil {
+				t.Fatalf("Publisher.PublishRaw() error = %v", err)
+			}
+			defer rsp.Body.Close()
+			if rsp.StatusCode != tt.statusCode {
+				t.Fatalf("Publisher.PublishRaw() status = %v, want %v", rsp.StatusCode, tt.statusCode)
+			} else if got := rsp.Header.Get("Ratelimit-Remaining"); got != "99" {
+				t.Fatalf("Publisher.PublishRaw() header Ratelimit-Remaining = %v, want %v", got, "99")
+			} else if got := q.Stats(); got != tt.wantStats {
+				t.Fatalf("Publisher.PublishRaw() stats = %+v, want %+v", got, tt.wantStats)
+			} else if len(m.ID) > 0 {
+				t.Fatalf("Publisher.PublishRaw() set the message id to %v", m.ID)
+			} else if got := client.r.Header.Get("Upstash-Delay"); got != "1m0s" {
+				t.Fatalf("Publisher.PublishRaw() header Upstash-Delay = %v, want %v", got, "1m0s")
+			} else if got := client.r.Header.Get("Upstash-Deduplication-Id"); got != "uuid" {
+				t.Fatalf("Publisher.PublishRaw() header Upstash-Deduplication-Id = %v, want %v", got, "uuid")
+			}
+		})
+	}
+}
+
+func TestPublisher_Stats(t *testing.T) {
+	// Each round publishes a message, a message that fails, a duplicate and a message that takes 3 attempts
+	transport := &mockTransport{}
+	for i := 0; i < 10; i++ {
+		transport.statusCodes = append(transport.statusCodes, http.StatusOK, http.StatusBadRequest, http.StatusOK,
+			http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK)
+		transport.bodies = append(transport.bodies, `{"messageId":"mock-id"}`, "", `{"messageId":"mock-id","deduplicated":true}`,
+			"", "", `{"messageId":"mock-id"}`)
+	}
+	q := &Publisher{
+		token: "token",
+		url:   "url",
+		topic: "topic",
+		client: &httpClient{
+			client:     &http.Client{Transport: transport},
+			MinBackOff: time.Millisecond,
+			MaxBackOff: time.Millisecond,
+			Retries:    3,
+		},
+		uuid: &uuid{},
+	}
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 4; j++ {
+			_ = q.Publish(context.TODO(), &Message{Body: []byte("message")})
+		}
+	}
+	want := PublisherStats{
+		Published:    30,
+		Failed:       10,
+		Retried:      10,
+		Deduplicated: 10,
+		Attempts:     60,
+	}
+	if got := q.Stats(); got != want {
+		t.Fatalf("Publisher.Stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestPublisher_Warmup(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		closed       bool
+		wantRequests int64
+		wantErr      bool
+	}{{
+		name:         "Warmup opens a connection",
+		status:       http.StatusOK,
+		wantRequests: 1,
+	}, {
+		name:         "Warmup ignores the status code without retrying",
+		status:       http.StatusMethodNotAllowed,
+		wantRequests: 1,
+	}, {
+		name:    "Warmup fails without a connection",
+		closed:  true,
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int64
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodHead {
+					t.Errorf("Publisher.Warmup() method = %v, want %v", r.Method, http.MethodHead)
+				}
+				requests.Add(1)
+				w.WriteHeader(tt.status)
+			}))
+			defer s.Close()
+			if tt.closed {
+				s.Close()
+			}
+			q, err := NewPublisher("topic", WithQStashToken("token"), WithQStashURL(s.URL+"/v2/publish"))
+			if err != nil {
+				t.Fatalf("NewPublisher() error = %v", err)
+			}
+			if err := q.Warmup(context.TODO()); (err != nil) != tt.wantErr {
+				t.Fatalf("Publisher.Warmup() error = %v, wantErr %v", err, tt.wantErr)
+			} else if got := requests.Load(); got != tt.wantRequests {
+				t.Fatalf("Publisher.Warmup() requests = %v, want %v", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishDeduplicationID(t *testing.T) {
+	tests := []struct {
+		name                string
+		body                string
+		wantDeduplicationID string
+	}{{
+		name:                "Publish returns the computed deduplication id",
+		body:                `{"messageId":"msg_1","deduplicationId":"dedup_1"}`,
+		wantDeduplicationID: "dedup_1",
+	}, {
+		name: "Publish without a computed deduplication id",
+		body: `{"messageId":"msg_1"}`,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &Publisher{
+				token:  "token",
+				url:    "url",
+				topic:  "topic",
+				client: &mockRecordingClient{bodies: []string{tt.body}},
+				uuid:   &mockUUID{uuid: "uuid"},
+			}
+			res, err := q.PublishWithResult(context.TODO(), &Message{Body: []byte("message")}, WithContentBasedDeduplication())
+			if err != nil {
+				t.Fatalf("Publisher.PublishWithResult() error = %v", err)
+			} else if res.MessageID != "msg_1" {
+				t.Fatalf("Publisher.PublishWithResult() message id = %v, want %v", res.MessageID, "msg_1")
+			} else if res.DeduplicationID != tt.wantDeduplicationID {
+				t.Fatalf("Publisher.PublishWithResult() deduplication id = %v, want %v", res.DeduplicationID, tt.wantDeduplicationID)
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishEmptyResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{{
+		name: "Publish with an empty response",
+		body: "",
+	}, {
+		name: "Publish with a blank response",
+		body: " \n",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &Publisher{
+				token:  "token",
+				url:    "url",
+				topic:  "topic",
+				client: &mockRecordingClient{bodies: []string{tt.body}},
+				uuid:   &mockUUID{uuid: "uuid"},
+			}
+			m := &Message{Body: []byte("message")}
+			if err := q.Publish(context.TODO(), m); err != nil {
+				t.Fatalf("Publisher.Publish() error = %v", err)
+			} else if len(m.ID) > 0 {
+				t.Fatalf("Publisher.Publish() message id = %v, want it unset", m.ID)
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishCorrelationID(t *testing.T) {
+	tests := []struct {
+		name              string
+		opts              []PublishOption
+		wantCorrelationID string
+	}{{
+		name:              "Publish with a correlation id",
+		opts:              []PublishOption{WithCorrelationID("order-42")},
+		wantCorrelationID: "order-42",
+	}, {
+		name: "Publish without a correlation id",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockRecordingClient{}
+			q := &Publisher{
+				token:  "token",
+				url:    "url",
+				topic:  "topic",
+				client: client,
+				uuid:   &mockUUID{uuid: "uuid"},
+			}
+			res, err := q.PublishWithResult(context.TODO(), &Message{Body: []byte("message")}, tt.opts...)
+			if err != nil {
+				t.Fatalf("Publisher.PublishWithResult() error = %v", err)
+			} else if res.CorrelationID != tt.wantCorrelationID {
+				t.Fatalf("Publisher.PublishWithResult() correlation id = %v, want %v", res.CorrelationID, tt.wantCorrelationID)
+			} else if got := client.headers[0].Get("Upstash-Forward-Correlation-Id"); got != tt.wantCorrelationID {
+				t.Fatalf("Publisher.PublishWithResult() header Upstash-Forward-Correlation-Id = %v, want %v", got, tt.wantCorrelationID)
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishBodyStream(t *testing.T) {
+	tests := []struct {
+		name              string
+		m                 *Message
+		wantContentLength int64
+		wantGetBody       bool
+		wantErr           bool
+	}{{
+		name:              "Publish a stream of known length",
+		m:                 &Message{BodyStream: io.MultiReader(strings.NewReader("mess"), strings.NewReader("age")), BodyLength: 7},
+		wantContentLength: 7,
+	}, {
+		name:              "Publish a seekable stream of known length",
+		m:                 &Message{BodyStream: io.NewSectionReader(strings.NewReader("message"), 0, 7), BodyLength: 7},
+		wantContentLength: 7,
+		wantGetBody:       true,
+	}, {
+		name: "Publish a stream of unknown length",
+		m:    &Message{BodyStream: io.MultiReader(strings.NewReader("message"))},
+	}, {
+		name:    "Publish with both a body and a body stream fails",
+		m:       &Message{Body: []byte("message"), BodyStream: strings.NewReader("message")},
+		wantErr: true,
+	}, {
+		name:    "Publish a stream with a negative length fails",
+		m:       &Message{BodyStream: strings.NewReader("message"), BodyLength: -1},
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockRecordingClient{}
+			q := &Publisher{
+				token:  "token",
+				url:    "url",
+				topic:  "topic",
+				client: client,
+				uuid:   &mockUUID{uuid: "uuid"},
+			}
+			if err := q.Publish(context.TODO(), tt.m); (err != nil) != tt.wantErr {
+				t.Fatalf("Publisher.Publish() error = %v, wantErr %v", err, tt.wantErr)
+			} else if tt.wantErr {
+				return
+			}
+			r := client.requests[0]
+			if r.ContentLength != tt.wantContentLength {
+				t.Fatalf("Publisher.Publish() content length = %v, want %v", r.ContentLength, tt.wantContentLength)
+			} else if bs, err := io.ReadAll(r.Body); err != nil || string(bs) != "message" {
+				t.Fatalf("Publisher.Publish() body = %s, want %s", bs, "message")
+			} else if (r.GetBody != nil) != tt.wantGetBody {
+				t.Fatalf("Publisher.Publish() GetBody = %v, want %v", r.GetBody != nil, tt.wantGetBody)
+			} else if !tt.wantGetBody {
+				return
+			}
+
+			// Check the seekable stream is rewound for a retry
+			body, err := r.GetBody()
+			if err != nil {
+				t.Fatalf("Request.GetBody() error = %v", err)
+			} else if bs, _ := io.ReadAll(body); string(bs) != "message" {
+				t.Fatalf("Request.GetBody() body = %s, want %s", bs, "message")
+			}
+		})
+	}
+}
+
+func TestPublisher_decodePublishResponse(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		wantMessageID string
+	}{{
+		name:          "Decode messageId",
+		body:          `{"messageId":"msg_1"}`,
+		wantMessageID: "msg_1",
+	}, {
+		name:          "Decode message_id",
+		body:          `{"message_id":"msg_1"}`,
+		wantMessageID: "msg_1",
+	}, {
+		name:          "Decode id",
+		body:          `{"id":"msg_1"}`,
+		wantMessageID: "msg_1",
+	}, {
+		name:          "Decode messageId before its variants",
+		body:          `{"id":"msg_3","message_id":"msg_2","messageId":"msg_1"}`,
+		wantMessageID: "msg_1",
+	}, {
+		name:          "Decode a url group with message_id",
+		body:          `[{"message_id":"msg_1","url":"https://a.example.com"},{"message_id":"msg_2","url":"https://b.example.com"}]`,
+		wantMessageID: "msg_1",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &Publisher{}
+			res, err := q.decodePublishResponse([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("Publisher.decodePublishResponse() error = %v", err)
+			} else if res.MessageID != tt.wantMessageID {
+				t.Fatalf("Publisher.decodePublishResponse() message id = %v, want %v", res.MessageID, tt.wantMessageID)
+			}
+			for _, e := range res.Endpoints {
+				if len(e.MessageID) == 0 {
+					t.Fatalf("Publisher.decodePublishResponse() endpoint %v has no message id", e.URL)
+				}
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishWithResultDeduplicated(t *testing.T) {
+	tests := []struct {
+		name             string
+		body             string
+		wantMessageID    string
+		wantDeduplicated bool
+	}{{
+		name:          "Publish a new message",
+		body:          `{"messageId":"msg_1"}`,
+		wantMessageID: "msg_1",
+	}, {
+		name:             "Publish a duplicate message",
+		body:             `{"messageId":"msg_1","deduplicated":true}`,
+		wantMessageID:    "msg_1",
+		wantDeduplicated: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &Publisher{
+				token:  "token",
+				url:    "url",
+				topic:  "topic",
+				client: &mockRecordingClient{bodies: []string{tt.body}},
+				uuid:   &mockUUID{uuid: "uuid"},
+			}
+			m := &Message{ID: "dedup-id", Body: []byte("message")}
+			res, err := q.PublishWithResult(context.TODO(), m)
+			if err != nil {
+				t.Fatalf("Publisher.PublishWithResult() error = %v", err)
+			} else if res.MessageID != tt.wantMessageID {
+				t.Fatalf("Publisher.PublishWithResult() message id = %v, want %v", res.MessageID, tt.wantMessageID)
+			} else if res.Deduplicated != tt.wantDeduplicated {
+				t.Fatalf("Publisher.PublishWithResult() deduplicated = %v, want %v", res.Deduplicated, tt.wantDeduplicated)
+			} else if m.ID != "dedup-id" {
+				t.Fatalf("Publisher.PublishWithResult() changed the message id to %v", m.ID)
+			}
+
+			// The deprecated Publish still sets the message id
+			q.client = &mockRecordingClient{bodies: []string{tt.body}}
+			if err := q.Publish(context.TODO(), m); err != nil {
+				t.Fatalf("Publisher.Publish() error = %v", err)
+			} else if m.ID != tt.wantMessageID {
+				t.Fatalf("Publisher.Publish() message id = %v, want %v", m.ID, tt.wantMessageID)
+			}
+		})
+	}
+}
+
+func TestPublisher_PublishFilter(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		wantErr      error
+		wantRequests int
+	}{{
+		name:         "Publish a message that passes the filter",
+		body:         "message",
+		wantRequests: 1,
+	}, {
+		name:    "Skip a message that fails the filter",
+		body:    "",
+		wantErr: ErrFiltered,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockRecordingClient{}
+			q := &Publisher{
+				token:  "token",
+				url:    "url",
+				topic:  "topic",
+				client: client,
+				uuid:   &mockUUID{uuid: "uuid"},
+				filter: func(m *Message) bool { return len(m.Body) > 0 },
+			}
+			if _, err := q.PublishWithResult(context.TODO(), &Message{Body: []byte(tt.body)}); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Publisher.PublishWithResult() error = %v, want %v", err, tt.wantErr)
+			} else if _, err := q.PublishRaw(context.TODO(), &Message{Body: []byte(tt.body)}); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Publisher.PublishRaw() error = %v, want %v", err, tt.wantErr)
+			} else if len(client.requests) != 2*tt.wantRequests {
+				t.Fatalf("Publisher.PublishWithResult() requests = %v, want %v", len(client.requests), 2*tt.wantRequests)
+			} else if stats := q.Stats(); stats.Failed != 0 {
+				t.Fatalf("Publisher.Stats() failed = %v, want filtered messages to not count as failed", stats.Failed)
+			}
+		})
+	}
+}
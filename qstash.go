@@ -12,3 +12,11 @@
 //
 // You must set these environment variables or pass them manually as options to the `NewReceiver` and `NewPublisher` functions.
 package qstash
+
+// Version is the version of the go-qstash package
+const Version = "0.1.0"
+
+// UserAgent returns the user agent sent with every request to qstash
+func UserAgent() string {
+	return "go-qstash/" + Version
+}
@@ -40,11 +40,13 @@ func ExamplePublisher_publish() {
 		log.Fatal(err)
 	}
 	// Publish a message
-	if err := p.Publish(context.Background(), &qstash.Message{
+	res, err := p.PublishWithResult(context.Background(), &qstash.Message{
 		Body: []byte("Hello World!"),
-	}); err != nil {
+	})
+	if err != nil {
 		log.Fatal(err)
 	}
+	log.Println("Published message", res.MessageID)
 }
 
 // Its also possible to add delays to a message in the queue
@@ -121,7 +123,7 @@ func Example_ngrokDemoApp() {
 		log.Fatal(err)
 	}
 	// ...now
-	if err := p.Publish(ctx, &qstash.Message{
+	if _, err := p.PublishWithResult(ctx, &qstash.Message{
 		Body: []byte("Hello World!"),
 	}); err != nil {
 		log.Fatal(err)
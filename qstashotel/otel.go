@@ -0,0 +1,71 @@
+// Package qstashotel traces published and received messages with OpenTelemetry.
+// It is a separate package so that the OpenTelemetry dependency is only required by the users that need it.
+package qstashotel
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/marksalpeter/go-qstash"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithTracer wraps each publish in a span of the OpenTelemetry tracer (see qstash.WithTracer)
+func WithTracer(tracer trace.Tracer) qstash.PublisherOption {
+	return qstash.WithTracer(NewTracer(tracer))
+}
+
+// WithReceiverTracer wraps each received request in a span of the OpenTelemetry tracer (see qstash.WithReceiverTracer)
+func WithReceiverTracer(tracer trace.Tracer) qstash.ReceiverOption {
+	return qstash.WithReceiverTracer(NewTracer(tracer))
+}
+
+// NewTracer adapts the OpenTelemetry tracer to a qstash.Tracer
+func NewTracer(tracer trace.Tracer) qstash.Tracer {
+	return &otelTracer{tracer: tracer}
+}
+
+// otelTracer starts OpenTelemetry spans
+type otelTracer struct {
+	tracer trace.Tracer
+}
+
+// Start starts an OpenTelemetry span with the name
+func (t *otelTracer) Start(ctx context.Context, name string) (context.Context, qstash.Span) {
+	ctx, span := t.tracer.Start(ctx, name)
+	return ctx, &otelSpan{span: span}
+}
+
+// otelSpan is an OpenTelemetry span
+type otelSpan struct {
+	span trace.Span
+}
+
+// SetAttribute sets an attribute of the span
+func (s *otelSpan) SetAttribute(key string, value any) {
+	switch v := value.(type) {
+	case string:
+		s.span.SetAttributes(attribute.String(key, v))
+	case int:
+		s.span.SetAttributes(attribute.Int(key, v))
+	case int64:
+		s.span.SetAttributes(attribute.Int64(key, v))
+	case bool:
+		s.span.SetAttributes(attribute.Bool(key, v))
+	default:
+		s.span.SetAttributes(attribute.String(key, fmt.Sprint(v)))
+	}
+}
+
+// RecordError records the error and sets the status of the span to an error
+func (s *otelSpan) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+// End ends the span
+func (s *otelSpan) End() {
+	s.span.End()
+}
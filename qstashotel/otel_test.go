@@ -0,0 +1,126 @@
+package qstashotel
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/marksalpeter/go-qstash"
+	"github.com/marksalpeter/go-qstash/qstashtest"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestWithTracer(t *testing.T) {
+	s := qstashtest.NewServer()
+	defer s.Close()
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("qstashotel")
+
+	// Receive the message in a span
+	r, err := qstash.NewReceiver(
+		qstash.WithSigningKey(s.SigningKey),
+		qstash.WithNextSigningKey(s.NextSigningKey),
+		WithReceiverTracer(tracer),
+	)
+	if err != nil {
+		t.Fatalf("qstash.NewReceiver() error = %v", err)
+	}
+	received := make(chan struct{}, 1)
+	receiver := httptest.NewServer(r.Receive(func(_ context.Context, m *qstash.Message) {
+		m.Ack()
+		received <- struct{}{}
+	}))
+	defer receiver.Close()
+
+	// Publish the message in a span
+	p, err := qstash.NewPublisher(
+		receiver.URL,
+		qstash.WithQStashURL(s.PublishURL()),
+		qstash.WithQStashToken(s.Token),
+		WithTracer(tracer),
+	)
+	if err != nil {
+		t.Fatalf("qstash.NewPublisher() error = %v", err)
+	}
+	res, err := p.PublishWithResult(context.Background(), &qstash.Message{Body: []byte("message")})
+	if err != nil {
+		t.Fatalf("Publisher.PublishWithResult() error = %v", err)
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message was not received")
+	}
+
+	// Wait for the receive span to end once the response is written
+	for start := time.Now(); len(recorder.Ended()) < 2 && time.Since(start) < time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	if len(spans) != 2 {
+		t.Fatalf("WithTracer() spans = %v, want a publish and a receive span", len(spans))
+	}
+	tests := []struct {
+		span           string
+		wantAttributes map[attribute.Key]attribute.Value
+	}{{
+		span: "qstash.publish",
+		wantAttributes: map[attribute.Key]attribute.Value{
+			"qstash.destination": attribute.StringValue(receiver.URL),
+			"qstash.message_id":  attribute.StringValue(res.MessageID),
+			"qstash.status":      attribute.IntValue(http.StatusCreated),
+		},
+	}, {
+		span: "qstash.receive",
+		wantAttributes: map[attribute.Key]attribute.Value{
+			"qstash.message_id": attribute.StringValue(res.MessageID),
+			"qstash.status":     attribute.IntValue(http.StatusOK),
+		},
+	}}
+	for _, tt := range tests {
+		span, ok := spans[tt.span]
+		if !ok {
+			t.Fatalf("WithTracer() spans = %v, want a %v span", spans, tt.span)
+		} else if span.Status().Code == codes.Error {
+			t.Fatalf("WithTracer() %v status = %v, want no error", tt.span, span.Status())
+		}
+		attributes := make(map[attribute.Key]attribute.Value)
+		for _, kv := range span.Attributes() {
+			attributes[kv.Key] = kv.Value
+		}
+		for k, want := range tt.wantAttributes {
+			if got := attributes[k]; got != want {
+				t.Fatalf("WithTracer() %v attribute %v = %v, want %v", tt.span, k, got.Emit(), want.Emit())
+			}
+		}
+	}
+}
+
+func TestSpan_RecordError(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := NewTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("qstashotel"))
+	_, span := tracer.Start(context.Background(), "span")
+	span.SetAttribute("string", "value")
+	span.SetAttribute("int", 1)
+	span.RecordError(context.Canceled)
+	span.End()
+
+	ended := recorder.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("Span.End() spans = %v, want 1", len(ended))
+	} else if got := ended[0].Status(); got.Code != codes.Error || got.Description != context.Canceled.Error() {
+		t.Fatalf("Span.RecordError() status = %v, want an error status", got)
+	} else if got := len(ended[0].Events()); got != 1 {
+		t.Fatalf("Span.RecordError() events = %v, want 1", got)
+	} else if got := ended[0].Attributes(); len(got) != 2 || got[0].Value.AsString() != "value" || got[1].Value.AsInt64() != 1 {
+		t.Fatalf("Span.SetAttribute() attributes = %v, want the string and the int", got)
+	}
+}
@@ -0,0 +1,42 @@
+// Package qstashproto publishes and decodes protobuf messages with qstash.
+// It is a separate package so that the protobuf dependency is only required by the users that need it.
+package qstashproto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+
+	"github.com/marksalpeter/go-qstash"
+	"google.golang.org/protobuf/proto"
+)
+
+// ContentType is the content type of protobuf messages
+const ContentType = "application/x-protobuf"
+
+// ErrContentType is returned when decoding a message that does not have the protobuf content type
+var ErrContentType = errors.New("message is not a protobuf message")
+
+// Publish marshals the protobuf message and publishes it with the protobuf content type
+func Publish(ctx context.Context, p *qstash.Publisher, msg proto.Message, opts ...qstash.PublishOption) (*qstash.PublishResult, error) {
+	body, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", qstash.ErrMarshal, err)
+	}
+	return p.PublishWithResult(ctx, &qstash.Message{Body: body}, append([]qstash.PublishOption{qstash.WithContentType(ContentType)}, opts...)...)
+}
+
+// Decode unmarshals the body of a received message into the protobuf message.
+// Messages without a content type are decoded, but messages with another content type return ErrContentType
+func Decode(m *qstash.Message, msg proto.Message) error {
+	if contentType := m.Headers.Get("Content-Type"); len(contentType) > 0 {
+		if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != ContentType {
+			return fmt.Errorf("%w: got '%s'", ErrContentType, contentType)
+		}
+	}
+	if err := proto.Unmarshal(m.Body, msg); err != nil {
+		return fmt.Errorf("could not unmarshal protobuf message %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package qstashproto
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/marksalpeter/go-qstash"
+	"github.com/marksalpeter/go-qstash/qstashtest"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestPublishAndDecode(t *testing.T) {
+	s := qstashtest.NewServer()
+	defer s.Close()
+
+	// Receive the protobuf message
+	r, err := qstash.NewReceiver(qstash.WithSigningKey(s.SigningKey), qstash.WithNextSigningKey(s.NextSigningKey))
+	if err != nil {
+		t.Fatalf("qstash.NewReceiver() error = %v", err)
+	}
+	received := make(chan *wrapperspb.StringValue, 1)
+	receiver := httptest.NewServer(r.Receive(func(_ context.Context, m *qstash.Message) {
+		var msg wrapperspb.StringValue
+		if err := Decode(m, &msg); err != nil {
+			t.Errorf("Decode() error = %v", err)
+			return
+		}
+		received <- &msg
+		m.Ack()
+	}))
+	defer receiver.Close()
+
+	// Publish the protobuf message
+	p, err := qstash.NewPublisher(receiver.URL, qstash.WithQStashURL(s.PublishURL()), qstash.WithQStashToken(s.Token))
+	if err != nil {
+		t.Fatalf("qstash.NewPublisher() error = %v", err)
+	}
+	send := wrapperspb.String("message")
+	res, err := Publish(context.Background(), p, send)
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	} else if m, _ := s.Message(res.MessageID); m.Header.Get("Content-Type") != ContentType {
+		t.Fatalf("Publish() content type = %v, want %v", m.Header.Get("Content-Type"), ContentType)
+	}
+	select {
+	case got := <-received:
+		if !proto.Equal(got, send) {
+			t.Fatalf("Decode() = %v, want %v", got, send)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message was not received")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	body, err := proto.Marshal(wrapperspb.String("message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		wantErr     bool
+		wantErrIs   error
+	}{{
+		name:        "Decode a protobuf message",
+		contentType: ContentType,
+		body:        body,
+	}, {
+		name: "Decode a message without a content type",
+		body: body,
+	}, {
+		name:        "Decode a json message fails",
+		contentType: "application/json",
+		body:        body,
+		wantErr:     true,
+		wantErrIs:   ErrContentType,
+	}, {
+		name:        "Decode an invalid protobuf message fails",
+		contentType: ContentType,
+		body:        []byte{0xff},
+		wantErr:     true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &qstash.Message{Headers: http.Header{}, Body: tt.body}
+			if len(tt.contentType) > 0 {
+				m.Headers.Set("Content-Type", tt.contentType)
+			}
+			var msg wrapperspb.StringValue
+			if err := Decode(m, &msg); err != nil {
+				if !tt.wantErr {
+					t.Fatalf("Decode() error = %v, wantErr %v", err, tt.wantErr)
+				} else if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+					t.Fatalf("Decode() error = %v, want %v", err, tt.wantErrIs)
+				}
+				return
+			} else if tt.wantErr {
+				t.Fatalf("Decode() error = %v, wantErr %v", err, tt.wantErr)
+			} else if msg.GetValue() != "message" {
+				t.Fatalf("Decode() = %v, want %v", msg.GetValue(), "message")
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+// Package qstashtest provides an in-memory qstash server for hermetic tests of publishers and receivers.
+//
+// The server accepts publishes, deduplicates and delays them like qstash does, and signs and
+// forwards them to their destination, retrying messages that are not acknowledged.
+package qstashtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marksalpeter/go-qstash"
+)
+
+// Message states
+const (
+	// StatePending messages are waiting for their delay or their next delivery attempt
+	StatePending = "pending"
+	// StateDelivered messages were acknowledged by their destination
+	StateDelivered = "delivered"
+	// StateFailed messages were not acknowledged after all of their retries
+	StateFailed = "failed"
+	// StateRecorded messages were published to a server without forwarding
+	StateRecorded = "recorded"
+	// StateCanceled messages were canceled before they were delivered
+	StateCanceled = "canceled"
+)
+
+// Message is a message published to the server
+type Message struct {
+	ID          string
+	Destination string
+	Header      http.Header
+	Body        []byte
+	Delay       time.Duration
+	Retries     int
+	State       string
+	// Statuses are the status codes the destination responded with for each delivery attempt
+	Statuses []int
+}
+
+// Server is an in-memory qstash server
+type Server struct {
+	*httptest.Server
+	// Token authenticates publishers. Use it with qstash.WithQStashToken
+	Token string
+	// SigningKey signs the forwarded messages. Use it with qstash.WithSigningKey
+	SigningKey string
+	// NextSigningKey is the next signing key. Use it with qstash.WithNextSigningKey
+	NextSigningKey string
+
+	forward      bool
+	retries      int
+	retryBackOff time.Duration
+	client       *http.Client
+
+	mu            sync.Mutex
+	wg            sync.WaitGroup
+	closed        bool
+	messages      []*Message
+	deduplication map[string]string
+	timers        map[string]*time.Timer
+}
+
+// Option configures the server
+type Option func(*Server)
+
+// WithToken overrides the token publishers must authenticate with. The default is "token"
+func WithToken(token string) Option {
+	return func(s *Server) {
+		s.Token = token
+	}
+}
+
+// WithSigningKeys overrides the signing keys. The default keys are "key" and "next key"
+func WithSigningKeys(signingKey, nextSigningKey string) Option {
+	return func(s *Server) {
+		s.SigningKey = signingKey
+		s.NextSigningKey = nextSigningKey
+	}
+}
+
+// WithoutForwarding records published messages without delivering them to their destination
+func WithoutForwarding() Option {
+	return func(s *Server) {
+		s.forward = false
+	}
+}
+
+// WithRetries overrides the number of retries for messages published without an
+// 'Upstash-Retries' header and the back off between them. The default is 3 retries 10ms apart
+func WithRetries(retries int, backOff time.Duration) Option {
+	return func(s *Server) {
+		s.retries = retries
+		s.retryBackOff = backOff
+	}
+}
+
+// NewServer starts and returns a new in-memory qstash server.
+// The caller should call Close when finished, to shut it down
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		Token:          "token",
+		SigningKey:     "key",
+		NextSigningKey: "next key",
+		forward:        true,
+		retries:        3,
+		retryBackOff:   10 * time.Millisecond,
+		client:         &http.Client{Timeout: 10 * time.Second},
+		deduplication:  make(map[string]string),
+		timers:         make(map[string]*time.Timer),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// PublishURL returns the publish endpoint of the server. Use it with qstash.WithQStashURL
+func (s *Server) PublishURL() string {
+	return s.URL + "/v2/publish"
+}
+
+// Messages returns a snapshot of the messages published to the server in the order they were published
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	messages := make([]Message, 0, len(s.messages))
+	for _, m := range s.messages {
+		messages = append(messages, s.snapshot(m))
+	}
+	return messages
+}
+
+// Message returns a snapshot of the message with the id
+func (s *Server) Message(id string) (Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.messages {
+		if m.ID == id {
+			return s.snapshot(m), true
+		}
+	}
+	return Message{}, false
+}
+
+// Close stops the pending deliveries, waits for the running ones and shuts down the server
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for id, t := range s.timers {
+		if t.Stop() {
+			s.wg.Done()
+		}
+		delete(s.timers, id)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	s.Server.Close()
+}
+
+// serveHTTP routes the qstash api requests
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+s.Token {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/v2/publish/"):
+		s.publish(w, r, strings.TrimPrefix(r.URL.Path, "/v2/publish/"))
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/v2/messages/"):
+		s.cancel(w, strings.TrimPrefix(r.URL.Path, "/v2/messages/"))
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// publish stores the message and schedules its delivery
+func (s *Server) publish(w http.ResponseWriter, r *http.Request, destination string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Parse the message options
+	m := &Message{
+		Destination: destination,
+		Header:      r.Header.Clone(),
+		Body:        body,
+		Retries:     s.retries,
+		State:       StateRecorded,
+	}
+	if v := r.Header.Get("Upstash-Delay"); len(v) > 0 {
+		if m.Delay, err = time.ParseDuration(v); err != nil || m.Delay < 0 {
+			http.Error(w, fmt.Sprintf("invalid delay '%s'", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.Header.Get("Upstash-Retries"); len(v) > 0 {
+		if m.Retries, err = strconv.Atoi(v); err != nil || m.Retries < 0 {
+			http.Error(w, fmt.Sprintf("invalid retries '%s'", v), http.StatusBadRequest)
+			return
+		}
+	}
+	deduplicationID := r.Header.Get("Upstash-Deduplication-Id")
+	if r.Header.Get("Upstash-Content-Based-Deduplication") == "true" {
+		bodyHash := sha256.Sum256(body)
+		deduplicationID = destination + ":" + hex.EncodeToString(bodyHash[:])
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		http.Error(w, "server is closed", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Respond with the original message id to duplicates
+	if id, ok := s.deduplication[deduplicationID]; ok && len(deduplicationID) > 0 {
+		respond(w, map[string]any{"messageId": id, "deduplicated": true})
+		return
+	}
+	m.ID = fmt.Sprintf("msg_%d", len(s.messages))
+	s.messages = append(s.messages, m)
+	if len(deduplicationID) > 0 {
+		s.deduplication[deduplicationID] = m.ID
+	}
+
+	// Schedule the delivery
+	if s.forward {
+		m.State = StatePending
+		s.schedule(m, m.Delay)
+	}
+	respond(w, map[string]any{"messageId": m.ID})
+}
+
+// cancel stops the delivery of a message that is waiting for its delay or its next retry
+func (s *Server) cancel(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.timers[id]
+	if !ok || !t.Stop() {
+		http.Error(w, fmt.Sprintf("message %s not found", id), http.StatusNotFound)
+		return
+	}
+	s.wg.Done()
+	delete(s.timers, id)
+	for _, m := range s.messages {
+		if m.ID == id {
+			m.State = StateCanceled
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// schedule delivers the message after the delay. The caller must hold the lock
+func (s *Server) schedule(m *Message, delay time.Duration) {
+	s.wg.Add(1)
+	s.timers[m.ID] = time.AfterFunc(delay, func() {
+		defer s.wg.Done()
+		s.deliver(m)
+	})
+}
+
+// deliver signs and forwards the message to its destination and retries it if it is not acknowledged
+func (s *Server) deliver(m *Message) {
+	s.mu.Lock()
+	delete(s.timers, m.ID)
+	retried := len(m.Statuses)
+	s.mu.Unlock()
+
+	// Forward the message
+	status := http.StatusBadGateway
+	if req, err := s.newDeliveryRequest(m, retried); err == nil {
+		if rsp, err := s.client.Do(req); err == nil {
+			rsp.Body.Close()
+			status = rsp.StatusCode
+		}
+	}
+
+	// Record the attempt and retry the message
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.Statuses = append(m.Statuses, status)
+	switch {
+	case status >= 200 && status <= 299:
+		m.State = StateDelivered
+	case retried >= m.Retries || s.closed:
+		m.State = StateFailed
+	default:
+		s.schedule(m, s.retryBackOff)
+	}
+}
+
+// newDeliveryRequest creates the signed request that forwards the message to its destination
+func (s *Server) newDeliveryRequest(m *Message, retried int) (*http.Request, error) {
+	signature, err := qstash.GenerateSignature(m.Body, s.SigningKey, "Upstash", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, m.Destination, bytes.NewReader(m.Body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range m.Header {
+		if strings.HasPrefix(strings.ToLower(k), "upstash-forward-") {
+			req.Header[http.CanonicalHeaderKey(k[len("upstash-forward-"):])] = v
+		}
+	}
+	if contentType := m.Header.Get("Content-Type"); len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Upstash-Signature", signature)
+	req.Header.Set("Upstash-Message-Id", m.ID)
+	req.Header.Set("Upstash-Retried", strconv.Itoa(retried))
+	return req, nil
+}
+
+// snapshot copies the message. The caller must hold the lock
+func (s *Server) snapshot(m *Message) Message {
+	c := *m
+	c.Header = m.Header.Clone()
+	c.Body = append([]byte(nil), m.Body...)
+	c.Statuses = append([]int(nil), m.Statuses...)
+	return c
+}
+
+// respond writes the json response body
+func respond(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,253 @@
+package qstashtest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/marksalpeter/go-qstash"
+)
+
+// newReceiver returns a test server that receives the messages signed by s and
+// acknowledges them when ack returns true
+func newReceiver(t *testing.T, s *Server, ack func(m *qstash.Message) bool) *httptest.Server {
+	r, err := qstash.NewReceiver(qstash.WithSigningKey(s.SigningKey), qstash.WithNextSigningKey(s.NextSigningKey))
+	if err != nil {
+		t.Fatalf("qstash.NewReceiver() error = %v", err)
+	}
+	return httptest.NewServer(r.Receive(func(_ context.Context, m *qstash.Message) {
+		if ack(m) {
+			m.Ack()
+		}
+	}))
+}
+
+// newPublisher returns a publisher for the destination that publishes to s
+func newPublisher(t *testing.T, s *Server, destination string) *qstash.Publisher {
+	p, err := qstash.NewPublisher(destination, qstash.WithQStashURL(s.PublishURL()), qstash.WithQStashToken(s.Token))
+	if err != nil {
+		t.Fatalf("qstash.NewPublisher() error = %v", err)
+	}
+	return p
+}
+
+// waitForState waits for the message to reach the state
+func waitForState(t *testing.T, s *Server, id, state string) Message {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(5 * time.Millisecond) {
+		if m, ok := s.Message(id); ok && m.State == state {
+			return m
+		}
+	}
+	m, _ := s.Message(id)
+	t.Fatalf("Server.Message() state = %v, want %v", m.State, state)
+	return m
+}
+
+func TestServer_Publish(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         []Option
+		ack          bool
+		wantState    string
+		wantStatuses []int
+	}{{
+		name:         "Publish delivers an acknowledged message",
+		ack:          true,
+		wantState:    StateDelivered,
+		wantStatuses: []int{http.StatusOK},
+	}, {
+		name:         "Publish retries an unacknowledged message",
+		opts:         []Option{WithRetries(2, time.Millisecond)},
+		wantState:    StateFailed,
+		wantStatuses: []int{http.StatusUnprocessableEntity, http.StatusUnprocessableEntity, http.StatusUnprocessableEntity},
+	}, {
+		name:      "Publish records the message without forwarding",
+		opts:      []Option{WithoutForwarding()},
+		ack:       true,
+		wantState: StateRecorded,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(tt.opts...)
+			defer s.Close()
+			received := make(chan qstash.Message, 10)
+			receiver := newReceiver(t, s, func(m *qstash.Message) bool {
+				received <- *m
+				return tt.ack
+			})
+			defer receiver.Close()
+
+			// Publish the message
+			p := newPublisher(t, s, receiver.URL)
+			m := qstash.Message{
+				Headers: http.Header{"Upstash-Forward-Event-Type": []string{"created"}},
+				Body:    []byte("message"),
+			}
+			if err := p.Publish(context.Background(), &m); err != nil {
+				t.Fatalf("Publisher.Publish() error = %v", err)
+			}
+			got := waitForState(t, s, m.ID, tt.wantState)
+			if len(got.Statuses) != len(tt.wantStatuses) {
+				t.Fatalf("Server.Message() statuses = %v, want %v", got.Statuses, tt.wantStatuses)
+			}
+			for i := range got.Statuses {
+				if got.Statuses[i] != tt.wantStatuses[i] {
+					t.Fatalf("Server.Message() statuses = %v, want %v", got.Statuses, tt.wantStatuses)
+				}
+			}
+
+			// Check the delivered message
+			if len(tt.wantStatuses) == 0 {
+				return
+			}
+			r := <-received
+			if r.ID != m.ID {
+				t.Fatalf("Receiver.Receive() id = %v, want %v", r.ID, m.ID)
+			} else if string(r.Body) != "message" {
+				t.Fatalf("Receiver.Receive() body = %s, want %s", r.Body, "message")
+			} else if r.EventType() != "created" {
+				t.Fatalf("Receiver.Receive() event type = %v, want %v", r.EventType(), "created")
+			}
+		})
+	}
+}
+
+func TestServer_PublishDeduplication(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         [2][]qstash.PublishOption
+		bodies       [2]string
+		wantMessages int
+	}{{
+		name:         "Publish deduplicates the deduplication id",
+		opts:         [2][]qstash.PublishOption{{qstash.WithDeduplicationID("id")}, {qstash.WithDeduplicationID("id")}},
+		bodies:       [2]string{"message", "other message"},
+		wantMessages: 1,
+	}, {
+		name:         "Publish deduplicates the content",
+		opts:         [2][]qstash.PublishOption{{qstash.WithContentBasedDeduplication()}, {qstash.WithContentBasedDeduplication()}},
+		bodies:       [2]string{"message", "message"},
+		wantMessages: 1,
+	}, {
+		name:         "Publish does not deduplicate different content",
+		opts:         [2][]qstash.PublishOption{{qstash.WithContentBasedDeduplication()}, {qstash.WithContentBasedDeduplication()}},
+		bodies:       [2]string{"message", "other message"},
+		wantMessages: 2,
+	}, {
+		name:         "Publish does not deduplicate generated ids",
+		bodies:       [2]string{"message", "message"},
+		wantMessages: 2,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(WithoutForwarding())
+			defer s.Close()
+			p := newPublisher(t, s, "https://example.com")
+			var ids [2]string
+			for i := range tt.bodies {
+				m := qstash.Message{Body: []byte(tt.bodies[i])}
+				if err := p.Publish(context.Background(), &m, tt.opts[i]...); err != nil {
+					t.Fatalf("Publisher.Publish() error = %v", err)
+				}
+				ids[i] = m.ID
+			}
+			if got := len(s.Messages()); got != tt.wantMessages {
+				t.Fatalf("Server.Messages() = %v, want %v messages", got, tt.wantMessages)
+			} else if deduplicated := ids[0] == ids[1]; deduplicated != (tt.wantMessages == 1) {
+				t.Fatalf("Publisher.Publish() ids = %v, want deduplicated %v", ids, tt.wantMessages == 1)
+			}
+		})
+	}
+}
+
+func TestServer_PublishDelay(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	receiver := newReceiver(t, s, func(*qstash.Message) bool { return true })
+	defer receiver.Close()
+
+	// Publish a delayed message
+	p := newPublisher(t, s, receiver.URL)
+	m := qstash.Message{Body: []byte("message")}
+	start := time.Now()
+	if err := p.PublishWithDelay(context.Background(), &m, time.Second); err != nil {
+		t.Fatalf("Publisher.PublishWithDelay() error = %v", err)
+	}
+	if got, _ := s.Message(m.ID); got.State != StatePending {
+		t.Fatalf("Server.Message() state = %v, want %v", got.State, StatePending)
+	} else if got.Delay != time.Second {
+		t.Fatalf("Server.Message() delay = %v, want %v", got.Delay, time.Second)
+	}
+	waitForState(t, s, m.ID, StateDelivered)
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("Server.Message() delivered after %v, want at least %v", elapsed, time.Second)
+	}
+}
+
+func TestServer_PublishUnauthorized(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	p, err := qstash.NewPublisher("https://example.com",
+		qstash.WithQStashURL(s.PublishURL()),
+		qstash.WithQStashToken("wrong"),
+		qstash.WithClientRetries(0),
+	)
+	if err != nil {
+		t.Fatalf("qstash.NewPublisher() error = %v", err)
+	}
+	if err := p.Publish(context.Background(), &qstash.Message{Body: []byte("message")}); err == nil {
+		t.Fatalf("Publisher.Publish() error = %v, want unauthorized", err)
+	} else if len(s.Messages()) != 0 {
+		t.Fatalf("Server.Messages() = %v, want none", s.Messages())
+	}
+}
+
+func TestServer_Cancel(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	received := make(chan qstash.Message, 1)
+	receiver := newReceiver(t, s, func(m *qstash.Message) bool {
+		received <- *m
+		return true
+	})
+	defer receiver.Close()
+
+	// Publish a delayed message
+	p, err := qstash.NewPublisher(receiver.URL,
+		qstash.WithQStashURL(s.PublishURL()),
+		qstash.WithQStashToken(s.Token),
+		qstash.WithClientRetries(0),
+	)
+	if err != nil {
+		t.Fatalf("qstash.NewPublisher() error = %v", err)
+	}
+	res, err := p.PublishWithResult(context.Background(), &qstash.Message{Body: []byte("message")}, qstash.WithDelay(time.Minute))
+	if err != nil {
+		t.Fatalf("Publisher.PublishWithResult() error = %v", err)
+	} else if len(res.MessageID) == 0 {
+		t.Fatalf("Publisher.PublishWithResult() message id is empty")
+	}
+
+	// Cancel it before it is delivered
+	if err := p.Messages().Cancel(context.Background(), res.MessageID); err != nil {
+		t.Fatalf("Messages.Cancel() error = %v", err)
+	} else if m, _ := s.Message(res.MessageID); m.State != StateCanceled {
+		t.Fatalf("Server.Message() state = %v, want %v", m.State, StateCanceled)
+	} else if err := p.Messages().Cancel(context.Background(), res.MessageID); !errors.Is(err, qstash.ErrMessageNotFound) {
+		t.Fatalf("Messages.Cancel() error = %v, want %v", err, qstash.ErrMessageNotFound)
+	}
+
+	// Delivered messages can not be canceled
+	m := qstash.Message{Body: []byte("message")}
+	if err := p.Publish(context.Background(), &m); err != nil {
+		t.Fatalf("Publisher.Publish() error = %v", err)
+	}
+	<-received
+	waitForState(t, s, m.ID, StateDelivered)
+	if err := p.Messages().Cancel(context.Background(), m.ID); !errors.Is(err, qstash.ErrMessageNotFound) {
+		t.Fatalf("Messages.Cancel() error = %v, want %v", err, qstash.ErrMessageNotFound)
+	}
+}
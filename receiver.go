@@ -1,13 +1,16 @@
 package qstash
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
@@ -15,8 +18,26 @@ import (
 
 // Receiver generates [http.Handler]s that receive and verify qstash messages from a lambda function
 type Receiver struct {
-	signingKey     string
-	nextSigningKey string
+	signingKey           string
+	nextSigningKey       string
+	signatureHeader      string
+	maxMessageSize       int
+	maxRetries           int
+	maxMessageAge        time.Duration
+	onLastAttempt        func(ctx context.Context, m *Message)
+	handlerTimeout       time.Duration
+	stopAfter            context.Context
+	expectedIssuer       string
+	expectedAudience     string
+	metrics              ReceiverMetrics
+	tracer               Tracer
+	requireTLS           bool
+	forwardedProtoHeader string
+	verifier             Verifier
+	bodyStore            BodyStore
+	onVerifyFailure      func(r *http.Request, err error)
+	unacknowledgedStatus int
+	unacknowledgedBody   string
 }
 
 // NewReceiver returns a new QStash Receiver
@@ -26,56 +47,243 @@ func NewReceiver(opts ...ReceiverOption) (*Receiver, error) {
 	if err := os.apply(opts...); err != nil {
 		return nil, fmt.Errorf("receiver is missing config: %w", err)
 	}
-	return &Receiver{
-		signingKey:     os.SigningKey,
-		nextSigningKey: os.NextSigningKey,
-	}, nil
+	q := &Receiver{
+		signingKey:           os.SigningKey,
+		nextSigningKey:       os.NextSigningKey,
+		signatureHeader:      os.SignatureHeader,
+		maxMessageSize:       os.MaxMessageSize,
+		maxRetries:           os.MaxRetries,
+		maxMessageAge:        os.MaxMessageAge,
+		onLastAttempt:        os.OnLastAttempt,
+		handlerTimeout:       os.HandlerTimeout,
+		stopAfter:            os.StopAfter,
+		expectedIssuer:       os.ExpectedIssuer,
+		expectedAudience:     os.ExpectedAudience,
+		metrics:              os.Metrics,
+		tracer:               os.Tracer,
+		requireTLS:           os.RequireTLS,
+		forwardedProtoHeader: os.ForwardedProtoHeader,
+		verifier:             os.Verifier,
+		bodyStore:            os.BodyStore,
+		onVerifyFailure:      os.OnVerifyFailure,
+		unacknowledgedStatus: os.Unacknowledged.StatusCode,
+		unacknowledgedBody:   os.Unacknowledged.Body,
+	}
+	if os.insecureSkipVerify() {
+		q.verifier = VerifierFunc(skipVerify)
+	} else if q.verifier == nil {
+		q.verifier = VerifierFunc(q.verifySignature)
+	}
+	return q, nil
+}
+
+// KeyFingerprints returns short sha-256 fingerprints of the current and next signing keys,
+// e.g. to check that a key rotation has reached every receiver without exposing the keys.
+// The fingerprint of a key that is not configured is empty
+func (q *Receiver) KeyFingerprints() (current, next string) {
+	return keyFingerprint(q.signingKey), keyFingerprint(q.nextSigningKey)
+}
+
+// keyFingerprint returns the first 8 bytes of the sha-256 hash of the key in hex
+func keyFingerprint(key string) string {
+	if len(key) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
 }
 
 // Receive receives a message from the QStash
 // Note: you must call ack or nack on the message for the request to complete
 func (q *Receiver) Receive(onReceive func(ctx context.Context, m *Message)) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Read the body
-		body, err := io.ReadAll(r.Body)
-		r.Body.Close()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		// Verify the signature
-		tokenString := r.Header.Get("Upstash-Signature")
-		if err := q.verify(body, tokenString, q.signingKey); err != nil {
-			// Try the next signing key
-			if err := q.verify(body, tokenString, q.nextSigningKey); err != nil {
-				http.Error(w, err.Error(), http.StatusUnauthorized)
-				return
-			}
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+		w, r, done := q.observe(w, r)
+		defer done()
+		// Parse and verify the message
+		m, ok := q.parse(w, r)
+		if !ok {
 			return
 		}
-		// Parse the message
-		var m Message
-		m.ID = r.Header.Get("Upstash-Message-Id")
-		m.Headers = r.Header
-		m.Body = body
-		m.Retried, _ = strconv.Atoi(r.Header.Get("Upstash-Retried"))
-		m.w = w
+		ctx, cancel := q.prepare(r.Context(), m)
+		defer cancel()
 		// Call the receiver
 		if onReceive != nil {
-			onReceive(r.Context(), &m)
+			start := time.Now()
+			onReceive(ctx, m)
+			q.observeHandlerLatency(time.Since(start))
 		}
 		// Retry unacknowledged messages
 		if !m.isAcknowledged {
-			http.Error(w, "message was not acknowledged by the receiver", http.StatusUnprocessableEntity)
+			body := q.unacknowledgedBody
+			if m.err != nil {
+				body = fmt.Sprintf("%s: %v", body, m.err)
+			}
+			http.Error(w, body, q.unacknowledgedStatus)
+			return
+		}
+	})
+}
+
+// ReceiveAck receives a message from the QStash and acknowledges it for the handler.
+// The message is acked when onReceive returns nil and is not acknowledged, so that
+// qstash retries it, when onReceive returns an error. The error is added to the
+// unacknowledged response body, so that it shows up in the qstash logs
+func (q *Receiver) ReceiveAck(onReceive func(ctx context.Context, m *Message) error) http.Handler {
+	return q.Receive(func(ctx context.Context, m *Message) {
+		if err := onReceive(ctx, m); err != nil {
+			m.err = err
+			return
+		}
+		m.Ack()
+	})
+}
+
+// Wrap verifies qstash messages before passing them on to an existing http handler.
+// The verified body is available to the handler as the request body. The response
+// of the handler is returned to qstash, so a 2xx acknowledges the message and any
+// other status code will cause the message to be retried
+func (q *Receiver) Wrap(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w, r, done := q.observe(w, r)
+		defer done()
+		// Parse and verify the message
+		m, ok := q.parse(w, r)
+		if !ok {
 			return
 		}
+		ctx, cancel := q.prepare(r.Context(), m)
+		defer cancel()
+		// Call the handler with the verified body
+		r = r.WithContext(ctx)
+		r.Body = io.NopCloser(bytes.NewReader(m.Body))
+		r.ContentLength = int64(len(m.Body))
+		start := time.Now()
+		next(w, r)
+		q.observeHandlerLatency(time.Since(start))
 	})
 }
 
-// verify verifies the body of a signed qstash request
-func (q *Receiver) verify(body []byte, tokenString, signingKey string) error {
+// parse reads and verifies a qstash request and parses it into a message.
+// If the request is rejected, parse responds to it and returns false
+func (q *Receiver) parse(w http.ResponseWriter, r *http.Request) (*Message, bool) {
+	// Reject new messages once the receiver has stopped
+	if q.stopAfter != nil && q.stopAfter.Err() != nil {
+		http.Error(w, "receiver has stopped accepting messages", http.StatusServiceUnavailable)
+		return nil, false
+	}
+
+	// Reject plaintext requests
+	if q.requireTLS && !q.isTLS(r) {
+		http.Error(w, "https is required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	// Read the body
+	var reader io.Reader = r.Body
+	if q.maxMessageSize > 0 {
+		reader = io.LimitReader(r.Body, int64(q.maxMessageSize)+1)
+	}
+	body, err := io.ReadAll(reader)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	} else if q.maxMessageSize > 0 && len(body) > q.maxMessageSize {
+		http.Error(w, fmt.Sprintf("message is larger than %d bytes", q.maxMessageSize), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+
+	// Verify the signature
+	claims, err := q.verifier.Verify(r, body)
+	if err != nil {
+		if q.metrics != nil {
+			q.metrics.IncVerifyFailure()
+		}
+		if q.onVerifyFailure != nil {
+			q.onVerifyFailure(r, err)
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	// Parse the message
+	var m Message
+	m.ID = r.Header.Get("Upstash-Message-Id")
+	m.Headers = r.Header
+	m.Body = body
+	m.claims = claims
+	m.signature = r.Header.Get(q.signatureHeader)
+	m.Retried, _ = strconv.Atoi(r.Header.Get("Upstash-Retried"))
+	m.w = w
+
+	// Drop stale messages
+	if publishedAt, ok := m.PublishedAt(); ok && q.maxMessageAge > 0 && time.Since(publishedAt) > q.maxMessageAge {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "message is older than %s and was dropped", q.maxMessageAge)
+		return nil, false
+	}
+
+	// Decode the body of a batched message and get the body of a message that was offloaded to the body store
+	if err := decodeBody(&m); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	} else if err := q.rehydrateBody(r.Context(), &m); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return &m, true
+}
+
+// isTLS returns true if the request was received over tls or forwarded from https by a proxy
+func (q *Receiver) isTLS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	} else if len(q.forwardedProtoHeader) == 0 {
+		return false
+	}
+	return strings.EqualFold(r.Header.Get(q.forwardedProtoHeader), "https")
+}
+
+// observe records the response status code with the receiver metrics and
+// ends the receive span when done is called
+func (q *Receiver) observe(w http.ResponseWriter, r *http.Request) (_ http.ResponseWriter, _ *http.Request, done func()) {
+	if q.metrics == nil && q.tracer == nil {
+		return w, r, func() {}
+	}
+	ctx, endSpan := q.traceReceive(r)
+	sw := &statusWriter{ResponseWriter: w}
+	return sw, r.WithContext(ctx), func() {
+		if q.metrics != nil {
+			q.metrics.IncReceive(sw.Status())
+		}
+		endSpan(sw.Status())
+	}
+}
+
+// observeHandlerLatency records the duration of the handler with the receiver metrics
+func (q *Receiver) observeHandlerLatency(d time.Duration) {
+	if q.metrics != nil {
+		q.metrics.ObserveHandlerLatency(d)
+	}
+}
+
+// prepare bounds the handler context by the handler timeout and
+// calls the last attempt hook before the message is handled
+func (q *Receiver) prepare(ctx context.Context, m *Message) (context.Context, context.CancelFunc) {
+	// Bound the handler by the handler timeout
+	cancel := func() {}
+	if q.handlerTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, q.handlerTimeout)
+	}
+	m.deadline, m.hasDeadline = ctx.Deadline()
+	// Give the last attempt a chance to persist the message
+	if q.onLastAttempt != nil && m.Retried >= q.maxRetries {
+		q.onLastAttempt(ctx, m)
+	}
+	return ctx, cancel
+}
+
+// verify verifies the body of a signed qstash request and returns the jwt claims
+func (q *Receiver) verify(body []byte, tokenString, signingKey string) (jwt.MapClaims, error) {
 	// Parse the JWT
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -84,22 +292,48 @@ func (q *Receiver) verify(body []byte, tokenString, signingKey string) error {
 		return []byte(signingKey), nil
 	})
 	if err != nil {
-		return fmt.Errorf("could not parse jwt: %w", err)
+		return nil, fmt.Errorf("could not parse jwt: %w", err)
 	}
 	// Validate the claims
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok || !token.Valid {
-		return fmt.Errorf("could not jwt process token claims")
-	} else if !claims.VerifyIssuer("Upstash", true) {
-		return fmt.Errorf("invalid issuer")
+		return nil, fmt.Errorf("could not jwt process token claims")
+	} else if !claims.VerifyIssuer(q.expectedIssuer, true) {
+		return nil, fmt.Errorf("invalid issuer")
+	} else if len(q.expectedAudience) > 0 && !claims.VerifyAudience(q.expectedAudience, true) {
+		return nil, fmt.Errorf("invalid audience")
 	} else if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
-		return fmt.Errorf("token has expired")
+		return nil, fmt.Errorf("token has expired")
 	} else if !claims.VerifyNotBefore(time.Now().Unix(), true) {
-		return fmt.Errorf("token is not valid yet")
+		return nil, fmt.Errorf("token is not valid yet")
 	}
 	bodyHash := sha256.Sum256(body)
 	if claims["body"] != base64.URLEncoding.EncodeToString(bodyHash[:]) {
-		return fmt.Errorf("body hash does not match")
+		return nil, fmt.Errorf("body hash does not match")
+	}
+	return claims, nil
+}
+
+// GenerateSignature generates a signed 'Upstash-Signature' jwt for the body.
+// It is the counterpart to the receiver's verification and is useful for building test fixtures.
+func GenerateSignature(body []byte, signingKey, issuer string, ttl time.Duration) (string, error) {
+	if signingKey == "" {
+		return "", fmt.Errorf("signing key is required")
+	} else if ttl <= 0 {
+		return "", fmt.Errorf("ttl must be greater than 0")
+	}
+	now := time.Now()
+	bodyHash := sha256.Sum256(body)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss":  issuer,
+		"iat":  now.Unix(),
+		"nbf":  now.Unix(),
+		"exp":  now.Add(ttl).Unix(),
+		"body": base64.URLEncoding.EncodeToString(bodyHash[:]),
+	})
+	tokenString, err := token.SignedString([]byte(signingKey))
+	if err != nil {
+		return "", fmt.Errorf("could not sign jwt: %w", err)
 	}
-	return nil
+	return tokenString, nil
 }
@@ -0,0 +1,937 @@
+package qstash
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestGenerateSignature(t *testing.T) {
+	type args struct {
+		body       []byte
+		signingKey string
+		issuer     string
+		ttl        time.Duration
+	}
+	tests := []struct {
+		name          string
+		args          args
+		verifyBody    []byte
+		verifyKey     string
+		wantErr       bool
+		wantVerifyErr bool
+	}{{
+		name: "Generated signature is verified",
+		args: args{
+			body:       []byte("message"),
+			signingKey: "key",
+			issuer:     "Upstash",
+			ttl:        time.Minute,
+		},
+		verifyBody: []byte("message"),
+		verifyKey:  "key",
+	}, {
+		name: "Generated signature fails with a different body",
+		args: args{
+			body:       []byte("message"),
+			signingKey: "key",
+			issuer:     "Upstash",
+			ttl:        time.Minute,
+		},
+		verifyBody:    []byte("other message"),
+		verifyKey:     "key",
+		wantVerifyErr: true,
+	}, {
+		name: "Generated signature fails with a different key",
+		args: args{
+			body:       []byte("message"),
+			signingKey: "key",
+			issuer:     "Upstash",
+			ttl:        time.Minute,
+		},
+		verifyBody:    []byte("message"),
+		verifyKey:     "other key",
+		wantVerifyErr: true,
+	}, {
+		name: "Generated signature fails with a different issuer",
+		args: args{
+			body:       []byte("message"),
+			signingKey: "key",
+			issuer:     "Someone",
+			ttl:        time.Minute,
+		},
+		verifyBody:    []byte("message"),
+		verifyKey:     "key",
+		wantVerifyErr: true,
+	}, {
+		name: "Generate signature without a key fails",
+		args: args{
+			body:   []byte("message"),
+			issuer: "Upstash",
+			ttl:    time.Minute,
+		},
+		wantErr: true,
+	}, {
+		name: "Generate signature without a ttl fails",
+		args: args{
+			body:       []byte("message"),
+			signingKey: "key",
+			issuer:     "Upstash",
+		},
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := GenerateSignature(tt.args.body, tt.args.signingKey, tt.args.issuer, tt.args.ttl)
+			if err != nil {
+				if !tt.wantErr {
+					t.Fatalf("GenerateSignature() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				return
+			} else if tt.wantErr {
+				t.Fatalf("GenerateSignature() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			q := Receiver{expectedIssuer: "Upstash"}
+			if _, err := q.verify(tt.verifyBody, token, tt.verifyKey); (err != nil) != tt.wantVerifyErr {
+				t.Fatalf("Receiver.verify() error = %v, wantVerifyErr %v", err, tt.wantVerifyErr)
+			}
+		})
+	}
+}
+
+func TestReceiver_Receive(t *testing.T) {
+	type args struct {
+		opts       []ReceiverOption
+		header     string
+		signingKey string
+		issuer     string
+		body       []byte
+		onReceive  func(ctx context.Context, m *Message)
+	}
+	ack := func(_ context.Context, m *Message) {
+		m.Ack()
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantStatus int
+		wantBody   string
+	}{{
+		name: "Receive a signed message",
+		args: args{
+			header:     "Upstash-Signature",
+			signingKey: "key",
+			body:       []byte("message"),
+			onReceive:  ack,
+		},
+		wantStatus: http.StatusOK,
+	}, {
+		name: "Receive an unacknowledged message",
+		args: args{
+			header:     "Upstash-Signature",
+			signingKey: "key",
+			body:       []byte("message"),
+			onReceive:  func(context.Context, *Message) {},
+		},
+		wantStatus: http.StatusUnprocessableEntity,
+	}, {
+		name: "Receive a message signed with the next signing key",
+		args: args{
+			header:     "Upstash-Signature",
+			signingKey: "next key",
+			body:       []byte("message"),
+			onReceive:  ack,
+		},
+		wantStatus: http.StatusOK,
+	}, {
+		name: "Receive a message with a bad signature fails",
+		args: args{
+			header:     "Upstash-Signature",
+			signingKey: "bad key",
+			body:       []byte("message"),
+			onReceive:  ack,
+		},
+		wantStatus: http.StatusUnauthorized,
+	}, {
+		name: "Receive a message with a renamed signature header",
+		args: args{
+			opts: []ReceiverOption{
+				WithSignatureHeader("X-Proxied-Signature"),
+			},
+			header:     "X-Proxied-Signature",
+			signingKey: "key",
+			body:       []byte("message"),
+			onReceive:  ack,
+		},
+		wantStatus: http.StatusOK,
+	}, {
+		name: "Receive a message without the renamed signature header fails",
+		args: args{
+			opts: []ReceiverOption{
+				WithSignatureHeader("X-Proxied-Signature"),
+			},
+			header:     "Upstash-Signature",
+			signingKey: "key",
+			body:       []byte("message"),
+			onReceive:  ack,
+		},
+		wantStatus: http.StatusUnauthorized,
+	}, {
+		name: "Receive a message from a custom issuer",
+		args: args{
+			opts: []ReceiverOption{
+				WithExpectedIssuer("Gateway"),
+			},
+			header:     "Upstash-Signature",
+			signingKey: "key",
+			issuer:     "Gateway",
+			body:       []byte("message"),
+			onReceive:  ack,
+		},
+		wantStatus: http.StatusOK,
+	}, {
+		name: "Receive a message from a custom issuer without expecting it fails",
+		args: args{
+			header:     "Upstash-Signature",
+			signingKey: "key",
+			issuer:     "Gateway",
+			body:       []byte("message"),
+			onReceive:  ack,
+		},
+		wantStatus: http.StatusUnauthorized,
+	}, {
+		name: "Receive a message from upstash when expecting a custom issuer fails",
+		args: args{
+			opts: []ReceiverOption{
+				WithExpectedIssuer("Gateway"),
+			},
+			header:     "Upstash-Signature",
+			signingKey: "key",
+			body:       []byte("message"),
+			onReceive:  ack,
+		},
+		wantStatus: http.StatusUnauthorized,
+	}, {
+		name: "Receive a message under the max message size",
+		args: args{
+			opts: []ReceiverOption{
+				WithMaxMessageSize(7),
+			},
+			header:     "Upstash-Signature",
+			signingKey: "key",
+			body:       []byte("message"),
+			onReceive: func(_ context.Context, m *Message) {
+				if m.Size() == 7 {
+					m.Ack()
+				}
+			},
+		},
+		wantStatus: http.StatusOK,
+	}, {
+		name: "Receive a message over the max message size fails",
+		args: args{
+			opts: []ReceiverOption{
+				WithMaxMessageSize(6),
+			},
+			header:     "Upstash-Signature",
+			signingKey: "key",
+			body:       []byte("message"),
+			onReceive:  ack,
+		},
+		wantStatus: http.StatusRequestEntityTooLarge,
+	}, {
+		name: "Receive an unacknowledged message with a custom response",
+		args: args{
+			opts: []ReceiverOption{
+				WithUnacknowledgedResponse(http.StatusInternalServerError, "retry later"),
+			},
+			header:     "Upstash-Signature",
+			signingKey: "key",
+			body:       []byte("message"),
+			onReceive:  func(context.Context, *Message) {},
+		},
+		wantStatus: http.StatusInternalServerError,
+		wantBody:   "retry later\n",
+	}, {
+		name: "Receive an unacknowledged message with the default response",
+		args: args{
+			header:     "Upstash-Signature",
+			signingKey: "key",
+			body:       []byte("message"),
+			onReceive:  func(context.Context, *Message) {},
+		},
+		wantStatus: http.StatusUnprocessableEntity,
+		wantBody:   "message was not acknowledged by the receiver\n",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewReceiver(append([]ReceiverOption{
+				WithSigningKey("key"),
+				WithNextSigningKey("next key"),
+			}, tt.args.opts...)...)
+			if err != nil {
+				t.Fatalf("NewReceiver() error = %v", err)
+			}
+			issuer := tt.args.issuer
+			if issuer == "" {
+				issuer = "Upstash"
+			}
+			signature, err := GenerateSignature(tt.args.body, tt.args.signingKey, issuer, time.Minute)
+			if err != nil {
+				t.Fatalf("GenerateSignature() error = %v", err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(tt.args.body))
+			r.Header.Set(tt.args.header, signature)
+			w := httptest.NewRecorder()
+			q.Receive(tt.args.onReceive).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Receiver.Receive() status = %v, want %v", w.Code, tt.wantStatus)
+			} else if len(tt.wantBody) > 0 && w.Body.String() != tt.wantBody {
+				t.Fatalf("Receiver.Receive() body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestReceiver_ReceiveOnLastAttempt(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries int
+		retried    string
+		wantCalled bool
+	}{{
+		name:       "First attempt",
+		maxRetries: 3,
+		retried:    "0",
+	}, {
+		name:       "Retried attempt",
+		maxRetries: 3,
+		retried:    "2",
+	}, {
+		name:       "Last attempt",
+		maxRetries: 3,
+		retried:    "3",
+		wantCalled: true,
+	}, {
+		name:       "Only attempt",
+		maxRetries: 0,
+		retried:    "0",
+		wantCalled: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called, calledBeforeReceive bool
+			q, err := NewReceiver(
+				WithSigningKey("key"),
+				WithNextSigningKey("next key"),
+				WithMaxRetries(tt.maxRetries),
+				WithOnLastAttempt(func(context.Context, *Message) {
+					called = true
+				}),
+			)
+			if err != nil {
+				t.Fatalf("NewReceiver() error = %v", err)
+			}
+			signature, err := GenerateSignature([]byte("message"), "key", "Upstash", time.Minute)
+			if err != nil {
+				t.Fatalf("GenerateSignature() error = %v", err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("message")))
+			r.Header.Set("Upstash-Signature", signature)
+			r.Header.Set("Upstash-Retried", tt.retried)
+			w := httptest.NewRecorder()
+			q.Receive(func(_ context.Context, m *Message) {
+				calledBeforeReceive = called
+				m.Ack()
+			}).ServeHTTP(w, r)
+			if called != tt.wantCalled {
+				t.Fatalf("Receiver.Receive() on last attempt called = %v, want %v", called, tt.wantCalled)
+			} else if called && !calledBeforeReceive {
+				t.Fatalf("Receiver.Receive() on last attempt was not called before the receiver")
+			}
+		})
+	}
+}
+
+func TestReceiver_ReceiveDeadline(t *testing.T) {
+	tests := []struct {
+		name           string
+		handlerTimeout time.Duration
+		wantDeadline   bool
+	}{{
+		name: "Receive without a handler timeout",
+	}, {
+		name:           "Receive with a handler timeout",
+		handlerTimeout: time.Minute,
+		wantDeadline:   true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewReceiver(
+				WithSigningKey("key"),
+				WithNextSigningKey("next key"),
+				WithHandlerTimeout(tt.handlerTimeout),
+			)
+			if err != nil {
+				t.Fatalf("NewReceiver() error = %v", err)
+			}
+			signature, err := GenerateSignature([]byte("message"), "key", "Upstash", time.Minute)
+			if err != nil {
+				t.Fatalf("GenerateSignature() error = %v", err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("message")))
+			r.Header.Set("Upstash-Signature", signature)
+			w := httptest.NewRecorder()
+			start := time.Now()
+			q.Receive(func(ctx context.Context, m *Message) {
+				deadline, ok := m.Deadline()
+				if ok != tt.wantDeadline {
+					t.Errorf("Message.Deadline() ok = %v, want %v", ok, tt.wantDeadline)
+				} else if !ok {
+					return
+				}
+				if ctxDeadline, _ := ctx.Deadline(); !deadline.Equal(ctxDeadline) {
+					t.Errorf("Message.Deadline() = %v, want the context deadline %v", deadline, ctxDeadline)
+				} else if deadline.Before(start.Add(tt.handlerTimeout)) || deadline.After(time.Now().Add(tt.handlerTimeout)) {
+					t.Errorf("Message.Deadline() = %v, want %v from now", deadline, tt.handlerTimeout)
+				}
+			}).ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestReceiver_ReceiveStopAfter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q, err := NewReceiver(
+		WithSigningKey("key"),
+		WithNextSigningKey("next key"),
+		WithStopAfter(ctx),
+	)
+	if err != nil {
+		t.Fatalf("NewReceiver() error = %v", err)
+	}
+	signature, err := GenerateSignature([]byte("message"), "key", "Upstash", time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateSignature() error = %v", err)
+	}
+	var received int
+	h := q.Receive(func(_ context.Context, m *Message) {
+		received++
+		m.Ack()
+	})
+	for _, tt := range []struct {
+		name       string
+		cancel     bool
+		wantStatus int
+		wantCalls  int
+	}{{
+		name:       "Receive before the context is done",
+		wantStatus: http.StatusOK,
+		wantCalls:  1,
+	}, {
+		name:       "Receive after the context is done",
+		cancel:     true,
+		wantStatus: http.StatusServiceUnavailable,
+		wantCalls:  1,
+	}} {
+		if tt.cancel {
+			cancel()
+		}
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("message")))
+		r.Header.Set("Upstash-Signature", signature)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.wantStatus {
+			t.Fatalf("%s: Receiver.Receive() status = %v, want %v", tt.name, w.Code, tt.wantStatus)
+		} else if received != tt.wantCalls {
+			t.Fatalf("%s: Receiver.Receive() handler calls = %v, want %v", tt.name, received, tt.wantCalls)
+		}
+	}
+}
+
+func TestReceiver_ReceiveSignature(t *testing.T) {
+	tests := []struct {
+		name            string
+		signatureHeader string
+	}{{
+		name:            "Receive with the default signature header",
+		signatureHeader: "Upstash-Signature",
+	}, {
+		name:            "Receive with a custom signature header",
+		signatureHeader: "X-Gateway-Signature",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewReceiver(
+				WithSigningKey("key"),
+				WithNextSigningKey("next key"),
+				WithSignatureHeader(tt.signatureHeader),
+			)
+			if err != nil {
+				t.Fatalf("NewReceiver() error = %v", err)
+			}
+			signature, err := GenerateSignature([]byte("message"), "key", "Upstash", time.Minute)
+			if err != nil {
+				t.Fatalf("GenerateSignature() error = %v", err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("message")))
+			r.Header.Set(tt.signatureHeader, signature)
+			w := httptest.NewRecorder()
+			var got string
+			q.Receive(func(ctx context.Context, m *Message) {
+				got = m.Signature()
+				m.Ack()
+			}).ServeHTTP(w, r)
+			if got != signature {
+				t.Fatalf("Message.Signature() = %v, want %v", got, signature)
+			}
+		})
+	}
+}
+
+func TestReceiver_ReceiveAck(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantBody   string
+	}{{
+		name:       "Receive acks a handled message",
+		wantStatus: http.StatusOK,
+	}, {
+		name:       "Receive nacks a message that failed",
+		err:        errors.New("could not handle message"),
+		wantStatus: http.StatusUnprocessableEntity,
+		wantBody:   "message was not acknowledged by the receiver: could not handle message\n",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewReceiver(WithSigningKey("key"), WithNextSigningKey("next key"))
+			if err != nil {
+				t.Fatalf("NewReceiver() error = %v", err)
+			}
+			signature, err := GenerateSignature([]byte("message"), "key", "Upstash", time.Minute)
+			if err != nil {
+				t.Fatalf("GenerateSignature() error = %v", err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("message")))
+			r.Header.Set("Upstash-Signature", signature)
+			w := httptest.NewRecorder()
+			var got string
+			q.ReceiveAck(func(ctx context.Context, m *Message) error {
+				got = string(m.Body)
+				return tt.err
+			}).ServeHTTP(w, r)
+			if got != "message" {
+				t.Fatalf("Receiver.ReceiveAck() body = %v, want %v", got, "message")
+			} else if w.Code != tt.wantStatus {
+				t.Fatalf("Receiver.ReceiveAck() status = %v, want %v", w.Code, tt.wantStatus)
+			} else if w.Body.String() != tt.wantBody {
+				t.Fatalf("Receiver.ReceiveAck() response body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestReceiver_KeyFingerprints(t *testing.T) {
+	q, err := NewReceiver(WithSigningKey("key"), WithNextSigningKey("next key"))
+	if err != nil {
+		t.Fatalf("NewReceiver() error = %v", err)
+	}
+	current, next := q.KeyFingerprints()
+	if current != "2c70e12b7a0646f9" {
+		t.Fatalf("Receiver.KeyFingerprints() current = %v, want %v", current, "2c70e12b7a0646f9")
+	} else if next != "07ada736740eb213" {
+		t.Fatalf("Receiver.KeyFingerprints() next = %v, want %v", next, "07ada736740eb213")
+	} else if strings.Contains(current, "key") || strings.Contains(next, "key") {
+		t.Fatalf("Receiver.KeyFingerprints() = %v, %v, exposes the keys", current, next)
+	}
+	if again, _ := q.KeyFingerprints(); again != current {
+		t.Fatalf("Receiver.KeyFingerprints() current = %v, want the stable %v", again, current)
+	}
+}
+
+func TestReceiver_Wrap(t *testing.T) {
+	tests := []struct {
+		name       string
+		signingKey string
+		status     int
+		wantStatus int
+		wantCalled bool
+	}{{
+		name:       "Wrapped handler acknowledges with a 200",
+		signingKey: "key",
+		status:     http.StatusOK,
+		wantStatus: http.StatusOK,
+		wantCalled: true,
+	}, {
+		name:       "Wrapped handler retries with a 500",
+		signingKey: "key",
+		status:     http.StatusInternalServerError,
+		wantStatus: http.StatusInternalServerError,
+		wantCalled: true,
+	}, {
+		name:       "Wrapped handler is not called with a bad signature",
+		signingKey: "bad key",
+		status:     http.StatusOK,
+		wantStatus: http.StatusUnauthorized,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewReceiver(WithSigningKey("key"), WithNextSigningKey("next key"))
+			if err != nil {
+				t.Fatalf("NewReceiver() error = %v", err)
+			}
+			signature, err := GenerateSignature([]byte("message"), tt.signingKey, "Upstash", time.Minute)
+			if err != nil {
+				t.Fatalf("GenerateSignature() error = %v", err)
+			}
+			var called bool
+			h := q.Wrap(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				if bs, err := io.ReadAll(r.Body); err != nil {
+					t.Errorf("Receiver.Wrap() error reading body = %v", err)
+				} else if string(bs) != "message" {
+					t.Errorf("Receiver.Wrap() body = %s, want %s", bs, "message")
+				}
+				w.WriteHeader(tt.status)
+			})
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("message")))
+			r.Header.Set("Upstash-Signature", signature)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if called != tt.wantCalled {
+				t.Fatalf("Receiver.Wrap() called = %v, want %v", called, tt.wantCalled)
+			} else if w.Code != tt.wantStatus {
+				t.Fatalf("Receiver.Wrap() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+type mockReceiverMetrics struct {
+	statuses       []int
+	latencies      []time.Duration
+	verifyFailures int
+}
+
+func (m *mockReceiverMetrics) IncReceive(status int) {
+	m.statuses = append(m.statuses, status)
+}
+
+func (m *mockReceiverMetrics) ObserveHandlerLatency(d time.Duration) {
+	m.latencies = append(m.latencies, d)
+}
+
+func (m *mockReceiverMetrics) IncVerifyFailure() {
+	m.verifyFailures++
+}
+
+func TestReceiver_ReceiveMetrics(t *testing.T) {
+	tests := []struct {
+		name               string
+		signingKey         string
+		ack                bool
+		wantStatus         int
+		wantLatencies      int
+		wantVerifyFailures int
+	}{{
+		name:          "Receive an acknowledged message",
+		signingKey:    "key",
+		ack:           true,
+		wantStatus:    http.StatusOK,
+		wantLatencies: 1,
+	}, {
+		name:          "Receive an unacknowledged message",
+		signingKey:    "key",
+		wantStatus:    http.StatusUnprocessableEntity,
+		wantLatencies: 1,
+	}, {
+		name:               "Receive a message that fails verification",
+		signingKey:         "bad key",
+		wantStatus:         http.StatusUnauthorized,
+		wantVerifyFailures: 1,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := &mockReceiverMetrics{}
+			q, err := NewReceiver(
+				WithSigningKey("key"),
+				WithNextSigningKey("next key"),
+				WithReceiverMetrics(metrics),
+			)
+			if err != nil {
+				t.Fatalf("NewReceiver() error = %v", err)
+			}
+			signature, err := GenerateSignature([]byte("message"), tt.signingKey, "Upstash", time.Minute)
+			if err != nil {
+				t.Fatalf("GenerateSignature() error = %v", err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("message")))
+			r.Header.Set("Upstash-Signature", signature)
+			w := httptest.NewRecorder()
+			q.Receive(func(_ context.Context, m *Message) {
+				if tt.ack {
+					m.Ack()
+				}
+			}).ServeHTTP(w, r)
+			if len(metrics.statuses) != 1 || metrics.statuses[0] != tt.wantStatus {
+				t.Fatalf("ReceiverMetrics.IncReceive() statuses = %v, want [%v]", metrics.statuses, tt.wantStatus)
+			} else if len(metrics.latencies) != tt.wantLatencies {
+				t.Fatalf("ReceiverMetrics.ObserveHandlerLatency() calls = %v, want %v", len(metrics.latencies), tt.wantLatencies)
+			} else if metrics.verifyFailures != tt.wantVerifyFailures {
+				t.Fatalf("ReceiverMetrics.IncVerifyFailure() calls = %v, want %v", metrics.verifyFailures, tt.wantVerifyFailures)
+			}
+		})
+	}
+}
+
+func TestNewReceiverUnacknowledgedResponse(t *testing.T) {
+	for _, statusCode := range []int{http.StatusOK, http.StatusNoContent, 0, 600} {
+		if _, err := NewReceiver(WithSigningKey("key"), WithNextSigningKey("next key"), WithUnacknowledgedResponse(statusCode, "")); err == nil {
+			t.Fatalf("NewReceiver() with unacknowledged status %d error = %v, want an error", statusCode, err)
+		}
+	}
+}
+
+func TestReceiver_ReceiveOnVerificationFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		signingKey string
+		wantCalled bool
+	}{{
+		name:       "Verified message",
+		signingKey: "key",
+	}, {
+		name:       "Message with a bad signature",
+		signingKey: "bad key",
+		wantCalled: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotRequest *http.Request
+			var gotErr error
+			q, err := NewReceiver(
+				WithSigningKey("key"),
+				WithNextSigningKey("next key"),
+				WithOnVerificationFailure(func(r *http.Request, err error) {
+					gotRequest, gotErr = r, err
+				}),
+			)
+			if err != nil {
+				t.Fatalf("NewReceiver() error = %v", err)
+			}
+			signature, err := GenerateSignature([]byte("message"), tt.signingKey, "Upstash", time.Minute)
+			if err != nil {
+				t.Fatalf("GenerateSignature() error = %v", err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("message")))
+			r.RemoteAddr = "203.0.113.1:1234"
+			r.Header.Set("Upstash-Signature", signature)
+			w := httptest.NewRecorder()
+			q.Receive(func(_ context.Context, m *Message) { m.Ack() }).ServeHTTP(w, r)
+			if called := gotRequest != nil; called != tt.wantCalled {
+				t.Fatalf("Receiver.Receive() called the verification failure hook = %v, want %v", called, tt.wantCalled)
+			} else if !tt.wantCalled {
+				return
+			}
+			if gotRequest.RemoteAddr != r.RemoteAddr {
+				t.Fatalf("Receiver.Receive() hook remote address = %v, want %v", gotRequest.RemoteAddr, r.RemoteAddr)
+			} else if gotErr == nil || !strings.Contains(gotErr.Error(), "signature is invalid") {
+				t.Fatalf("Receiver.Receive() hook error = %v, want the failure reason", gotErr)
+			} else if strings.Contains(gotErr.Error(), "key") {
+				t.Fatalf("Receiver.Receive() hook error = %v, must not contain the signing key", gotErr)
+			} else if w.Code != http.StatusUnauthorized {
+				t.Fatalf("Receiver.Receive() status = %v, want %v", w.Code, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+func TestReceiver_verifyAudience(t *testing.T) {
+	tests := []struct {
+		name             string
+		audience         any
+		expectedAudience string
+		wantErr          bool
+	}{{
+		name:             "Matching audience is accepted",
+		audience:         "https://example.com/a",
+		expectedAudience: "https://example.com/a",
+	}, {
+		name:             "Audience list with a match is accepted",
+		audience:         []string{"https://example.com/b", "https://example.com/a"},
+		expectedAudience: "https://example.com/a",
+	}, {
+		name:             "Mismatching audience fails",
+		audience:         "https://example.com/b",
+		expectedAudience: "https://example.com/a",
+		wantErr:          true,
+	}, {
+		name:             "Missing audience fails",
+		expectedAudience: "https://example.com/a",
+		wantErr:          true,
+	}, {
+		name:     "Audience is not checked by default",
+		audience: "https://example.com/b",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := []byte("message")
+			bodyHash := sha256.Sum256(body)
+			claims := jwt.MapClaims{
+				"iss":  "Upstash",
+				"nbf":  time.Now().Unix(),
+				"exp":  time.Now().Add(time.Minute).Unix(),
+				"body": base64.URLEncoding.EncodeToString(bodyHash[:]),
+			}
+			if tt.audience != nil {
+				claims["aud"] = tt.audience
+			}
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("key"))
+			if err != nil {
+				t.Fatalf("jwt.Token.SignedString() error = %v", err)
+			}
+			q := Receiver{expectedIssuer: "Upstash", expectedAudience: tt.expectedAudience}
+			if _, err := q.verify(body, token, "key"); (err != nil) != tt.wantErr {
+				t.Fatalf("Receiver.verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReceiver_ReceiveRequireTLS(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []ReceiverOption
+		tls        bool
+		header     http.Header
+		wantStatus int
+	}{{
+		name:       "Receive over http is rejected",
+		opts:       []ReceiverOption{WithRequireTLS()},
+		wantStatus: http.StatusBadRequest,
+	}, {
+		name:       "Receive over https is accepted",
+		opts:       []ReceiverOption{WithRequireTLS()},
+		tls:        true,
+		wantStatus: http.StatusOK,
+	}, {
+		name:       "Receive forwarded from https is rejected by default",
+		opts:       []ReceiverOption{WithRequireTLS()},
+		header:     http.Header{"X-Forwarded-Proto": []string{"https"}},
+		wantStatus: http.StatusBadRequest,
+	}, {
+		name:       "Receive forwarded from https with a trusted header is accepted",
+		opts:       []ReceiverOption{WithRequireTLS(), WithForwardedProtoHeader("X-Forwarded-Proto")},
+		header:     http.Header{"X-Forwarded-Proto": []string{"https"}},
+		wantStatus: http.StatusOK,
+	}, {
+		name:       "Receive forwarded from http is rejected",
+		opts:       []ReceiverOption{WithRequireTLS(), WithForwardedProtoHeader("X-Forwarded-Proto")},
+		header:     http.Header{"X-Forwarded-Proto": []string{"http"}},
+		wantStatus: http.StatusBadRequest,
+	}, {
+		name:       "Receive forwarded from https with a custom header is accepted",
+		opts:       []ReceiverOption{WithRequireTLS(), WithForwardedProtoHeader("X-Scheme")},
+		header:     http.Header{"X-Scheme": []string{"https"}},
+		wantStatus: http.StatusOK,
+	}, {
+		name:       "Receive over http is accepted by default",
+		wantStatus: http.StatusOK,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewReceiver(append(tt.opts, WithSigningKey("key"), WithNextSigningKey("next key"))...)
+			if err != nil {
+				t.Fatalf("NewReceiver() error = %v", err)
+			}
+			signature, err := GenerateSignature([]byte("message"), "key", "Upstash", time.Minute)
+			if err != nil {
+				t.Fatalf("GenerateSignature() error = %v", err)
+			}
+			target := "http://example.com/"
+			if tt.tls {
+				target = "https://example.com/"
+			}
+			r := httptest.NewRequest(http.MethodPost, target, bytes.NewReader([]byte("message")))
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+			r.Header.Set("Upstash-Signature", signature)
+			w := httptest.NewRecorder()
+			q.Receive(func(_ context.Context, m *Message) {
+				m.Ack()
+			}).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Receiver.Receive() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestReceiver_ReceiveMaxMessageAge(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxAge      time.Duration
+		age         time.Duration
+		wantHandled bool
+	}{{
+		name:        "Receive a fresh message",
+		maxAge:      time.Hour,
+		age:         time.Minute,
+		wantHandled: true,
+	}, {
+		name:   "Drop a stale message",
+		maxAge: time.Hour,
+		age:    2 * time.Hour,
+	}, {
+		name:        "Receive a stale message without a max age",
+		age:         2 * time.Hour,
+		wantHandled: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewReceiver(WithSigningKey("key"), WithNextSigningKey("next key"), WithMaxMessageAge(tt.maxAge))
+			if err != nil {
+				t.Fatalf("NewReceiver() error = %v", err)
+			}
+			body := []byte("message")
+			bodyHash := sha256.Sum256(body)
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+				"iss":  "Upstash",
+				"iat":  time.Now().Add(-tt.age).Unix(),
+				"nbf":  time.Now().Add(-tt.age).Unix(),
+				"exp":  time.Now().Add(time.Minute).Unix(),
+				"body": base64.URLEncoding.EncodeToString(bodyHash[:]),
+			}).SignedString([]byte("key"))
+			if err != nil {
+				t.Fatalf("jwt.Token.SignedString() error = %v", err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+			r.Header.Set("Upstash-Signature", token)
+			w := httptest.NewRecorder()
+			var handled bool
+			q.Receive(func(_ context.Context, m *Message) {
+				handled = true
+				m.Ack()
+			}).ServeHTTP(w, r)
+			if handled != tt.wantHandled {
+				t.Fatalf("Receiver.Receive() handled = %v, want %v", handled, tt.wantHandled)
+			} else if w.Code != http.StatusOK {
+				t.Fatalf("Receiver.Receive() status = %v, want %v", w.Code, http.StatusOK)
+			}
+		})
+	}
+}
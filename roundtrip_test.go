@@ -0,0 +1,66 @@
+package qstash_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/marksalpeter/go-qstash"
+	"github.com/marksalpeter/go-qstash/qstashtest"
+)
+
+func TestRoundTripInProcess(t *testing.T) {
+	s := qstashtest.NewServer()
+	defer s.Close()
+
+	// Create a receiver behind a test server
+	r, err := qstash.NewReceiver(qstash.WithSigningKey(s.SigningKey), qstash.WithNextSigningKey(s.NextSigningKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan qstash.Message, 1)
+	receiver := httptest.NewServer(r.Receive(func(_ context.Context, m *qstash.Message) {
+		received <- *m
+		m.Ack()
+	}))
+	defer receiver.Close()
+
+	// Publish the message through the qstash test server
+	p, err := qstash.NewPublisher(receiver.URL, qstash.WithQStashURL(s.PublishURL()), qstash.WithQStashToken(s.Token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := qstash.Message{
+		Body: []byte("message"),
+	}
+	res, err := p.PublishWithResult(context.Background(), &send)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check that the received message matches the one we sent
+	select {
+	case m := <-received:
+		if m.ID != res.MessageID {
+			t.Errorf("expected message id %s, got %s", res.MessageID, m.ID)
+		} else if string(m.Body) != string(send.Body) {
+			t.Errorf("expected message body '%s', got '%s'", string(send.Body), string(m.Body))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not received")
+	}
+
+	// Check that the message was acknowledged
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(5 * time.Millisecond) {
+		if m, _ := s.Message(res.MessageID); m.State == qstashtest.StateDelivered {
+			break
+		}
+	}
+	if m, _ := s.Message(res.MessageID); len(m.Statuses) != 1 {
+		t.Fatalf("expected 1 delivery, got %d", len(m.Statuses))
+	} else if m.Statuses[0] != http.StatusOK {
+		t.Fatalf("expected the delivery to be acknowledged with %d, got %d", http.StatusOK, m.Statuses[0])
+	}
+}
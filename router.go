@@ -0,0 +1,57 @@
+package qstash
+
+import (
+	"context"
+)
+
+// Router dispatches received messages to the handler registered for their event type (see PublishEvent).
+// Messages with an event type that has no handler are passed to the fallback, or left
+// unacknowledged when there is none, so that qstash retries them.
+// Register the handlers before receiving messages, e.g. receiver.Receive(router.Receive)
+type Router struct {
+	handlers map[string]func(ctx context.Context, m *Message)
+	fallback func(ctx context.Context, m *Message)
+}
+
+// NewRouter returns a router without any handlers
+func NewRouter() *Router {
+	return &Router{
+		handlers: make(map[string]func(ctx context.Context, m *Message)),
+	}
+}
+
+// Handle registers the handler for messages with the event type, replacing any previous handler
+func (rt *Router) Handle(eventType string, onReceive func(ctx context.Context, m *Message)) {
+	rt.handlers[eventType] = onReceive
+}
+
+// Fallback registers the handler for messages with an event type that has no handler
+func (rt *Router) Fallback(onReceive func(ctx context.Context, m *Message)) {
+	rt.fallback = onReceive
+}
+
+// Receive dispatches the message to the handler for its event type
+func (rt *Router) Receive(ctx context.Context, m *Message) {
+	if onReceive, ok := rt.handlers[m.EventType()]; ok {
+		onReceive(ctx, m)
+	} else if rt.fallback != nil {
+		rt.fallback(ctx, m)
+	}
+}
+
+// HandleEvent registers a handler that receives the decoded events of type T published with PublishEvent.
+// Messages that can not be decoded are left unacknowledged
+func HandleEvent[T any](rt *Router, onEvent func(ctx context.Context, m *Message, event T)) error {
+	eventType, err := eventTypeOf[T]()
+	if err != nil {
+		return err
+	}
+	rt.Handle(eventType, func(ctx context.Context, m *Message) {
+		event, err := DecodeEvent[T](m)
+		if err != nil {
+			return
+		}
+		onEvent(ctx, m, event)
+	})
+	return nil
+}
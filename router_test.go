@@ -0,0 +1,117 @@
+package qstash
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type orderDeleted struct {
+	OrderID string `json:"orderId"`
+}
+
+func TestRouter_Receive(t *testing.T) {
+	tests := []struct {
+		name        string
+		eventType   string
+		body        string
+		fallback    bool
+		wantHandler string
+		wantOrderID string
+		wantStatus  int
+	}{{
+		name:        "Dispatch a created order",
+		eventType:   "orderCreated",
+		body:        `{"orderId":"order-id"}`,
+		wantHandler: "created",
+		wantOrderID: "order-id",
+		wantStatus:  http.StatusOK,
+	}, {
+		name:        "Dispatch a deleted order",
+		eventType:   "orderDeleted",
+		body:        `{"orderId":"order-id"}`,
+		wantHandler: "deleted",
+		wantOrderID: "order-id",
+		wantStatus:  http.StatusOK,
+	}, {
+		name:        "Dispatch a raw message",
+		eventType:   "ping",
+		wantHandler: "ping",
+		wantStatus:  http.StatusOK,
+	}, {
+		name:        "Dispatch an unknown event type to the fallback",
+		eventType:   "orderShipped",
+		fallback:    true,
+		wantHandler: "fallback",
+		wantStatus:  http.StatusOK,
+	}, {
+		name:       "Unknown event type without a fallback is not acknowledged",
+		eventType:  "orderShipped",
+		wantStatus: http.StatusUnprocessableEntity,
+	}, {
+		name:       "Event that can not be decoded is not acknowledged",
+		eventType:  "orderCreated",
+		body:       `not json`,
+		wantStatus: http.StatusUnprocessableEntity,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Register the handlers
+			var gotHandler, gotOrderID string
+			rt := NewRouter()
+			if err := HandleEvent(rt, func(_ context.Context, m *Message, event orderCreated) {
+				gotHandler, gotOrderID = "created", event.OrderID
+				m.Ack()
+			}); err != nil {
+				t.Fatalf("HandleEvent() error = %v", err)
+			}
+			if err := HandleEvent(rt, func(_ context.Context, m *Message, event *orderDeleted) {
+				gotHandler, gotOrderID = "deleted", event.OrderID
+				m.Ack()
+			}); err != nil {
+				t.Fatalf("HandleEvent() error = %v", err)
+			}
+			rt.Handle("ping", func(_ context.Context, m *Message) {
+				gotHandler = "ping"
+				m.Ack()
+			})
+			if tt.fallback {
+				rt.Fallback(func(_ context.Context, m *Message) {
+					gotHandler = "fallback"
+					m.Ack()
+				})
+			}
+
+			// Receive the message
+			q, err := NewReceiver(WithSigningKey("key"), WithNextSigningKey("next key"))
+			if err != nil {
+				t.Fatalf("NewReceiver() error = %v", err)
+			}
+			signature, err := GenerateSignature([]byte(tt.body), "key", "Upstash", time.Minute)
+			if err != nil {
+				t.Fatalf("GenerateSignature() error = %v", err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(tt.body)))
+			r.Header.Set("Upstash-Signature", signature)
+			r.Header.Set("Event-Type", tt.eventType)
+			w := httptest.NewRecorder()
+			q.Receive(rt.Receive).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Router.Receive() status = %v, want %v", w.Code, tt.wantStatus)
+			} else if gotHandler != tt.wantHandler {
+				t.Fatalf("Router.Receive() handler = %v, want %v", gotHandler, tt.wantHandler)
+			} else if gotOrderID != tt.wantOrderID {
+				t.Fatalf("Router.Receive() order id = %v, want %v", gotOrderID, tt.wantOrderID)
+			}
+		})
+	}
+}
+
+func TestHandleEvent(t *testing.T) {
+	if err := HandleEvent(NewRouter(), func(context.Context, *Message, map[string]string) {}); err == nil {
+		t.Fatalf("HandleEvent() with an unnamed type error = %v, want an error", err)
+	}
+}
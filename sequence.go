@@ -0,0 +1,187 @@
+package qstash
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sequenceHeader and streamIDHeader order the messages published with WithSequence.
+// qstash strips the 'Upstash-Forward-' prefix when it delivers the message
+const (
+	sequenceHeader = "Sequence"
+	streamIDHeader = "Stream-Id"
+)
+
+// sequenceStreamTTL is how long a Sequencer keeps the position of a stream that has no messages
+const sequenceStreamTTL = 24 * time.Hour
+
+// Sequencer processes the messages of each stream published with WithSequence in order.
+// A message that arrives ahead of its turn is held until the messages before it have been
+// acknowledged. If its turn does not come within the timeout the message is not acknowledged,
+// so that qstash retries it later. Messages that were already acknowledged are acknowledged
+// again without calling the handler and messages without a sequence are handled right away.
+//
+// Note: the position of each stream is kept in memory, so every message of a stream must be
+// delivered to the same process. A publish that fails without a response from qstash may leave
+// a gap that blocks its stream until the timeout runs out on every retry. The position of a stream
+// that has had no messages for 24 hours is forgotten, e.g. after its publisher restarted with a new stream
+type Sequencer struct {
+	timeout time.Duration
+	ttl     time.Duration
+	mu      sync.Mutex
+	streams map[string]*sequenceStream
+	evicted time.Time
+}
+
+// sequenceStream is the position of a stream
+type sequenceStream struct {
+	next    uint64
+	busy    bool
+	changed chan struct{}
+	// waiting is the number of messages waiting for their turn and lastUsed is when a message last waited or was handled
+	waiting  int
+	lastUsed time.Time
+}
+
+// NewSequencer returns a sequencer that holds out of order messages for up to the timeout
+func NewSequencer(timeout time.Duration) *Sequencer {
+	return &Sequencer{
+		timeout: timeout,
+		ttl:     sequenceStreamTTL,
+		streams: make(map[string]*sequenceStream),
+		evicted: time.Now(),
+	}
+}
+
+// Receive wraps the receive handler so that it handles the messages of each stream in order,
+// e.g. receiver.Receive(sequencer.Receive(onReceive))
+func (s *Sequencer) Receive(onReceive func(ctx context.Context, m *Message)) func(ctx context.Context, m *Message) {
+	return func(ctx context.Context, m *Message) {
+		streamID := m.Headers.Get(streamIDHeader)
+		sequence, err := strconv.ParseUint(m.Headers.Get(sequenceHeader), 10, 64)
+		if len(streamID) == 0 || err != nil {
+			onReceive(ctx, m)
+			return
+		}
+
+		// Wait for the message's turn
+		st, ok, duplicate := s.wait(ctx, streamID, sequence)
+		if duplicate {
+			m.Ack()
+			return
+		} else if !ok {
+			return
+		}
+
+		// Handle the message and move the stream on once it is acknowledged
+		defer func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			st.busy = false
+			st.lastUsed = time.Now()
+			if m.isAcknowledged {
+				st.next++
+			}
+			close(st.changed)
+			st.changed = make(chan struct{})
+		}()
+		onReceive(ctx, m)
+	}
+}
+
+// wait blocks until the sequence is next in the stream and no other message of the stream is being handled.
+// ok is false if the timeout or the context ran out first and duplicate is true if the sequence was already handled
+func (s *Sequencer) wait(ctx context.Context, streamID string, sequence uint64) (_ *sequenceStream, ok, duplicate bool) {
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evictIdle()
+	st, found := s.streams[streamID]
+	if !found {
+		st = &sequenceStream{next: 1, changed: make(chan struct{})}
+		s.streams[streamID] = st
+	}
+	st.waiting++
+	defer func() {
+		st.waiting--
+		st.lastUsed = time.Now()
+	}()
+	for {
+		if sequence < st.next {
+			return st, false, true
+		} else if sequence == st.next && !st.busy {
+			st.busy = true
+			return st, true, false
+		}
+		changed := st.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+			s.mu.Lock()
+		case <-timer.C:
+			s.mu.Lock()
+			return st, false, false
+		case <-ctx.Done():
+			s.mu.Lock()
+			return st, false, false
+		}
+	}
+}
+
+// evictIdle removes the streams that have had no messages for longer than the ttl.
+// It checks the streams at most once per ttl. The sequencer must be locked
+func (s *Sequencer) evictIdle() {
+	now := time.Now()
+	if now.Sub(s.evicted) < s.ttl {
+		return
+	}
+	s.evicted = now
+	for id, st := range s.streams {
+		if !st.busy && st.waiting == 0 && now.Sub(st.lastUsed) >= s.ttl {
+			delete(s.streams, id)
+		}
+	}
+}
+
+// destinationSequence is the stream of the messages published to a destination
+// and the last sequence number used in it
+type destinationSequence struct {
+	mu       sync.Mutex
+	streamID string
+	last     uint64
+}
+
+// nextSequence numbers the request with the next sequence of its destination and returns a function
+// that must be called once the message is published. The destination is locked until then, so that
+// the next message only gets the next number if this one was published, rather than leaving a gap.
+// A message that qstash may have accepted, e.g. when no response was received, counts as published
+func (q *Publisher) nextSequence(r *http.Request, destination string) func(published bool) {
+	if len(q.streamID) == 0 {
+		return func(bool) {}
+	}
+	q.sequencesMu.Lock()
+	if q.sequences == nil {
+		q.sequences = make(map[string]*destinationSequence)
+	}
+	seq, ok := q.sequences[destination]
+	if !ok {
+		seq = &destinationSequence{streamID: fmt.Sprintf("%s-%d", q.streamID, len(q.sequences)+1)}
+		q.sequences[destination] = seq
+	}
+	q.sequencesMu.Unlock()
+
+	seq.mu.Lock()
+	r.Header.Set("Upstash-Forward-"+streamIDHeader, seq.streamID)
+	r.Header.Set("Upstash-Forward-"+sequenceHeader, strconv.FormatUint(seq.last+1, 10))
+	return func(published bool) {
+		defer seq.mu.Unlock()
+		if published {
+			seq.last++
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package qstash
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newSequencedMessage returns a message in the stream with the sequence
+func newSequencedMessage(streamID string, sequence int) (*Message, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	return &Message{
+		Headers: http.Header{
+			"Stream-Id": []string{streamID},
+			"Sequence":  []string{strconv.Itoa(sequence)},
+		},
+		w: w,
+	}, w
+}
+
+func TestSequencer_Receive(t *testing.T) {
+	tests := []struct {
+		name        string
+		sequences   []int
+		concurrent  bool
+		wantHandled []int
+		wantAcked   []bool
+	}{{
+		name:        "Receive in order",
+		sequences:   []int{1, 2, 3},
+		wantHandled: []int{1, 2, 3},
+		wantAcked:   []bool{true, true, true},
+	}, {
+		name:        "Receive out of order",
+		sequences:   []int{3, 2, 1},
+		concurrent:  true,
+		wantHandled: []int{1, 2, 3},
+		wantAcked:   []bool{true, true, true},
+	}, {
+		name:        "Receive a gap",
+		sequences:   []int{1, 3},
+		wantHandled: []int{1},
+		wantAcked:   []bool{true, false},
+	}, {
+		name:        "Receive a duplicate",
+		sequences:   []int{1, 2, 1},
+		wantHandled: []int{1, 2},
+		wantAcked:   []bool{true, true, true},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSequencer(50 * time.Millisecond)
+			var mu sync.Mutex
+			var handled []int
+			h := s.Receive(func(_ context.Context, m *Message) {
+				sequence, _ := strconv.Atoi(m.Headers.Get("Sequence"))
+				mu.Lock()
+				handled = append(handled, sequence)
+				mu.Unlock()
+				m.Ack()
+			})
+
+			// Receive the messages
+			var wg sync.WaitGroup
+			acked := make([]bool, len(tt.sequences))
+			for i, sequence := range tt.sequences {
+				receive := func(i, sequence int) {
+					defer wg.Done()
+					m, w := newSequencedMessage("stream", sequence)
+					h(context.Background(), m)
+					acked[i] = w.Code == http.StatusOK && m.isAcknowledged
+				}
+				wg.Add(1)
+				if tt.concurrent {
+					go receive(i, sequence)
+					time.Sleep(5 * time.Millisecond)
+				} else {
+					receive(i, sequence)
+				}
+			}
+			wg.Wait()
+
+			// Check the order
+			if !equalInts(handled, tt.wantHandled) {
+				t.Fatalf("Sequencer.Receive() handled = %v, want %v", handled, tt.wantHandled)
+			}
+			for i := range acked {
+				if acked[i] != tt.wantAcked[i] {
+					t.Fatalf("Sequencer.Receive() acked = %v, want %v", acked, tt.wantAcked)
+				}
+			}
+		})
+	}
+}
+
+func TestSequencer_ReceiveWithoutSequence(t *testing.T) {
+	var called bool
+	h := NewSequencer(time.Millisecond).Receive(func(_ context.Context, m *Message) {
+		called = true
+		m.Ack()
+	})
+	h(context.Background(), &Message{Headers: http.Header{}, w: httptest.NewRecorder()})
+	if !called {
+		t.Fatalf("Sequencer.Receive() did not call the handler for a message without a sequence")
+	}
+}
+
+func TestSequencer_ReceiveEvictsIdleStreams(t *testing.T) {
+	s := NewSequencer(10 * time.Millisecond)
+	s.ttl = 20 * time.Millisecond
+	h := s.Receive(func(_ context.Context, m *Message) {
+		m.Ack()
+	})
+	m, _ := newSequencedMessage("old-stream", 1)
+	h(context.Background(), m)
+	time.Sleep(2 * s.ttl)
+
+	// The next message evicts the idle stream
+	m, _ = newSequencedMessage("new-stream", 1)
+	h(context.Background(), m)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.streams["old-stream"]; ok {
+		t.Fatalf("Sequencer.Receive() kept the idle stream")
+	} else if _, ok := s.streams["new-stream"]; !ok {
+		t.Fatalf("Sequencer.Receive() evicted the active stream")
+	}
+}
+
+func TestPublisher_PublishWithSequence(t *testing.T) {
+	q, err := NewPublisher("topic", WithQStashToken("token"), WithSequence())
+	if err != nil {
+		t.Fatalf("NewPublisher() error = %v", err)
+	}
+	client := &mockRecordingClient{}
+	q.client = client
+	for i := 0; i < 3; i++ {
+		if err := q.Publish(context.TODO(), &Message{Body: []byte("message")}); err != nil {
+			t.Fatalf("Publisher.Publish() error = %v", err)
+		}
+	}
+	for i, r := range client.requests {
+		if got, want := r.Header.Get("Upstash-Forward-Sequence"), strconv.Itoa(i+1); got != want {
+			t.Fatalf("Publisher.Publish() sequence = %v, want %v", got, want)
+		} else if got, want := r.Header.Get("Upstash-Forward-Stream-Id"), q.streamID+"-1"; got != want || len(q.streamID) == 0 {
+			t.Fatalf("Publisher.Publish() stream id = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPublisher_PublishWithSequenceWithoutGaps(t *testing.T) {
+	q, err := NewPublisher("topic", WithQStashToken("token"), WithSequence())
+	if err != nil {
+		t.Fatalf("NewPublisher() error = %v", err)
+	}
+	steps := []struct {
+		name         string
+		destinations []string
+		statusCode   int
+		wantSequence []string
+	}{{
+		name:         "Publish to a",
+		destinations: []string{"https://a.example.com"},
+		statusCode:   http.StatusOK,
+		wantSequence: []string{"1"},
+	}, {
+		name:         "Rejected publish to a does not use up its number",
+		destinations: []string{"https://a.example.com"},
+		statusCode:   http.StatusBadRequest,
+		wantSequence: []string{"2"},
+	}, {
+		name:         "Publish to a after the rejected publish",
+		destinations: []string{"https://a.example.com"},
+		statusCode:   http.StatusOK,
+		wantSequence: []string{"2"},
+	}, {
+		name:         "Publish to many numbers each destination",
+		destinations: []string{"https://a.example.com", "https://b.example.com"},
+		statusCode:   http.StatusOK,
+		wantSequence: []string{"3", "1"},
+	}}
+	for _, step := range steps {
+		var client *mockRecordingClient
+		var statusClient *mockStatusClient
+		if step.statusCode == http.StatusOK {
+			client = &mockRecordingClient{}
+			q.client = client
+		} else {
+			statusClient = &mockStatusClient{statusCode: step.statusCode}
+			q.client = statusClient
+		}
+		var targets []PublishTarget
+		for _, destination := range step.destinations {
+			targets = append(targets, PublishTarget{URL: destination})
+		}
+		_, err := q.PublishToMany(context.TODO(), &Message{Body: []byte("message")}, targets)
+		if got := err != nil; got != (statusClient != nil) {
+			t.Fatalf("%s: Publisher.PublishToMany() error = %v", step.name, err)
+		}
+		if statusClient != nil {
+			if got := statusClient.r.Header.Get("Upstash-Forward-Sequence"); got != step.wantSequence[0] {
+				t.Fatalf("%s: Publisher.PublishToMany() sequence = %v, want %v", step.name, got, step.wantSequence[0])
+			}
+			continue
+		}
+		streamIDs := map[string]bool{}
+		for i, r := range client.requests {
+			if got := r.Header.Get("Upstash-Forward-Sequence"); got != step.wantSequence[i] {
+				t.Fatalf("%s: Publisher.PublishToMany() sequence = %v, want %v", step.name, got, step.wantSequence[i])
+			}
+			streamIDs[r.Header.Get("Upstash-Forward-Stream-Id")] = true
+		}
+		if len(streamIDs) != len(step.destinations) {
+			t.Fatalf("%s: Publisher.PublishToMany() stream ids = %v, want one for each destination", step.name, len(streamIDs))
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package qstash
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Tracer starts the spans of published and received messages (see WithTracer and WithReceiverTracer).
+// It is a small subset of OpenTelemetry's tracing api, so that this package does not depend on
+// OpenTelemetry. The qstashotel package adapts an OpenTelemetry tracer, e.g. qstashotel.WithTracer(tracer)
+type Tracer interface {
+	// Start starts a span with the name and returns the context that carries it
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	// SetAttribute sets an attribute of the span. The value is a string or an int
+	SetAttribute(key string, value any)
+	// RecordError records the error that failed the span
+	RecordError(err error)
+	// End ends the span
+	End()
+}
+
+// Span names and attributes
+const (
+	publishSpanName      = "qstash.publish"
+	receiveSpanName      = "qstash.receive"
+	destinationAttribute = "qstash.destination"
+	messageIDAttribute   = "qstash.message_id"
+	statusAttribute      = "qstash.status"
+	attemptsAttribute    = "qstash.attempts"
+	retriedAttribute     = "qstash.retried"
+)
+
+// spanKey is the context key of the span that the publish request reports its status to
+type spanKey struct{}
+
+// withSpan returns a context that carries the span
+func withSpan(ctx context.Context, span Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// setSpanAttribute sets an attribute of the span in the context, if there is one
+func setSpanAttribute(ctx context.Context, key string, value any) {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		span.SetAttribute(key, value)
+	}
+}
+
+// tracePublish publishes the message in a span when the publisher has a tracer
+func (q *Publisher) tracePublish(ctx context.Context, destination string, publish func(ctx context.Context) (*PublishResult, error)) (*PublishResult, error) {
+	if q.tracer == nil {
+		return publish(ctx)
+	}
+	ctx, span := q.tracer.Start(ctx, publishSpanName)
+	defer span.End()
+	span.SetAttribute(destinationAttribute, destination)
+	res, err := publish(withSpan(ctx, span))
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	if len(res.MessageID) > 0 {
+		span.SetAttribute(messageIDAttribute, res.MessageID)
+	}
+	if res.Attempts > 0 {
+		span.SetAttribute(attemptsAttribute, res.Attempts)
+	}
+	return res, nil
+}
+
+// traceReceive starts the span of a received request when the receiver has a tracer.
+// done ends the span with the response status code
+func (q *Receiver) traceReceive(r *http.Request) (_ context.Context, done func(status int)) {
+	if q.tracer == nil {
+		return r.Context(), func(int) {}
+	}
+	ctx, span := q.tracer.Start(r.Context(), receiveSpanName)
+	span.SetAttribute(messageIDAttribute, r.Header.Get("Upstash-Message-Id"))
+	if retried, err := strconv.Atoi(r.Header.Get("Upstash-Retried")); err == nil {
+		span.SetAttribute(retriedAttribute, retried)
+	}
+	return ctx, func(status int) {
+		span.SetAttribute(statusAttribute, status)
+		if status < 200 || status > 299 {
+			span.RecordError(fmt.Errorf("receiver responded with status %d", status))
+		}
+		span.End()
+	}
+}
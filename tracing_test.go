@@ -0,0 +1,180 @@
+package qstash
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockSpan records its attributes and errors
+type mockSpan struct {
+	name       string
+	attributes map[string]any
+	errs       []error
+	ended      bool
+}
+
+func (s *mockSpan) SetAttribute(key string, value any) {
+	s.attributes[key] = value
+}
+
+func (s *mockSpan) RecordError(err error) {
+	s.errs = append(s.errs, err)
+}
+
+func (s *mockSpan) End() {
+	s.ended = true
+}
+
+// mockTracer records the spans it starts in memory
+type mockTracer struct {
+	mu    sync.Mutex
+	spans []*mockSpan
+}
+
+func (t *mockTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	span := &mockSpan{name: name, attributes: make(map[string]any)}
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+func TestPublisher_PublishTracer(t *testing.T) {
+	tests := []struct {
+		name   string
+		client interface {
+			Do(*http.Request) (*http.Response, error)
+		}
+		wantAttributes map[string]any
+		wantErr        bool
+	}{{
+		name:   "Publish records a span",
+		client: &mockClient{},
+		wantAttributes: map[string]any{
+			destinationAttribute: "topic",
+			messageIDAttribute:   "mock-id",
+			statusAttribute:      http.StatusOK,
+			attemptsAttribute:    1,
+		},
+	}, {
+		name:   "Publish records a failed status",
+		client: &mockStatusClient{statusCode: http.StatusBadRequest},
+		wantAttributes: map[string]any{
+			destinationAttribute: "topic",
+			statusAttribute:      http.StatusBadRequest,
+		},
+		wantErr: true,
+	}, {
+		name:   "Publish records a network error",
+		client: &mockErrorClient{err: errors.New("connection reset by peer")},
+		wantAttributes: map[string]any{
+			destinationAttribute: "topic",
+		},
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracer := &mockTracer{}
+			q := &Publisher{
+				token:  "token",
+				url:    "url",
+				topic:  "topic",
+				client: tt.client,
+				uuid:   &mockUUID{uuid: "uuid"},
+				tracer: tracer,
+			}
+			if err := q.Publish(context.TODO(), &Message{Body: []byte("message")}); (err != nil) != tt.wantErr {
+				t.Fatalf("Publisher.Publish() error = %v, wantErr %v", err, tt.wantErr)
+			} else if len(tracer.spans) != 1 {
+				t.Fatalf("Publisher.Publish() spans = %v, want 1 span", len(tracer.spans))
+			}
+			span := tracer.spans[0]
+			if span.name != publishSpanName {
+				t.Fatalf("Publisher.Publish() span name = %v, want %v", span.name, publishSpanName)
+			} else if !span.ended {
+				t.Fatalf("Publisher.Publish() did not end the span")
+			} else if (len(span.errs) > 0) != tt.wantErr {
+				t.Fatalf("Publisher.Publish() span errors = %v, wantErr %v", span.errs, tt.wantErr)
+			} else if len(span.attributes) != len(tt.wantAttributes) {
+				t.Fatalf("Publisher.Publish() span attributes = %v, want %v", span.attributes, tt.wantAttributes)
+			}
+			for k, v := range tt.wantAttributes {
+				if span.attributes[k] != v {
+					t.Fatalf("Publisher.Publish() span attribute %s = %v, want %v", k, span.attributes[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestReceiver_ReceiveTracer(t *testing.T) {
+	tests := []struct {
+		name       string
+		signed     bool
+		ack        bool
+		wantStatus int
+		wantErr    bool
+	}{{
+		name:       "Receive records an acknowledged message",
+		signed:     true,
+		ack:        true,
+		wantStatus: http.StatusOK,
+	}, {
+		name:       "Receive records an unacknowledged message",
+		signed:     true,
+		wantStatus: http.StatusUnprocessableEntity,
+		wantErr:    true,
+	}, {
+		name:       "Receive records a verification failure",
+		wantStatus: http.StatusUnauthorized,
+		wantErr:    true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracer := &mockTracer{}
+			q, err := NewReceiver(WithSigningKey("key"), WithNextSigningKey("next key"), WithReceiverTracer(tracer))
+			if err != nil {
+				t.Fatalf("NewReceiver() error = %v", err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("message")))
+			r.Header.Set("Upstash-Message-Id", "msg_1")
+			r.Header.Set("Upstash-Retried", "2")
+			if tt.signed {
+				signature, err := GenerateSignature([]byte("message"), "key", "Upstash", time.Minute)
+				if err != nil {
+					t.Fatalf("GenerateSignature() error = %v", err)
+				}
+				r.Header.Set("Upstash-Signature", signature)
+			}
+			w := httptest.NewRecorder()
+			q.Receive(func(_ context.Context, m *Message) {
+				if tt.ack {
+					m.Ack()
+				}
+			}).ServeHTTP(w, r)
+			if len(tracer.spans) != 1 {
+				t.Fatalf("Receiver.Receive() spans = %v, want 1 span", len(tracer.spans))
+			}
+			span := tracer.spans[0]
+			if span.name != receiveSpanName {
+				t.Fatalf("Receiver.Receive() span name = %v, want %v", span.name, receiveSpanName)
+			} else if !span.ended {
+				t.Fatalf("Receiver.Receive() did not end the span")
+			} else if span.attributes[statusAttribute] != tt.wantStatus {
+				t.Fatalf("Receiver.Receive() span status = %v, want %v", span.attributes[statusAttribute], tt.wantStatus)
+			} else if span.attributes[messageIDAttribute] != "msg_1" {
+				t.Fatalf("Receiver.Receive() span message id = %v, want %v", span.attributes[messageIDAttribute], "msg_1")
+			} else if span.attributes[retriedAttribute] != 2 {
+				t.Fatalf("Receiver.Receive() span retried = %v, want %v", span.attributes[retriedAttribute], 2)
+			} else if (len(span.errs) > 0) != tt.wantErr {
+				t.Fatalf("Receiver.Receive() span errors = %v, wantErr %v", span.errs, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,27 +2,78 @@ package qstash
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"io"
+	"log"
 	"math/big"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
+// uuid generates random base62 encoded ids
 type uuid struct {
+	// size is the number of random bytes in each id. The default is 16
+	size int
+	// random is the source of the random bytes. The default is crypto/rand
+	random io.Reader
 }
 
+// fallbackCounter numbers the ids generated without the random source
+var fallbackCounter atomic.Uint64
 
 // NewV4 is a 16 byte universally unique identifier
-// generated for each message published with this package by default
-func (*uuid) NewV4() (string, error) {
-	// Generate a random uuid
-	uuid := make([]byte, 16)
-	_, err := io.ReadFull(rand.Reader, uuid[:])
-	if err != nil {
-		return "", err
+// generated for each message published with this package by default.
+// Ids of other sizes (see WithIDBytes) are random bytes without the uuid version bits
+func (u *uuid) NewV4() (string, error) {
+	size := u.size
+	if size == 0 {
+		size = 16
 	}
-	uuid[6] = (uuid[6] & 0x0f) | 0x40 // Version 4
-	uuid[8] = (uuid[8] & 0x3f) | 0x80 // Variant is 10
-	// Base62 encode the uuid
+	random := u.random
+	if random == nil {
+		random = rand.Reader
+	}
+	// Generate a random uuid, falling back to a time based id if the random source fails
+	uuid := make([]byte, size)
+	if _, err := io.ReadFull(random, uuid[:]); err != nil {
+		log.Printf("WARNING: qstash: could not generate a random id, falling back to a time based id: %v", err)
+		fallbackID(uuid)
+	}
+	if size == 16 {
+		uuid[6] = (uuid[6] & 0x0f) | 0x40 // Version 4
+		uuid[8] = (uuid[8] & 0x3f) | 0x80 // Variant is 10
+	}
+	// Base62 encode the uuid, padded to the length of the largest id of this size
 	var i big.Int
 	i.SetBytes(uuid)
-	return i.Text(62), nil
-}	
\ No newline at end of file
+	id := i.Text(62)
+	if n := base62Len(size); len(id) < n {
+		id = strings.Repeat("0", n-len(id)) + id
+	}
+	return id, nil
+}
+
+// base62Len returns the length of the base62 encoding of the largest number with size bytes
+func base62Len(size int) int {
+	var max big.Int
+	max.Lsh(big.NewInt(1), uint(size*8))
+	max.Sub(&max, big.NewInt(1))
+	return len(max.Text(62))
+}
+
+// fallbackID fills the id with bytes derived from the time, the process id and a counter.
+// The ids are unique but predictable, so they are only used when the random source fails
+func fallbackID(id []byte) {
+	seed := make([]byte, 28)
+	binary.BigEndian.PutUint64(seed[0:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint64(seed[8:], fallbackCounter.Add(1))
+	binary.BigEndian.PutUint64(seed[16:], uint64(os.Getpid()))
+	for i := 0; i < len(id); i += sha256.Size {
+		binary.BigEndian.PutUint32(seed[24:], uint32(i))
+		sum := sha256.Sum256(seed)
+		copy(id[i:], sum[:])
+	}
+}
@@ -0,0 +1,67 @@
+package qstash
+
+import (
+	"errors"
+	"testing"
+	"testing/iotest"
+)
+
+func TestUUID_NewV4(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		wantLen int
+	}{{
+		name:    "Default size",
+		wantLen: 22,
+	}, {
+		name:    "8 bytes",
+		size:    8,
+		wantLen: 11,
+	}, {
+		name:    "16 bytes",
+		size:    16,
+		wantLen: 22,
+	}, {
+		name:    "32 bytes",
+		size:    32,
+		wantLen: 43,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &uuid{size: tt.size}
+			seen := make(map[string]bool)
+			for i := 0; i < 100; i++ {
+				id, err := u.NewV4()
+				if err != nil {
+					t.Fatalf("uuid.NewV4() error = %v", err)
+				} else if len(id) != tt.wantLen {
+					t.Fatalf("uuid.NewV4() = %v with length %d, want length %d", id, len(id), tt.wantLen)
+				} else if seen[id] {
+					t.Fatalf("uuid.NewV4() = %v, generated twice", id)
+				}
+				seen[id] = true
+			}
+		})
+	}
+}
+
+func TestUUID_NewV4Fallback(t *testing.T) {
+	for _, size := range []int{8, 16, 64} {
+		u := &uuid{size: size, random: iotest.ErrReader(errors.New("entropy source failed"))}
+		seen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			id, err := u.NewV4()
+			if err != nil {
+				t.Fatalf("uuid.NewV4() error = %v", err)
+			} else if len(id) != base62Len(size) {
+				t.Fatalf("uuid.NewV4() = %v with length %d, want length %d", id, len(id), base62Len(size))
+			} else if err := validateDeduplicationID(id); err != nil {
+				t.Fatalf("uuid.NewV4() = %v is not a usable deduplication id: %v", id, err)
+			} else if seen[id] {
+				t.Fatalf("uuid.NewV4() = %v, generated twice", id)
+			}
+			seen[id] = true
+		}
+	}
+}
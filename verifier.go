@@ -0,0 +1,42 @@
+package qstash
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Verifier verifies that a request was sent by qstash and returns the claims of its signature.
+// The body has already been read from the request.
+// Implement it to verify messages in topologies the default signature check does not cover,
+// e.g. when a gateway re-signs the requests from qstash (see WithVerifier)
+type Verifier interface {
+	Verify(r *http.Request, body []byte) (jwt.MapClaims, error)
+}
+
+// VerifierFunc is an adapter to allow the use of ordinary functions as verifiers
+type VerifierFunc func(r *http.Request, body []byte) (jwt.MapClaims, error)
+
+// Verify calls f(r, body)
+func (f VerifierFunc) Verify(r *http.Request, body []byte) (jwt.MapClaims, error) {
+	return f(r, body)
+}
+
+// verifySignature is the default verifier. It checks the body hash of the jwt in the
+// signature header against the signing key and then the next signing key
+func (q *Receiver) verifySignature(r *http.Request, body []byte) (jwt.MapClaims, error) {
+	tokenString := r.Header.Get(q.signatureHeader)
+	claims, err := q.verify(body, tokenString, q.signingKey)
+	if err != nil {
+		// Try the next signing key
+		return q.verify(body, tokenString, q.nextSigningKey)
+	}
+	return claims, nil
+}
+
+// skipVerify accepts every request without verifying it (see WithInsecureSkipVerify)
+func skipVerify(r *http.Request, _ []byte) (jwt.MapClaims, error) {
+	log.Printf("qstash: WARNING signature verification is disabled, accepting unverified request %s %s", r.Method, r.URL)
+	return jwt.MapClaims{}, nil
+}
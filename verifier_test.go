@@ -0,0 +1,120 @@
+package qstash
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestReceiver_ReceiveWithVerifier(t *testing.T) {
+	publishedAt := time.Unix(1700000000, 0)
+	// gateway trusts the upstash claims forwarded by a gateway that verified the outer signature
+	gateway := VerifierFunc(func(r *http.Request, body []byte) (jwt.MapClaims, error) {
+		if r.Header.Get("X-Gateway-Token") != "secret" {
+			return nil, errors.New("bad gateway token")
+		}
+		return jwt.MapClaims{"iat": float64(publishedAt.Unix())}, nil
+	})
+	tests := []struct {
+		name               string
+		token              string
+		wantStatus         int
+		wantPublishedAt    bool
+		wantVerifyFailures int
+	}{{
+		name:            "Custom verifier accepts the message",
+		token:           "secret",
+		wantStatus:      http.StatusOK,
+		wantPublishedAt: true,
+	}, {
+		name:               "Custom verifier rejects the message",
+		token:              "wrong",
+		wantStatus:         http.StatusUnauthorized,
+		wantVerifyFailures: 1,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := &mockReceiverMetrics{}
+			q, err := NewReceiver(WithSigningKey(""), WithNextSigningKey(""), WithVerifier(gateway), WithReceiverMetrics(metrics))
+			if err != nil {
+				t.Fatalf("NewReceiver() error = %v", err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("message")))
+			r.Header.Set("X-Gateway-Token", tt.token)
+			w := httptest.NewRecorder()
+			var got time.Time
+			q.Receive(func(_ context.Context, m *Message) {
+				got, _ = m.PublishedAt()
+				m.Ack()
+			}).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Receiver.Receive() status = %v, want %v", w.Code, tt.wantStatus)
+			} else if tt.wantPublishedAt && !got.Equal(publishedAt) {
+				t.Fatalf("Message.PublishedAt() = %v, want %v", got, publishedAt)
+			} else if metrics.verifyFailures != tt.wantVerifyFailures {
+				t.Fatalf("Receiver.Receive() verify failures = %v, want %v", metrics.verifyFailures, tt.wantVerifyFailures)
+			}
+		})
+	}
+}
+
+func TestNewReceiverRequiresSigningKeysWithoutVerifier(t *testing.T) {
+	if _, err := NewReceiver(WithSigningKey(""), WithNextSigningKey("")); err == nil {
+		t.Fatalf("NewReceiver() error = %v, want an error without signing keys", err)
+	}
+}
+
+func TestReceiver_ReceiveInsecureSkipVerify(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        []ReceiverOption
+		env         string
+		wantStatus  int
+		wantWarning bool
+	}{{
+		name:        "Option and environment gate skip verification",
+		opts:        []ReceiverOption{WithInsecureSkipVerify()},
+		env:         "true",
+		wantStatus:  http.StatusOK,
+		wantWarning: true,
+	}, {
+		name:       "Option without the environment gate verifies",
+		opts:       []ReceiverOption{WithInsecureSkipVerify()},
+		wantStatus: http.StatusUnauthorized,
+	}, {
+		name:       "Environment gate without the option verifies",
+		env:        "true",
+		wantStatus: http.StatusUnauthorized,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("QSTASH_INSECURE_SKIP_VERIFY", tt.env)
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+			q, err := NewReceiver(append(tt.opts, WithSigningKey("key"), WithNextSigningKey("next key"))...)
+			if err != nil {
+				t.Fatalf("NewReceiver() error = %v", err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("message")))
+			w := httptest.NewRecorder()
+			q.Receive(func(_ context.Context, m *Message) {
+				m.Ack()
+			}).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Receiver.Receive() status = %v, want %v", w.Code, tt.wantStatus)
+			} else if gotWarning := strings.Contains(logs.String(), "WARNING"); gotWarning != tt.wantWarning {
+				t.Fatalf("Receiver.Receive() warning = %v, want %v", gotWarning, tt.wantWarning)
+			}
+		})
+	}
+}